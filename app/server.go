@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/codecrafters-io/redis-starter-go/protocol"
 	"github.com/jessevdk/go-flags"
@@ -19,10 +21,6 @@ func main() {
 
 	opts.Config()
 
-	if opts.Role != "master" {
-		go connectToMaster(opts)
-	}
-
 	runMaster(opts)
 }
 
@@ -35,6 +33,52 @@ func runMaster(o protocol.Opts) {
 
 	mc := protocol.NewMasterConfig()
 
+	if o.AOFRestoreUntil > 0 && o.AppendOnly != "yes" {
+		fmt.Println("The dataset is restored from the append-only file, appendonly must be yes")
+		os.Exit(1)
+	}
+
+	if err := protocol.ConfigureReplication(o); err != nil {
+		fmt.Println("Invalid replication options:", err.Error())
+		os.Exit(1)
+	}
+
+	if o.AppendOnly == "yes" {
+		// the append-only file is the most complete copy of the dataset
+		// and is replayed before accepting any client
+		if err := protocol.LoadAOF(o); err != nil {
+			fmt.Println("Failed to load the append-only file:", err.Error())
+			os.Exit(1)
+		}
+
+		if o.Role != "master" {
+			protocol.ReplicateMaster(o)
+		}
+	} else {
+		// clients are accepted while loading so they can be told the dataset isn't ready
+		loaded := protocol.LoadRDB(o)
+		go func() {
+			if err := <-loaded; err != nil {
+				fmt.Println("Failed to load the RDB file:", err.Error())
+				os.Exit(1)
+			}
+
+			// the snapshot received from master replaces the dataset loaded
+			if o.Role != "master" {
+				protocol.ReplicateMaster(o)
+			}
+		}()
+	}
+
+	if err := protocol.ScheduleSaves(o); err != nil {
+		fmt.Println("Invalid save points:", err.Error())
+		os.Exit(1)
+	}
+
+	protocol.ScheduleActiveExpiry()
+
+	go shutdownOnSignal(o)
+
 	for {
 		conn, err := l.Accept()
 		if err != nil {
@@ -49,22 +93,18 @@ func runMaster(o protocol.Opts) {
 	}
 }
 
-// handleReplConnection handles replication
-func connectToMaster(o protocol.Opts) {
-	addr := fmt.Sprintf("%s:%s", o.MasterHost, o.MasterPort)
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		fmt.Println("net.Dial() failed: ", err.Error())
-	}
+// shutdownOnSignal saves the dataset before exiting on SIGINT and SIGTERM.
+// The server keeps running if it can't be saved.
+func shutdownOnSignal(o protocol.Opts) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	c := protocol.NewConnection(conn)
-	server := protocol.NewSlave(c)
+	for range sigs {
+		if err := protocol.Shutdown(o); err != nil {
+			fmt.Println("Shutdown failed, not exiting:", err.Error())
+			continue
+		}
 
-	err = server.Handshake(o)
-	if err != nil {
-		fmt.Println("Handshake failed:", err.Error())
-		return
+		os.Exit(0)
 	}
-
-	server.Handle()
 }
@@ -0,0 +1,97 @@
+// aofcheck checks files of RESP commands the way redis-check-aof does: a
+// file of the append-only log, every file listed in its manifest, or a
+// captured replication stream. With --fix, the last file is truncated to its
+// last valid command so the server can load it again.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/protocol"
+	"github.com/jessevdk/go-flags"
+)
+
+// Opts are the command line options.
+type Opts struct {
+	Fix  bool `long:"fix" description:"Truncate the file to its last valid command"`
+	Yes  bool `short:"y" long:"yes" description:"Fix without asking for confirmation"`
+	Args struct {
+		File string `positional-arg-name:"FILE" description:"File of commands, or manifest of the append-only log" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+func main() {
+	var opts Opts
+
+	if _, err := flags.Parse(&opts); err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			return
+		}
+		os.Exit(1)
+	}
+
+	if err := run(opts); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+}
+
+// run checks the files in order and stops at the first one with a problem.
+func run(o Opts) error {
+	paths := []string{o.Args.File}
+	if strings.HasSuffix(o.Args.File, ".manifest") {
+		var err error
+		if paths, err = protocol.ManifestFiles(o.Args.File); err != nil {
+			return fmt.Errorf("invalid manifest %s: %v", o.Args.File, err)
+		}
+	}
+
+	for i, path := range paths {
+		c, err := protocol.CheckAOF(path)
+		if err != nil {
+			return fmt.Errorf("failed to check %s: %v", path, err)
+		}
+
+		if c.Problem == nil {
+			fmt.Printf("%s: %d commands, %d bytes, looks OK\n", path, c.Commands, c.Size)
+			continue
+		}
+
+		fmt.Printf("%s: %v\n", path, c.Problem)
+		fmt.Printf("AOF analyzed: size=%d, ok_up_to=%d, ok_up_to_commands=%d, diff=%d\n",
+			c.Size, c.Valid, c.Commands, c.Size-c.Valid)
+
+		if i != len(paths)-1 {
+			return fmt.Errorf("%s isn't the last file of the log and can't be fixed", path)
+		}
+
+		if !o.Fix {
+			return fmt.Errorf("%s is corrupt, use --fix to truncate it to its last valid command", path)
+		}
+
+		if !o.Yes && !confirm(fmt.Sprintf("This will shrink %s by %d bytes. Continue? [y/N]: ", path, c.Size-c.Valid)) {
+			return fmt.Errorf("%s is left unchanged", path)
+		}
+
+		if err := os.Truncate(path, c.Valid); err != nil {
+			return fmt.Errorf("failed to truncate %s: %v", path, err)
+		}
+
+		fmt.Printf("Successfully truncated %s\n", path)
+	}
+
+	return nil
+}
+
+// confirm asks the question and reports whether it was answered yes.
+func confirm(question string) bool {
+	fmt.Print(question)
+
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,257 @@
+// rdbtool checks RDB files the way redis-check-rdb does, reports what they
+// hold and converts them to and from JSON lines and RESP commands.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/protocol"
+	"github.com/jessevdk/go-flags"
+)
+
+type fileArg struct {
+	File string `positional-arg-name:"FILE" required:"yes"`
+}
+
+// CheckCommand validates the structure and the checksum of an RDB file.
+type CheckCommand struct {
+	Args fileArg `positional-args:"yes"`
+}
+
+// StatsCommand reports the keys of an RDB file.
+type StatsCommand struct {
+	Top  int     `long:"top" description:"Number of biggest keys to list" default:"10"`
+	Args fileArg `positional-args:"yes"`
+}
+
+// ExportCommand writes the keys of an RDB file as JSON lines or RESP commands.
+type ExportCommand struct {
+	Format string  `short:"f" long:"format" description:"Output format" choice:"json" choice:"resp" default:"json"`
+	Output string  `short:"o" long:"output" description:"Output file, standard output if not given"`
+	Args   fileArg `positional-args:"yes"`
+}
+
+// ImportCommand writes a new RDB file from JSON lines or RESP commands.
+type ImportCommand struct {
+	Format string `short:"f" long:"format" description:"Input format" choice:"json" choice:"resp" default:"json"`
+	Output string `short:"o" long:"output" description:"RDB file to write" required:"yes"`
+	Args   struct {
+		File string `positional-arg-name:"FILE" description:"Input file, standard input if not given"`
+	} `positional-args:"yes"`
+}
+
+func main() {
+	parser := flags.NewParser(nil, flags.Default)
+	parser.AddCommand("check", "Check an RDB file", "Validates the structure and the checksum of an RDB file.", &CheckCommand{})
+	parser.AddCommand("stats", "Report the keys of an RDB file", "Counts the keys per database and type, lists the biggest keys and the distribution of the expiry times.", &StatsCommand{})
+	parser.AddCommand("export", "Export an RDB file", "Writes the keys of an RDB file as JSON lines or RESP commands.", &ExportCommand{})
+	parser.AddCommand("import", "Import keys to a new RDB file", "Writes a new RDB file from JSON lines or RESP commands written by export.", &ImportCommand{})
+
+	if _, err := parser.Parse(); err != nil {
+		if flagsErr, ok := err.(*flags.Error); !ok || flagsErr.Type != flags.ErrHelp {
+			os.Exit(1)
+		}
+	}
+}
+
+// readDump loads the given RDB file.
+func readDump(path string) (*protocol.Dump, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	d, err := protocol.ReadDump(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s is invalid: %v", path, err)
+	}
+
+	return d, nil
+}
+
+// Execute runs the check command.
+func (c *CheckCommand) Execute(args []string) error {
+	d, err := readDump(c.Args.File)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("RDB version %d\n", d.Version)
+
+	names := make([]string, 0, len(d.Aux))
+	for name := range d.Aux {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Printf("AUX %s = %q\n", name, d.Aux[name])
+	}
+
+	fmt.Printf("%d keys\n", len(d.Keys()))
+	fmt.Println("RDB looks OK")
+
+	return nil
+}
+
+// Execute runs the stats command.
+func (c *StatsCommand) Execute(args []string) error {
+	d, err := readDump(c.Args.File)
+	if err != nil {
+		return err
+	}
+
+	keys := d.Keys()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	types := []string{"string", "list", "set", "zset", "hash", "stream"}
+	counts := make(map[int]map[string]int)
+	var dbs []int
+	for _, k := range keys {
+		if counts[k.DB] == nil {
+			counts[k.DB] = make(map[string]int)
+			dbs = append(dbs, k.DB)
+		}
+		counts[k.DB][k.Type]++
+		counts[k.DB]["keys"]++
+		if k.ExpireAt != 0 {
+			counts[k.DB]["expires"]++
+		}
+	}
+
+	fmt.Fprintln(w, "DB\tKEYS\tEXPIRES\tSTRING\tLIST\tSET\tZSET\tHASH\tSTREAM")
+	for _, db := range dbs {
+		fmt.Fprintf(w, "%d\t%d\t%d", db, counts[db]["keys"], counts[db]["expires"])
+		for _, t := range types {
+			fmt.Fprintf(w, "\t%d", counts[db][t])
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintln(w, "\nBIGGEST KEYS\tDB\tTYPE\tELEMENTS\tMEMORY")
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].Memory > keys[j].Memory })
+	for _, k := range keys[:min(c.Top, len(keys))] {
+		fmt.Fprintf(w, "%q\t%d\t%s\t%d\t%d\n", k.Key, k.DB, k.Type, k.Elements, k.Memory)
+	}
+
+	buckets := []struct {
+		name string
+		ttl  time.Duration
+	}{
+		{"< 1 minute", time.Minute},
+		{"< 1 hour", time.Hour},
+		{"< 1 day", 24 * time.Hour},
+		{"< 1 week", 7 * 24 * time.Hour},
+	}
+	dist := make([]int, len(buckets)+1)
+	var persistent, expired int
+
+	now := time.Now().UnixMilli()
+	for _, k := range keys {
+		switch {
+		case k.ExpireAt == 0:
+			persistent++
+		case k.ExpireAt <= now:
+			expired++
+		default:
+			i := sort.Search(len(buckets), func(i int) bool {
+				return time.Duration(k.ExpireAt-now)*time.Millisecond < buckets[i].ttl
+			})
+			dist[i]++
+		}
+	}
+
+	fmt.Fprintln(w, "\nEXPIRY\tKEYS")
+	fmt.Fprintf(w, "none\t%d\n", persistent)
+	fmt.Fprintf(w, "expired\t%d\n", expired)
+	for i, b := range buckets {
+		fmt.Fprintf(w, "%s\t%d\n", b.name, dist[i])
+	}
+	fmt.Fprintf(w, ">= 1 week\t%d\n", dist[len(buckets)])
+
+	return w.Flush()
+}
+
+// Execute runs the export command.
+func (c *ExportCommand) Execute(args []string) error {
+	d, err := readDump(c.Args.File)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if c.Output != "" {
+		f, err := os.Create(c.Output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	w := bufio.NewWriter(out)
+	if c.Format == "resp" {
+		err = d.WriteRESP(w)
+	} else {
+		err = d.WriteJSON(w)
+	}
+	if err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// Execute runs the import command.
+func (c *ImportCommand) Execute(args []string) error {
+	var in io.Reader = os.Stdin
+	if c.Args.File != "" {
+		f, err := os.Open(c.Args.File)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var d *protocol.Dump
+	var err error
+	if c.Format == "resp" {
+		d, err = protocol.ReadRESP(bufio.NewReader(in))
+	} else {
+		d, err = protocol.ReadJSON(in)
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(c.Output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if err := d.WriteRDB(w); err != nil {
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote %d keys to %s\n", len(d.Keys()), c.Output)
+
+	return nil
+}
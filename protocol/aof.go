@@ -0,0 +1,857 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var aof = NewAOF()
+
+// ErrRewriteInProgress is returned when a rewrite is requested while another one is running.
+var ErrRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+
+// rewriteRetryDelay is the time to wait after a failed automatic rewrite before trying again
+const rewriteRetryDelay = time.Minute
+
+// AOF appends the write commands to the append-only log, in the RESP form
+// they are propagated in, so that replaying them rebuilds the dataset.
+// The log is made of the files listed in its manifest: rewriting it writes
+// the dataset to a new base file while the write commands go to a new
+// incremental file, then the previous files are deleted.
+type AOF struct {
+	lock     sync.Mutex
+	manifest *Manifest
+	file     *os.File // incremental file appended to, nil if the AOF is off
+	fsync    string   // always, everysec or no
+
+	// database selected by the last command in the file, -1 if none
+	db int
+	// time of the last timestamp annotation in the file, 0 if none
+	ts         int64
+	timestamps bool
+	// set when commands were written since the last fsync
+	unsynced     bool
+	lastWriteErr error
+
+	// sizes of the base file and of the whole log, to trigger automatic rewrites
+	baseSize       int64
+	currentSize    int64
+	rewriteMinSize int64
+
+	rewriteDone     chan struct{} // closed once the running rewrite ends, nil if none runs
+	lastRewriteOK   bool
+	lastRewriteTry  time.Time
+	lastRewriteTime time.Duration // -1 if no rewrite ran
+}
+
+// NewAOF is the AOF constructor
+func NewAOF() *AOF {
+	return &AOF{
+		db:              -1,
+		lastRewriteOK:   true,
+		lastRewriteTime: -1,
+	}
+}
+
+// LoadAOF replays the append-only log into the databases, then opens it to
+// append the following write commands. Without any log yet, the dataset is
+// loaded from the RDB file and written to the first base file.
+func LoadAOF(o Opts) error {
+	minSize, err := parseMemory(o.AutoAOFRewriteMinSize)
+	if err != nil {
+		return fmt.Errorf("parseMemory failed: %v", err)
+	}
+
+	m, err := loadManifest(o)
+	if err != nil {
+		return fmt.Errorf("loadManifest failed: %v", err)
+	}
+
+	if m == nil {
+		m, err = upgradeAOF(o)
+		if err != nil {
+			return fmt.Errorf("upgradeAOF failed: %v", err)
+		}
+	}
+
+	var baseSize, size int64
+	if m != nil {
+		baseSize, size, err = loadAOFFiles(o, m)
+		if err != nil {
+			return err
+		}
+	} else {
+		aux, err := loadRDB(o, databases)
+		persistence.setAux(aux)
+		if err != nil {
+			return fmt.Errorf("loadRDB failed: %v", err)
+		}
+	}
+
+	// replaying the log isn't a change to save
+	persistence.dirty.Store(0)
+
+	if o.AOFRestoreUntil > 0 {
+		// the writes after the instant are kept aside with the whole log,
+		// the restored dataset starting a new one
+		backup, err := setAsideAOF(o, time.Now())
+		if err != nil {
+			return fmt.Errorf("setAsideAOF failed: %v", err)
+		}
+		fmt.Printf("Moved the AOF to %s\n", backup)
+
+		m, baseSize, size = nil, 0, 0
+	}
+
+	aof.lock.Lock()
+	aof.manifest = m
+	aof.baseSize, aof.currentSize = baseSize, size
+	aof.rewriteMinSize = minSize
+	aof.lock.Unlock()
+
+	if o.AOFRestoreUntil > 0 {
+		fmt.Println("Rewriting the AOF from the restored dataset")
+
+		if err := aof.rewrite(o, persistence.snapshot(databases, o)); err != nil {
+			return fmt.Errorf("rewrite failed: %v", err)
+		}
+	} else if m == nil || m.base == nil {
+		fmt.Println("Creating the AOF base file on server start")
+
+		if err := aof.rewrite(o, persistence.snapshot(databases, o)); err != nil {
+			return fmt.Errorf("rewrite failed: %v", err)
+		}
+	}
+
+	if err := aof.open(o); err != nil {
+		return err
+	}
+
+	go func() {
+		for range time.Tick(100 * time.Millisecond) {
+			aof.cron(o)
+		}
+	}()
+
+	return nil
+}
+
+// setAsideAOF renames the directory of the append-only log so that a new log
+// starts without deleting any file of the previous one. It returns the new
+// path of the directory.
+func setAsideAOF(o Opts, now time.Time) (string, error) {
+	backup := fmt.Sprintf("%s.before-restore-%d", aofDir(o), now.Unix())
+
+	if err := os.Rename(aofDir(o), backup); err != nil {
+		return "", fmt.Errorf("os.Rename failed: %v", err)
+	}
+
+	return backup, nil
+}
+
+// upgradeAOF moves an append-only file written before the multi-part log
+// into the AOF directory, as the base file of a new manifest. Nil is
+// returned if there is no such file.
+func upgradeAOF(o Opts) (*Manifest, error) {
+	legacy := filepath.Join(o.Dir, o.AppendFilename)
+	if _, err := os.Stat(legacy); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("os.Stat failed: %v", err)
+	}
+
+	if err := os.MkdirAll(aofDir(o), 0o755); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll failed: %v", err)
+	}
+
+	m := &Manifest{
+		base:    &AOFInfo{name: o.AppendFilename, seq: 1, kind: aofTypeBase},
+		baseSeq: 1,
+	}
+
+	// a crash in between leaves a manifest naming a missing file rather than
+	// a moved file no manifest knows about
+	if err := m.write(o); err != nil {
+		return nil, fmt.Errorf("write failed: %v", err)
+	}
+
+	if err := os.Rename(legacy, filepath.Join(aofDir(o), o.AppendFilename)); err != nil {
+		return nil, fmt.Errorf("os.Rename failed: %v", err)
+	}
+
+	fmt.Printf("Moved %s to %s\n", legacy, aofDir(o))
+
+	return m, nil
+}
+
+// loadAOFFiles replays the files of the manifest in order and returns the
+// size of the base file and the size of the whole log. With AOFRestoreUntil,
+// the replay stops at the first write made after that instant.
+func loadAOFFiles(o Opts, m *Manifest) (int64, int64, error) {
+	l := &aofLoader{o: o, until: o.AOFRestoreUntil}
+	var baseSize, size int64
+
+	files := m.files()
+	for i, info := range files {
+		ts := l.ts
+		n, err := l.load(filepath.Join(aofDir(o), info.name), i == len(files)-1)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if info == m.base {
+			baseSize = n
+		}
+		size += n
+
+		if l.stopped {
+			// the first incremental file starts with the time its base file was written
+			if m.base != nil && i == 1 && l.ts == ts {
+				return 0, 0, errors.New("the base file was written after the instant to restore")
+			}
+			break
+		}
+	}
+
+	if l.until > 0 {
+		if l.ts == 0 {
+			return 0, 0, errors.New("the log has no timestamp to restore from, enable aof-timestamp-enabled")
+		}
+
+		fmt.Printf("Restored the dataset as of %d\n", l.until)
+	}
+
+	return baseSize, size, nil
+}
+
+// aofLoader replays the files of the log against the databases.
+type aofLoader struct {
+	o     Opts
+	until int64 // unix time in milliseconds to restore the dataset to, 0 for all of it
+
+	ts      int64 // time of the last timestamp annotation read, 0 if none
+	stopped bool  // set once a write made after until is reached
+}
+
+// load runs the commands of a file of the log, after its RDB preamble if it
+// has one, and returns its size. A last command cut short, as left by a
+// crash in the middle of a write, is removed from the last file of the log
+// if AOFLoadTruncated allows it. A transaction without EXEC is removed the
+// same way. Lines starting with '#' are annotations, "#TS:<unix seconds>" giving
+// the time of the writes following it.
+func (l *aofLoader) load(path string, last bool) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("os.Open failed: %v", err)
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var valid int64
+
+	if magic, err := br.Peek(5); err == nil && string(magic) == "REDIS" {
+		// the RDB file reads from the same buffered reader
+		if err := NewFile(br).load(databases); err != nil {
+			return 0, fmt.Errorf("%s has a corrupt RDB preamble: %v", path, err)
+		}
+
+		pos, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, fmt.Errorf("Seek failed: %v", err)
+		}
+		valid = pos - int64(br.Buffered())
+	}
+
+	reader := NewRespReader(br)
+
+	// the replies to the commands are dropped
+	s := &Server{storage: databases[0], opts: l.o, replay: true}
+
+	var multi int64
+	count := 0
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("Peek failed: %v", err)
+		}
+
+		if b[0] == '#' {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				// cut short like a command
+				break
+			}
+
+			if ts, ok := strings.CutPrefix(strings.TrimRight(line, "\r\n"), "#TS:"); ok {
+				t, err := strconv.ParseInt(ts, 10, 64)
+				if err != nil {
+					return 0, fmt.Errorf("%s is corrupt: invalid timestamp %q at offset %d", path, ts, valid)
+				}
+
+				// the annotations are in seconds, covering the writes up to the next one
+				if l.until > 0 && t*1000 > l.until {
+					l.stopped = true
+					fmt.Printf("Stopped replaying %s at offset %d, written at %d\n", path, valid, t)
+					return valid, nil
+				}
+				l.ts = t
+			}
+
+			valid += int64(len(line))
+			continue
+		}
+
+		if b[0] != RespArray {
+			return 0, fmt.Errorf("%s is corrupt: unexpected %q at offset %d", path, b[0], valid)
+		}
+
+		n, request, err := reader.ReadCommand()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s is corrupt at offset %d: %v", path, valid, err)
+		}
+
+		if cmd, _ := lookupCommand(request); cmd == nil {
+			return 0, fmt.Errorf("%s is corrupt: unknown command %q at offset %d", path, request[0], valid)
+		}
+
+		if strings.ToLower(request[0]) == "multi" {
+			multi = valid
+		}
+
+		if err := s.HandleRequest(request); err != nil {
+			return 0, fmt.Errorf("HandleRequest failed: %v", err)
+		}
+
+		valid += int64(n)
+		count++
+	}
+
+	end := valid
+	if s.queuing {
+		end = multi
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("Stat failed: %v", err)
+	}
+
+	if end < info.Size() {
+		if !last {
+			return 0, fmt.Errorf("%s is truncated at offset %d but isn't the last file of the log", path, end)
+		}
+
+		if l.o.AOFLoadTruncated != "yes" {
+			return 0, fmt.Errorf("%s is truncated at offset %d, set aof-load-truncated to yes to load it anyway", path, end)
+		}
+
+		fmt.Printf("%s is truncated, removing the %d bytes after offset %d\n", path, info.Size()-end, end)
+		if err := os.Truncate(path, end); err != nil {
+			return 0, fmt.Errorf("os.Truncate failed: %v", err)
+		}
+	}
+
+	fmt.Printf("Replayed %d commands from %s\n", count, path)
+
+	return end, nil
+}
+
+// open opens the last incremental file of the log to append the write
+// commands to it, creating one if there is none.
+func (a *AOF) open(o Opts) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if err := os.MkdirAll(aofDir(o), 0o755); err != nil {
+		return fmt.Errorf("os.MkdirAll failed: %v", err)
+	}
+
+	m := a.manifest
+	created := len(m.incrs) == 0
+	if created {
+		m = m.clone()
+		m.nextIncr(o.AppendFilename)
+		if err := m.write(o); err != nil {
+			return fmt.Errorf("write failed: %v", err)
+		}
+		a.manifest = m
+	}
+
+	// left over by a crash before the end of a rewrite
+	a.deleteHistory(o)
+
+	f, err := os.OpenFile(filepath.Join(aofDir(o), m.incrs[len(m.incrs)-1].name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile failed: %v", err)
+	}
+
+	a.file = f
+	a.fsync = o.AppendFsync
+	a.db = -1
+	a.ts = 0
+	a.timestamps = o.AOFTimestampEnabled == "yes"
+
+	if created {
+		a.annotate()
+	}
+
+	if o.AppendFsync == "everysec" {
+		go func() {
+			for range time.Tick(time.Second) {
+				a.sync()
+			}
+		}()
+	}
+
+	return nil
+}
+
+// Feed appends write commands, each selecting the database it ran against.
+// With the always policy, they are on disk once Feed returns.
+func (a *AOF) Feed(ops ...op) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.file == nil {
+		return
+	}
+
+	var cmd string
+	if now := time.Now().Unix(); a.timestamps && now != a.ts {
+		cmd = fmt.Sprintf("#TS:%d\r\n", now)
+		a.ts = now
+	}
+	db := a.db
+	for _, o := range ops {
+		if o.db != db {
+			cmd += ToRespArray([]string{"SELECT", strconv.Itoa(o.db)})
+			db = o.db
+		}
+		cmd += ToRespArray(o.request)
+	}
+
+	n, err := a.file.WriteString(cmd)
+	a.currentSize += int64(n)
+	if err == nil && a.fsync == "always" {
+		err = a.file.Sync()
+	}
+
+	if err != nil {
+		fmt.Printf("Writing to the AOF failed: %v\n", err)
+		// the database and time are written again before the next command
+		a.db = -1
+		a.ts = 0
+	} else {
+		a.db = db
+		a.unsynced = a.fsync == "everysec"
+	}
+	a.lastWriteErr = err
+}
+
+// sync flushes the commands written since the last call to disk.
+// Writers aren't held back while the file is synced.
+func (a *AOF) sync() {
+	a.lock.Lock()
+	f, unsynced := a.file, a.unsynced
+	a.unsynced = false
+	a.lock.Unlock()
+
+	if f == nil || !unsynced {
+		return
+	}
+
+	// a rewrite may have closed the file since, once synced
+	if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		fmt.Printf("Syncing the AOF failed: %v\n", err)
+	}
+}
+
+// BackgroundRewrite writes the snapshot to a new base file in the background.
+// The write commands run from now on go to a new incremental file, so the
+// caller must hold the locks the snapshot was taken with.
+func (a *AOF) BackgroundRewrite(o Opts, snap *Snapshot) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.rewriteDone != nil {
+		return ErrRewriteInProgress
+	}
+
+	if a.file != nil {
+		if err := a.nextIncr(o); err != nil {
+			return fmt.Errorf("nextIncr failed: %v", err)
+		}
+	}
+
+	done := make(chan struct{})
+	a.rewriteDone = done
+	a.lastRewriteTry = time.Now()
+
+	go func() {
+		start := time.Now()
+		err := a.rewrite(o, snap)
+		if err != nil {
+			fmt.Printf("Background AOF rewrite failed: %v\n", err)
+		}
+
+		a.lock.Lock()
+		defer a.lock.Unlock()
+
+		a.rewriteDone = nil
+		a.lastRewriteOK = err == nil
+		a.lastRewriteTime = time.Since(start)
+		close(done)
+	}()
+
+	return nil
+}
+
+// nextIncr switches to a new incremental file. The previous one is synced
+// and closed, it stays in the manifest until the rewrite ends.
+// The caller must hold the lock.
+func (a *AOF) nextIncr(o Opts) error {
+	m := a.manifest.clone()
+	path := filepath.Join(aofDir(o), m.nextIncr(o.AppendFilename).name)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile failed: %v", err)
+	}
+
+	if err := m.write(o); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("write failed: %v", err)
+	}
+
+	if err := a.file.Sync(); err != nil {
+		fmt.Printf("Syncing the AOF failed: %v\n", err)
+	}
+	a.file.Close()
+
+	a.manifest = m
+	a.file = f
+	a.db = -1
+	a.ts = 0
+	a.unsynced = false
+
+	a.annotate()
+
+	return nil
+}
+
+// annotate writes the time a new incremental file starts at, which is the
+// time its base file is written at. The caller must hold the lock.
+func (a *AOF) annotate() {
+	if !a.timestamps {
+		return
+	}
+
+	now := time.Now().Unix()
+	n, err := fmt.Fprintf(a.file, "#TS:%d\r\n", now)
+	a.currentSize += int64(n)
+	if err != nil {
+		fmt.Printf("Writing to the AOF failed: %v\n", err)
+		return
+	}
+	a.ts = now
+}
+
+// rewrite writes the snapshot to a new base file and replaces the previous
+// base and incremental files with it in the manifest, except the file the
+// write commands currently go to.
+func (a *AOF) rewrite(o Opts, snap *Snapshot) error {
+	if err := os.MkdirAll(aofDir(o), 0o755); err != nil {
+		return fmt.Errorf("os.MkdirAll failed: %v", err)
+	}
+
+	f, err := os.CreateTemp(aofDir(o), "temp-rewriteaof-*.aof")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp failed: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// values the command table can't rebuild are only kept by the RDB format
+	rdb := o.AOFUseRDBPreamble == "yes" || !snap.rewritableAsCommands()
+
+	w := bufio.NewWriter(f)
+	if rdb {
+		base := *snap
+		base.aux = slices.Clone(snap.aux)
+		for i := range base.aux {
+			if base.aux[i][0] == "aof-base" {
+				base.aux[i][1] = "1"
+			}
+		}
+		err = base.write(w)
+	} else {
+		err = snap.writeCommands(w)
+	}
+	if err != nil {
+		return fmt.Errorf("write failed: %v", err)
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("Flush failed: %v", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("Sync failed: %v", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Close failed: %v", err)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	m := a.manifest
+	if m == nil {
+		// the AOF is off but an earlier log may be on disk
+		if m, err = loadManifest(o); err != nil {
+			return fmt.Errorf("loadManifest failed: %v", err)
+		}
+		if m == nil {
+			m = &Manifest{}
+		}
+	}
+
+	keep := 0
+	if a.file != nil {
+		keep = 1
+	}
+
+	m = m.clone()
+	base := m.nextBase(o.AppendFilename, rdb, keep)
+	path := filepath.Join(aofDir(o), base.name)
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("os.Rename failed: %v", err)
+	}
+
+	if err := m.write(o); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("write failed: %v", err)
+	}
+	a.manifest = m
+
+	if info, err := os.Stat(path); err == nil {
+		a.baseSize = info.Size()
+		a.currentSize = a.baseSize
+	}
+	if a.file != nil {
+		if info, err := a.file.Stat(); err == nil {
+			a.currentSize += info.Size()
+		}
+	}
+
+	a.deleteHistory(o)
+
+	fmt.Printf("AOF rewritten to %s\n", base.name)
+
+	return nil
+}
+
+// deleteHistory deletes the files left over by rewrites.
+// The caller must hold the lock.
+func (a *AOF) deleteHistory(o Opts) {
+	if a.manifest == nil || len(a.manifest.history) == 0 {
+		return
+	}
+
+	for _, info := range a.manifest.history {
+		err := os.Remove(filepath.Join(aofDir(o), info.name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("Deleting %s failed: %v\n", info.name, err)
+		}
+	}
+
+	m := a.manifest.clone()
+	m.history = nil
+	if err := m.write(o); err != nil {
+		fmt.Printf("Writing the AOF manifest failed: %v\n", err)
+		return
+	}
+	a.manifest = m
+}
+
+// waitRewrite waits for the running rewrite to end.
+func (a *AOF) waitRewrite() {
+	a.lock.Lock()
+	done := a.rewriteDone
+	a.lock.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// cron starts a rewrite if the log grew enough since the last one.
+func (a *AOF) cron(o Opts) {
+	if persistence.Loading() || !a.rewriteDue(o, time.Now()) {
+		return
+	}
+
+	// the new incremental file must start right after the snapshot
+	unlock := lockDatabases(databases, false)
+	defer unlock()
+
+	err := a.BackgroundRewrite(o, persistence.snapshot(databases, o))
+	if err != nil && !errors.Is(err, ErrRewriteInProgress) {
+		fmt.Printf("BackgroundRewrite failed: %v\n", err)
+	}
+}
+
+// rewriteDue reports whether the log is larger than AutoAOFRewriteMinSize
+// and grew by AutoAOFRewritePercentage since the last rewrite.
+func (a *AOF) rewriteDue(o Opts, now time.Time) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.file == nil || a.rewriteDone != nil || o.AutoAOFRewritePercentage <= 0 || a.currentSize <= a.rewriteMinSize {
+		return false
+	}
+
+	if !a.lastRewriteOK && now.Sub(a.lastRewriteTry) < rewriteRetryDelay {
+		return false
+	}
+
+	base := max(a.baseSize, 1)
+	growth := (a.currentSize - base) * 100 / base
+	if growth < int64(o.AutoAOFRewritePercentage) {
+		return false
+	}
+
+	fmt.Printf("Starting automatic rewriting of AOF on %d%% growth\n", growth)
+
+	return true
+}
+
+// rewritableAsCommands reports whether every key of the snapshot can be
+// rebuilt by the commands of the command table.
+func (snap *Snapshot) rewritableAsCommands() bool {
+	for _, keys := range snap.dbs {
+		for key, e := range keys {
+			if rewriteCommands(key, e) == nil {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// writeCommands writes the commands rebuilding the snapshot.
+func (snap *Snapshot) writeCommands(w io.Writer) error {
+	for i, keys := range snap.dbs {
+		if len(keys) == 0 {
+			continue
+		}
+
+		if _, err := io.WriteString(w, ToRespArray([]string{"SELECT", strconv.Itoa(i)})); err != nil {
+			return err
+		}
+
+		for key, e := range keys {
+			for _, cmd := range rewriteCommands(key, e) {
+				if _, err := io.WriteString(w, ToRespArray(cmd)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// rewriteCommands returns the commands rebuilding a key, nil if the command
+// table can't. Streams are only rebuilt if adding their entries again
+// gives back the same stream.
+func rewriteCommands(key string, e *Entry) [][]string {
+	switch v := e.value.(type) {
+	case String:
+		cmd := []string{"SET", key, string(v)}
+		if e.expireAt != 0 {
+			cmd = append(cmd, "PXAT", strconv.FormatInt(e.expireAt, 10))
+		}
+		return [][]string{cmd}
+
+	case *Stream:
+		if e.expireAt != 0 || len(v.entries) == 0 || len(v.groups) > 0 ||
+			v.lastID != v.entries[len(v.entries)-1].id || v.entriesAdded != int64(len(v.entries)) ||
+			(v.maxDeletedID != "" && v.maxDeletedID != "0-0") {
+			return nil
+		}
+
+		cmds := make([][]string, 0, len(v.entries))
+		for _, entry := range v.entries {
+			fields := make([]string, 0, len(entry.kvpairs))
+			for field := range entry.kvpairs {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+
+			cmd := []string{"XADD", key, entry.id}
+			for _, field := range fields {
+				cmd = append(cmd, field, entry.kvpairs[field])
+			}
+			cmds = append(cmds, cmd)
+		}
+		return cmds
+	}
+
+	return nil
+}
+
+// info returns the AOF fields of the persistence section of the INFO command.
+func (a *AOF) info() string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	writeStatus := "ok"
+	if a.lastWriteErr != nil {
+		writeStatus = "err"
+	}
+
+	rewriteStatus := "ok"
+	if !a.lastRewriteOK {
+		rewriteStatus = "err"
+	}
+
+	rewriteTime := int64(-1)
+	if a.lastRewriteTime >= 0 {
+		rewriteTime = int64(a.lastRewriteTime.Seconds())
+	}
+
+	ret := fmt.Sprintf("aof_enabled:%d\r\n"+
+		"aof_rewrite_in_progress:%d\r\n"+
+		"aof_last_rewrite_time_sec:%d\r\n"+
+		"aof_last_bgrewrite_status:%s\r\n"+
+		"aof_last_write_status:%s\r\n",
+		boolInt(a.file != nil), boolInt(a.rewriteDone != nil), rewriteTime, rewriteStatus, writeStatus)
+
+	if a.file != nil {
+		ret += fmt.Sprintf("aof_current_size:%d\r\naof_base_size:%d\r\n", a.currentSize, a.baseSize)
+	}
+
+	return ret
+}
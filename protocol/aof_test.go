@@ -0,0 +1,499 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestAOFLoader_load(t *testing.T) {
+	const (
+		setFoo   = "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"
+		select1  = "*2\r\n$6\r\nSELECT\r\n$1\r\n1\r\n"
+		setBaz   = "*3\r\n$3\r\nSET\r\n$3\r\nbaz\r\n$3\r\nqux\r\n"
+		multi    = "*1\r\n$5\r\nMULTI\r\n"
+		exec     = "*1\r\n$4\r\nEXEC\r\n"
+		setShort = "*3\r\n$3\r\nSET\r\n$3\r\nnew"
+	)
+
+	dbs := newDatabases(2)
+	dbs[1].Set("pre", "amble", 0)
+
+	var buf bytes.Buffer
+	if err := persistence.snapshot(dbs, Opts{}).write(&buf); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+	preamble := buf.String()
+
+	tests := []struct {
+		name        string
+		content     string
+		truncated   string
+		notLast     bool
+		until       int64
+		wantSize    int
+		want        []string
+		wantDB1     []string
+		wantContent string
+		wantErr     bool
+	}{
+		{
+			name:        "Test load",
+			content:     setFoo + select1 + setBaz,
+			truncated:   "yes",
+			want:        []string{"foo"},
+			wantDB1:     []string{"baz"},
+			wantContent: setFoo + select1 + setBaz,
+		},
+		{
+			name:        "Test load transaction",
+			content:     multi + setFoo + select1 + setBaz + exec,
+			truncated:   "yes",
+			want:        []string{"foo"},
+			wantDB1:     []string{"baz"},
+			wantContent: multi + setFoo + select1 + setBaz + exec,
+		},
+		{
+			name:        "Test load truncated command",
+			content:     setFoo + setShort,
+			truncated:   "yes",
+			want:        []string{"foo"},
+			wantDB1:     []string{},
+			wantContent: setFoo,
+		},
+		{
+			name:        "Test load transaction without EXEC",
+			content:     setFoo + multi + select1 + setBaz,
+			truncated:   "yes",
+			want:        []string{"foo"},
+			wantDB1:     []string{},
+			wantContent: setFoo,
+		},
+		{
+			name:        "Test load RDB preamble",
+			content:     preamble + setFoo + setShort,
+			truncated:   "yes",
+			want:        []string{"foo"},
+			wantDB1:     []string{"pre"},
+			wantContent: preamble + setFoo,
+		},
+		{
+			name:        "Test load truncated command before the last file",
+			content:     setFoo + setShort,
+			truncated:   "yes",
+			notLast:     true,
+			wantContent: setFoo + setShort,
+			wantErr:     true,
+		},
+		{
+			name:        "Test load truncated command refused",
+			content:     setFoo + setShort,
+			truncated:   "no",
+			wantContent: setFoo + setShort,
+			wantErr:     true,
+		},
+		{
+			name:        "Test load corrupt command",
+			content:     setFoo + "*3\r\n$3\r\nSET\r\n$x\r\n" + setBaz,
+			truncated:   "yes",
+			wantContent: setFoo + "*3\r\n$3\r\nSET\r\n$x\r\n" + setBaz,
+			wantErr:     true,
+		},
+		{
+			name:        "Test load unknown command",
+			content:     "*1\r\n$3\r\nFOO\r\n",
+			truncated:   "yes",
+			wantContent: "*1\r\n$3\r\nFOO\r\n",
+			wantErr:     true,
+		},
+		{
+			name:        "Test load annotations",
+			content:     "#TS:100\r\n" + setFoo + "# comment\r\n#TS:200\r\n" + select1 + setBaz,
+			truncated:   "yes",
+			want:        []string{"foo"},
+			wantDB1:     []string{"baz"},
+			wantContent: "#TS:100\r\n" + setFoo + "# comment\r\n#TS:200\r\n" + select1 + setBaz,
+		},
+		{
+			name:        "Test restore until",
+			content:     "#TS:100\r\n" + setFoo + "#TS:200\r\n" + select1 + setBaz + setShort,
+			truncated:   "no",
+			until:       150000,
+			wantSize:    len("#TS:100\r\n" + setFoo),
+			want:        []string{"foo"},
+			wantDB1:     []string{},
+			wantContent: "#TS:100\r\n" + setFoo + "#TS:200\r\n" + select1 + setBaz + setShort,
+		},
+		{
+			name:        "Test load invalid timestamp",
+			content:     "#TS:x\r\n" + setFoo,
+			truncated:   "yes",
+			wantContent: "#TS:x\r\n" + setFoo,
+			wantErr:     true,
+		},
+		{
+			name:        "Test load inline command",
+			content:     "SET foo bar\r\n",
+			truncated:   "yes",
+			wantContent: "SET foo bar\r\n",
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(dbs []*Storage) { databases = dbs }(databases)
+			databases = newDatabases(2)
+
+			dir := t.TempDir()
+			path := filepath.Join(dir, "appendonly.aof")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+
+			l := &aofLoader{o: Opts{AOFLoadTruncated: tt.truncated}, until: tt.until}
+			size, err := l.load(path, !tt.notLast)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if content, _ := os.ReadFile(path); string(content) != tt.wantContent {
+				t.Errorf("load() content = %q, want %q", content, tt.wantContent)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			wantSize := tt.wantSize
+			if wantSize == 0 {
+				wantSize = len(tt.wantContent)
+			}
+			if size != int64(wantSize) {
+				t.Errorf("load() size = %d, want %d", size, wantSize)
+			}
+
+			if l.stopped != (tt.until > 0) {
+				t.Errorf("load() stopped = %v, want %v", l.stopped, tt.until > 0)
+			}
+
+			for i, want := range [][]string{tt.want, tt.wantDB1} {
+				got := databases[i].Keys("*")
+				sort.Strings(got)
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("load() keys of DB %d = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAOF_Feed(t *testing.T) {
+	o := Opts{Dir: t.TempDir(), AppendDirname: "appendonlydir", AppendFilename: "appendonly.aof", AppendFsync: "always"}
+
+	a := NewAOF()
+	a.Feed(op{db: 0, request: []string{"SET", "ignored", "value"}})
+
+	a.manifest = &Manifest{}
+	if err := a.open(o); err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+
+	a.Feed(op{db: 0, request: []string{"SET", "a", "1"}})
+	a.Feed(op{db: 0, request: []string{"SET", "b", "2"}})
+	a.Feed(op{db: 1, request: []string{"INCR", "c"}})
+	a.Feed(op{db: 1, request: []string{"INCR", "d"}}, op{db: 0, request: []string{"INCR", "e"}})
+
+	want := "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n" +
+		"*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n" +
+		"*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n2\r\n" +
+		"*2\r\n$6\r\nSELECT\r\n$1\r\n1\r\n" +
+		"*2\r\n$4\r\nINCR\r\n$1\r\nc\r\n" +
+		"*2\r\n$4\r\nINCR\r\n$1\r\nd\r\n" +
+		"*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n" +
+		"*2\r\n$4\r\nINCR\r\n$1\r\ne\r\n"
+
+	if got, _ := os.ReadFile(filepath.Join(aofDir(o), "appendonly.aof.1.incr.aof")); string(got) != want {
+		t.Errorf("Feed() content = %q, want %q", got, want)
+	}
+
+	if a.currentSize != int64(len(want)) {
+		t.Errorf("Feed() current size = %d, want %d", a.currentSize, len(want))
+	}
+}
+
+func TestAOF_FeedTimestamp(t *testing.T) {
+	o := Opts{Dir: t.TempDir(), AppendDirname: "appendonlydir", AppendFilename: "appendonly.aof", AppendFsync: "always"}
+
+	a := NewAOF()
+	a.manifest = &Manifest{}
+	if err := a.open(o); err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+	a.timestamps = true
+
+	before := time.Now().Unix()
+	a.Feed(op{db: 0, request: []string{"SET", "a", "1"}})
+	after := time.Now().Unix()
+
+	got, _ := os.ReadFile(filepath.Join(aofDir(o), "appendonly.aof.1.incr.aof"))
+
+	var ts int64
+	if _, err := fmt.Sscanf(string(got), "#TS:%d\r\n", &ts); err != nil {
+		t.Fatalf("Feed() content = %q, want a timestamp first", got)
+	}
+	if ts < before || ts > after {
+		t.Errorf("Feed() timestamp = %d, want unix seconds between %d and %d", ts, before, after)
+	}
+}
+
+func Test_setAsideAOF(t *testing.T) {
+	o := Opts{Dir: t.TempDir(), AppendDirname: "appendonlydir", AppendFilename: "appendonly.aof"}
+
+	files := map[string]string{
+		"appendonly.aof.manifest":   "file appendonly.aof.1.incr.aof seq 1 type i\n",
+		"appendonly.aof.1.incr.aof": "#TS:1000\r\n",
+	}
+	if err := os.Mkdir(aofDir(o), 0o755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(aofDir(o), name), []byte(content), 0o644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	backup, err := setAsideAOF(o, time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatalf("setAsideAOF() error = %v", err)
+	}
+	if want := aofDir(o) + ".before-restore-1700000000"; backup != want {
+		t.Errorf("setAsideAOF() = %q, want %q", backup, want)
+	}
+
+	for name, content := range files {
+		if got, err := os.ReadFile(filepath.Join(backup, name)); err != nil || string(got) != content {
+			t.Errorf("setAsideAOF() kept %s = %q, %v, want %q", name, got, err, content)
+		}
+	}
+
+	// the restored dataset starts a new log
+	if m, err := loadManifest(o); err != nil || m != nil {
+		t.Errorf("loadManifest() = %v, %v, want no manifest", m, err)
+	}
+}
+
+func TestAOF_rewrite(t *testing.T) {
+	stream := NewStream()
+	for _, id := range []string{"1-1", "2-0"} {
+		entry, _ := NewStreamEntry(id, []string{"f", id, "g", "x"})
+		stream.entries = append(stream.entries, entry)
+	}
+	stream.lastID = "2-0"
+	stream.entriesAdded = 2
+
+	expireAt := time.Now().Add(time.Hour).UnixMilli()
+
+	tests := []struct {
+		name     string
+		preamble string
+		list     bool
+		wantBase string
+	}{
+		{name: "Test rewrite with RDB preamble", preamble: "yes", wantBase: "appendonly.aof.2.base.rdb"},
+		{name: "Test rewrite as commands", preamble: "no", wantBase: "appendonly.aof.2.base.aof"},
+		{name: "Test rewrite as commands with a list", preamble: "no", list: true, wantBase: "appendonly.aof.2.base.rdb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(dbs []*Storage) { databases = dbs }(databases)
+			databases = newDatabases(2)
+			databases[0].Set("str", "value", expireAt)
+			databases[1].SetValue("stream", cloneValue(stream), 0)
+			if tt.list {
+				databases[1].SetValue("list", NewList("a", "b"), 0)
+			}
+
+			o := Opts{
+				Dir:               t.TempDir(),
+				AppendDirname:     "appendonlydir",
+				AppendFilename:    "appendonly.aof",
+				AppendFsync:       "no",
+				AOFUseRDBPreamble: tt.preamble,
+				AOFLoadTruncated:  "yes",
+			}
+
+			a := NewAOF()
+			if err := a.rewrite(o, persistence.snapshot(databases, o)); err != nil {
+				t.Fatalf("rewrite() error = %v", err)
+			}
+			if err := a.open(o); err != nil {
+				t.Fatalf("open() error = %v", err)
+			}
+
+			a.Feed(op{db: 0, request: []string{"SET", "before", "rewrite"}})
+			if err := a.BackgroundRewrite(o, persistence.snapshot(databases, o)); err != nil {
+				t.Fatalf("BackgroundRewrite() error = %v", err)
+			}
+			a.Feed(op{db: 1, request: []string{"SET", "after", "rewrite"}})
+			databases[1].Set("after", "rewrite", 0)
+			a.waitRewrite()
+
+			if !a.lastRewriteOK {
+				t.Fatalf("BackgroundRewrite() failed")
+			}
+
+			wantManifest := fmt.Sprintf("file %s seq 2 type b\nfile appendonly.aof.2.incr.aof seq 2 type i\n", tt.wantBase)
+			if got, _ := os.ReadFile(manifestPath(o)); string(got) != wantManifest {
+				t.Errorf("manifest = %q, want %q", got, wantManifest)
+			}
+
+			entries, _ := os.ReadDir(aofDir(o))
+			var files []string
+			for _, entry := range entries {
+				files = append(files, entry.Name())
+			}
+			if wantFiles := []string{tt.wantBase, "appendonly.aof.2.incr.aof", "appendonly.aof.manifest"}; !reflect.DeepEqual(files, wantFiles) {
+				t.Errorf("files = %v, want %v", files, wantFiles)
+			}
+
+			// the key set before the rewrite is in the base file only
+			wantDBs := databases
+			databases = newDatabases(2)
+			m, err := loadManifest(o)
+			if err != nil {
+				t.Fatalf("loadManifest() error = %v", err)
+			}
+			if _, _, err := loadAOFFiles(o, m); err != nil {
+				t.Fatalf("loadAOFFiles() error = %v", err)
+			}
+
+			for i := range databases {
+				got, want := databases[i].clone(), wantDBs[i].clone()
+
+				// a stream loaded from an RDB file has a 0-0 max deleted ID rather than none
+				for _, keys := range []map[string]*Entry{got, want} {
+					if e, ok := keys["stream"]; ok {
+						e.value.(*Stream).maxDeletedID = "0-0"
+					}
+				}
+
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("loaded DB %d = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func Test_loadAOFFiles(t *testing.T) {
+	const (
+		setFoo = "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"
+		setBaz = "*3\r\n$3\r\nSET\r\n$3\r\nbaz\r\n$3\r\nqux\r\n"
+		setNew = "*3\r\n$3\r\nSET\r\n$3\r\nnew\r\n$3\r\nkey\r\n"
+	)
+
+	files := map[string]string{
+		"appendonly.aof.manifest": "file appendonly.aof.1.base.aof seq 1 type b\n" +
+			"file appendonly.aof.1.incr.aof seq 1 type i\n" +
+			"file appendonly.aof.2.incr.aof seq 2 type i\n",
+		"appendonly.aof.1.base.aof": setFoo,
+		"appendonly.aof.1.incr.aof": "#TS:1000\r\n#TS:1100\r\n" + setBaz,
+		"appendonly.aof.2.incr.aof": "#TS:1200\r\n" + setNew,
+	}
+
+	tests := []struct {
+		name     string
+		until    int64
+		want     []string
+		wantSize int64
+		wantErr  bool
+	}{
+		{name: "Test load every file", want: []string{"baz", "foo", "new"}, wantSize: 123},
+		{name: "Test restore after the last write", until: 2000000, want: []string{"baz", "foo", "new"}, wantSize: 123},
+		{name: "Test restore between files", until: 1150000, want: []string{"baz", "foo"}, wantSize: 82},
+		{name: "Test restore within the second of a write", until: 1100500, want: []string{"baz", "foo"}, wantSize: 82},
+		{name: "Test restore to the base file", until: 1050000, want: []string{"foo"}, wantSize: 41},
+		{name: "Test restore before the base file", until: 999999, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(dbs []*Storage) { databases = dbs }(databases)
+			databases = newDatabases(1)
+
+			o := Opts{Dir: t.TempDir(), AppendDirname: "appendonlydir", AppendFilename: "appendonly.aof", AOFRestoreUntil: tt.until}
+			if err := os.Mkdir(aofDir(o), 0o755); err != nil {
+				t.Fatalf("Mkdir failed: %v", err)
+			}
+			for name, content := range files {
+				if err := os.WriteFile(filepath.Join(aofDir(o), name), []byte(content), 0o644); err != nil {
+					t.Fatalf("WriteFile failed: %v", err)
+				}
+			}
+
+			m, err := loadManifest(o)
+			if err != nil {
+				t.Fatalf("loadManifest() error = %v", err)
+			}
+
+			baseSize, size, err := loadAOFFiles(o, m)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadAOFFiles() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if baseSize != int64(len(setFoo)) || size != tt.wantSize {
+				t.Errorf("loadAOFFiles() sizes = %d, %d, want %d, %d", baseSize, size, len(setFoo), tt.wantSize)
+			}
+
+			got := databases[0].Keys("*")
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadAOFFiles() keys = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAOF_rewriteDue(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name          string
+		percentage    int
+		baseSize      int64
+		currentSize   int64
+		lastRewriteOK bool
+		sinceRewrite  time.Duration
+		want          bool
+	}{
+		{name: "Test too small", percentage: 100, baseSize: 0, currentSize: 1000, lastRewriteOK: true, want: false},
+		{name: "Test not grown enough", percentage: 100, baseSize: 1500, currentSize: 2999, lastRewriteOK: true, want: false},
+		{name: "Test grown enough", percentage: 100, baseSize: 1500, currentSize: 3000, lastRewriteOK: true, want: true},
+		{name: "Test no base", percentage: 100, baseSize: 0, currentSize: 1025, lastRewriteOK: true, want: true},
+		{name: "Test disabled", percentage: 0, baseSize: 0, currentSize: 5000, lastRewriteOK: true, want: false},
+		{name: "Test retry after failure too soon", percentage: 100, currentSize: 5000, sinceRewrite: time.Second, want: false},
+		{name: "Test retry after failure", percentage: 100, currentSize: 5000, sinceRewrite: time.Hour, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAOF()
+			a.file = os.Stdout
+			a.rewriteMinSize = 1024
+			a.baseSize = tt.baseSize
+			a.currentSize = tt.currentSize
+			a.lastRewriteOK = tt.lastRewriteOK
+			a.lastRewriteTry = now.Add(-tt.sinceRewrite)
+
+			if got := a.rewriteDue(Opts{AutoAOFRewritePercentage: tt.percentage}, now); got != tt.want {
+				t.Errorf("rewriteDue() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// AOFCheck is the result of checking a file of RESP commands.
+type AOFCheck struct {
+	Size     int64 // size of the file
+	Valid    int64 // offset right after the last valid command
+	Commands int   // number of commands before Valid
+	Problem  error // first problem found, nil if the whole file is valid
+}
+
+// CheckAOF scans a file of RESP commands, such as a file of the append-only
+// log or a captured replication stream, with the decoder the server reads
+// requests with. An RDB preamble and the '#' annotations are checked too. A
+// transaction without EXEC ends the valid part of the file at its MULTI.
+func CheckAOF(path string) (*AOFCheck, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open failed: %v", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Stat failed: %v", err)
+	}
+
+	c := &AOFCheck{Size: info.Size()}
+	br := bufio.NewReader(f)
+
+	if magic, err := br.Peek(5); err == nil && string(magic) == "REDIS" {
+		if err := NewFile(br).load(newDatabases(databaseCount)); err != nil {
+			c.Problem = fmt.Errorf("corrupt RDB preamble: %v", err)
+			return c, nil
+		}
+
+		pos, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, fmt.Errorf("Seek failed: %v", err)
+		}
+		c.Valid = pos - int64(br.Buffered())
+	}
+
+	reader := NewRespReader(br)
+
+	offset := c.Valid
+	multi := false
+	pending := 0 // commands of the open transaction
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Peek failed: %v", err)
+		}
+
+		if b[0] == '#' {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				c.Problem = fmt.Errorf("annotation cut short at offset %d", offset)
+				break
+			}
+
+			if ts, ok := strings.CutPrefix(strings.TrimRight(line, "\r\n"), "#TS:"); ok {
+				if _, err := strconv.ParseInt(ts, 10, 64); err != nil {
+					c.Problem = fmt.Errorf("invalid timestamp %q at offset %d", ts, offset)
+					break
+				}
+			}
+
+			offset += int64(len(line))
+			if !multi {
+				c.Valid = offset
+			}
+			continue
+		}
+
+		if b[0] != RespArray {
+			c.Problem = fmt.Errorf("unexpected %q at offset %d", b[0], offset)
+			break
+		}
+
+		n, request, err := reader.ReadCommand()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			c.Problem = fmt.Errorf("command cut short at offset %d", offset)
+			break
+		}
+		if err != nil {
+			c.Problem = fmt.Errorf("%v at offset %d", err, offset)
+			break
+		}
+
+		if len(request) == 0 {
+			c.Problem = fmt.Errorf("empty command at offset %d", offset)
+			break
+		}
+
+		switch strings.ToLower(request[0]) {
+		case "multi":
+			if multi {
+				c.Problem = fmt.Errorf("MULTI inside a transaction at offset %d", offset)
+			}
+			multi = true
+		case "exec":
+			if !multi {
+				c.Problem = fmt.Errorf("EXEC without MULTI at offset %d", offset)
+			}
+			multi = false
+		}
+
+		if c.Problem != nil {
+			break
+		}
+
+		offset += int64(n)
+		pending++
+		if !multi {
+			c.Valid = offset
+			c.Commands += pending
+			pending = 0
+		}
+	}
+
+	if c.Problem == nil && multi {
+		c.Problem = fmt.Errorf("MULTI without EXEC at offset %d", c.Valid)
+	}
+
+	return c, nil
+}
@@ -0,0 +1,133 @@
+package protocol
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckAOF(t *testing.T) {
+	const (
+		setFoo   = "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"
+		multi    = "*1\r\n$5\r\nMULTI\r\n"
+		exec     = "*1\r\n$4\r\nEXEC\r\n"
+		ts       = "#TS:1700000000\r\n"
+		setShort = "*3\r\n$3\r\nSET\r\n$3\r\nnew"
+	)
+
+	var buf bytes.Buffer
+	if err := persistence.snapshot(newDatabases(1), Opts{}).write(&buf); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+	preamble := buf.String()
+
+	tests := []struct {
+		name         string
+		content      string
+		wantValid    int
+		wantCommands int
+		wantProblem  bool
+	}{
+		{
+			name:         "Test check",
+			content:      ts + setFoo + multi + setFoo + exec,
+			wantValid:    len(ts + setFoo + multi + setFoo + exec),
+			wantCommands: 4,
+		},
+		{
+			name:         "Test check RDB preamble",
+			content:      preamble + setFoo,
+			wantValid:    len(preamble + setFoo),
+			wantCommands: 1,
+		},
+		{
+			name:         "Test check empty file",
+			content:      "",
+			wantValid:    0,
+			wantCommands: 0,
+		},
+		{
+			name:         "Test check command cut short",
+			content:      setFoo + setShort,
+			wantValid:    len(setFoo),
+			wantCommands: 1,
+			wantProblem:  true,
+		},
+		{
+			name:         "Test check transaction without EXEC",
+			content:      setFoo + multi + setFoo + ts + setFoo,
+			wantValid:    len(setFoo),
+			wantCommands: 1,
+			wantProblem:  true,
+		},
+		{
+			name:         "Test check EXEC without MULTI",
+			content:      setFoo + exec + setFoo,
+			wantValid:    len(setFoo),
+			wantCommands: 1,
+			wantProblem:  true,
+		},
+		{
+			name:         "Test check nested MULTI",
+			content:      multi + setFoo + multi,
+			wantValid:    0,
+			wantCommands: 0,
+			wantProblem:  true,
+		},
+		{
+			name:         "Test check invalid bulk length",
+			content:      setFoo + "*1\r\n$x\r\nPING\r\n" + setFoo,
+			wantValid:    len(setFoo),
+			wantCommands: 1,
+			wantProblem:  true,
+		},
+		{
+			name:         "Test check inline command",
+			content:      setFoo + "PING\r\n",
+			wantValid:    len(setFoo),
+			wantCommands: 1,
+			wantProblem:  true,
+		},
+		{
+			name:         "Test check invalid timestamp",
+			content:      setFoo + "#TS:soon\r\n" + setFoo,
+			wantValid:    len(setFoo),
+			wantCommands: 1,
+			wantProblem:  true,
+		},
+		{
+			name:         "Test check corrupt RDB preamble",
+			content:      preamble[:len(preamble)-3],
+			wantValid:    0,
+			wantCommands: 0,
+			wantProblem:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "appendonly.aof")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatalf("os.WriteFile() error = %v", err)
+			}
+
+			got, err := CheckAOF(path)
+			if err != nil {
+				t.Fatalf("CheckAOF() error = %v", err)
+			}
+
+			if got.Size != int64(len(tt.content)) {
+				t.Errorf("CheckAOF() Size = %v, want %v", got.Size, len(tt.content))
+			}
+			if got.Valid != int64(tt.wantValid) {
+				t.Errorf("CheckAOF() Valid = %v, want %v", got.Valid, tt.wantValid)
+			}
+			if got.Commands != tt.wantCommands {
+				t.Errorf("CheckAOF() Commands = %v, want %v", got.Commands, tt.wantCommands)
+			}
+			if (got.Problem != nil) != tt.wantProblem {
+				t.Errorf("CheckAOF() Problem = %v, wantProblem %v", got.Problem, tt.wantProblem)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package protocol
+
+// Backlog keeps the last bytes propagated to the slaves in a circular buffer,
+// so that a slave reconnecting after a short disconnection only receives the
+// commands it missed instead of a snapshot of the whole dataset.
+type Backlog struct {
+	buf     []byte
+	idx     int // position of the next byte written
+	histlen int // number of bytes held, up to the size of buf
+	end     int // replication offset right after the last byte held
+}
+
+// newBacklog creates a backlog of the given size, empty at the given offset.
+func newBacklog(size int, offset int) *Backlog {
+	return &Backlog{
+		buf: make([]byte, size),
+		end: offset,
+	}
+}
+
+// write adds the bytes propagated to the backlog, overwriting the oldest ones.
+func (b *Backlog) write(s string) {
+	b.end += len(s)
+
+	if len(s) > len(b.buf) {
+		s = s[len(s)-len(b.buf):]
+	}
+
+	n := copy(b.buf[b.idx:], s)
+	copy(b.buf, s[n:])
+
+	b.idx = (b.idx + len(s)) % len(b.buf)
+	b.histlen = min(b.histlen+len(s), len(b.buf))
+}
+
+// first returns the replication offset of the first byte held.
+func (b *Backlog) first() int {
+	return b.end - b.histlen
+}
+
+// since returns the bytes propagated after the given offset, false if some
+// of them aren't held anymore.
+func (b *Backlog) since(offset int) (string, bool) {
+	if offset < b.first() || offset > b.end {
+		return "", false
+	}
+
+	n := b.end - offset
+	start := (b.idx - n + len(b.buf)) % len(b.buf)
+	if start+n <= len(b.buf) {
+		return string(b.buf[start : start+n]), true
+	}
+
+	return string(b.buf[start:]) + string(b.buf[:start+n-len(b.buf)]), true
+}
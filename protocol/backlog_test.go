@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBacklog_since(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		start   int
+		writes  []string
+		offset  int
+		want    string
+		wantOK  bool
+		wantLen int
+	}{
+		{
+			name:    "Test since empty backlog",
+			size:    8,
+			start:   100,
+			offset:  100,
+			want:    "",
+			wantOK:  true,
+			wantLen: 0,
+		},
+		{
+			name:    "Test since start",
+			size:    8,
+			writes:  []string{"abc", "de"},
+			offset:  0,
+			want:    "abcde",
+			wantOK:  true,
+			wantLen: 5,
+		},
+		{
+			name:    "Test since offset within",
+			size:    8,
+			writes:  []string{"abc", "de"},
+			offset:  3,
+			want:    "de",
+			wantOK:  true,
+			wantLen: 5,
+		},
+		{
+			name:    "Test since wrapped around",
+			size:    8,
+			writes:  []string{"abcdef", "ghij"},
+			offset:  3,
+			want:    "defghij",
+			wantOK:  true,
+			wantLen: 8,
+		},
+		{
+			name:    "Test since overwritten",
+			size:    8,
+			writes:  []string{"abcdef", "ghij"},
+			offset:  1,
+			wantOK:  false,
+			wantLen: 8,
+		},
+		{
+			name:    "Test since write larger than the backlog",
+			size:    4,
+			writes:  []string{"ab", "cdefghij"},
+			offset:  6,
+			want:    "ghij",
+			wantOK:  true,
+			wantLen: 4,
+		},
+		{
+			name:    "Test since offset ahead",
+			size:    8,
+			writes:  []string{"abc"},
+			offset:  4,
+			wantOK:  false,
+			wantLen: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBacklog(tt.size, tt.start)
+			for _, w := range tt.writes {
+				b.write(w)
+			}
+
+			if want := tt.start + len(strings.Join(tt.writes, "")); b.end != want {
+				t.Errorf("write() end = %d, want %d", b.end, want)
+			}
+			if b.histlen != tt.wantLen {
+				t.Errorf("write() histlen = %d, want %d", b.histlen, tt.wantLen)
+			}
+
+			got, ok := b.since(tt.offset)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("since() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
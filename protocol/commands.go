@@ -0,0 +1,138 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CommandFlag describes how a command interacts with the server.
+type CommandFlag uint
+
+const (
+	flagWrite    CommandFlag = 1 << iota // may modify the keyspace
+	flagReadonly                         // only reads the keyspace
+	flagBlocking                         // may block the client
+	flagAdmin                            // administrative command
+	flagKeyspace                         // operates on the whole keyspace
+	flagLoading                          // allowed while the dataset is loading
+	flagAllDBs                           // operates on every database
+	flagStale                            // allowed on a slave whose link with master is down
+	flagNoMulti                          // not allowed inside a transaction
+)
+
+// Command represents an entry of the command table.
+type Command struct {
+	name  string
+	arity int // number of arguments including the name, -N means at least N
+	flags CommandFlag
+
+	// key positions inside the request, 0 if the command takes no keys
+	firstKey int
+	lastKey  int // negative values count from the end of the request
+	step     int
+
+	// getKeys extracts the keys of commands whose key positions are not fixed
+	getKeys func(request []string) []string
+
+	handler func(s *Server, args []string) (string, error)
+}
+
+var commands map[string]*Command
+
+func init() {
+	commands = make(map[string]*Command)
+
+	for _, cmd := range []*Command{
+		{name: "ping", arity: -1, flags: flagStale, handler: handlePing},
+		{name: "echo", arity: 2, handler: handleEcho},
+		{name: "select", arity: 2, flags: flagLoading | flagStale, handler: handleSelect},
+		{name: "hello", arity: -1, flags: flagLoading | flagStale, handler: handleHello},
+		{name: "set", arity: -3, flags: flagWrite, firstKey: 1, lastKey: 1, step: 1, handler: handleSet},
+		{name: "get", arity: 2, flags: flagReadonly, firstKey: 1, lastKey: 1, step: 1, handler: handleGet},
+		{name: "incr", arity: 2, flags: flagWrite, firstKey: 1, lastKey: 1, step: 1, handler: handleIncr},
+		{name: "keys", arity: 2, flags: flagReadonly | flagKeyspace, handler: handleKeys},
+		{name: "type", arity: 2, flags: flagReadonly, firstKey: 1, lastKey: 1, step: 1, handler: handleType},
+		{name: "xadd", arity: -5, flags: flagWrite, firstKey: 1, lastKey: 1, step: 1, handler: handleXadd},
+		{name: "xrange", arity: -4, flags: flagReadonly, firstKey: 1, lastKey: 1, step: 1, handler: handleXrange},
+		{name: "xread", arity: -4, flags: flagReadonly | flagBlocking, getKeys: xreadKeys, handler: handleXread},
+		{name: "multi", arity: 1, flags: flagStale, handler: handleMulti},
+		{name: "exec", arity: 1, flags: flagStale, handler: handleExec},
+		{name: "discard", arity: 1, flags: flagStale, handler: handleDiscard},
+		{name: "info", arity: -1, flags: flagLoading | flagStale, handler: handleInfo},
+		{name: "config", arity: -2, flags: flagAdmin | flagLoading | flagStale, handler: handleConfig},
+		{name: "replconf", arity: -1, flags: flagAdmin | flagLoading | flagStale, handler: handleReplconf},
+		{name: "save", arity: 1, flags: flagAdmin | flagAllDBs, handler: handleSave},
+		{name: "bgsave", arity: 1, flags: flagAdmin | flagAllDBs, handler: handleBgsave},
+		{name: "bgrewriteaof", arity: 1, flags: flagAdmin | flagAllDBs, handler: handleBgrewriteaof},
+		{name: "shutdown", arity: -1, flags: flagAdmin | flagAllDBs | flagLoading | flagStale, handler: handleShutdown},
+		{name: "lastsave", arity: 1, flags: flagLoading | flagStale, handler: handleLastsave},
+		{name: "replicaof", arity: 3, flags: flagAdmin | flagStale | flagNoMulti, handler: handleReplicaof},
+		{name: "slaveof", arity: 3, flags: flagAdmin | flagStale | flagNoMulti, handler: handleReplicaof},
+		{name: "psync", arity: -3, flags: flagAdmin | flagAllDBs | flagNoMulti, handler: handlePsync},
+		{name: "wait", arity: 3, flags: flagBlocking | flagNoMulti, handler: handleWait},
+	} {
+		commands[cmd.name] = cmd
+	}
+}
+
+// lookupCommand finds the command for the given request and validates its arity.
+// On failure the RESP error to send back to the client is returned instead.
+func lookupCommand(request []string) (*Command, string) {
+	name := strings.ToLower(request[0])
+
+	cmd, ok := commands[name]
+	if !ok {
+		var args string
+		for _, arg := range request[1:] {
+			args += fmt.Sprintf("'%s' ", arg)
+		}
+
+		return nil, ToSimpleError(fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", request[0], args))
+	}
+
+	if (cmd.arity > 0 && len(request) != cmd.arity) || len(request) < -cmd.arity {
+		return nil, ToSimpleError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd.name))
+	}
+
+	return cmd, ""
+}
+
+// keys returns the keys the given request operates on.
+func (cmd *Command) keys(request []string) []string {
+	if cmd.getKeys != nil {
+		return cmd.getKeys(request)
+	}
+
+	if cmd.firstKey == 0 {
+		return nil
+	}
+
+	last := cmd.lastKey
+	if last < 0 {
+		last = len(request) + last
+	}
+
+	var keys []string
+	for i := cmd.firstKey; i <= last && i < len(request); i += cmd.step {
+		keys = append(keys, request[i])
+	}
+
+	return keys
+}
+
+// isSet reports whether the command has the given flag.
+func (cmd *Command) isSet(flag CommandFlag) bool {
+	return cmd.flags&flag != 0
+}
+
+// xreadKeys returns the stream keys following the STREAMS option of XREAD.
+func xreadKeys(request []string) []string {
+	for i := 1; i < len(request); i++ {
+		if strings.ToUpper(request[i]) == "STREAMS" {
+			streams := request[i+1:]
+			return streams[:len(streams)/2]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_lookupCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []string
+		want    string
+		wantMsg string
+	}{
+		{
+			name:    "Test lookupCommand 1",
+			request: []string{"GET", "key"},
+			want:    "get",
+		},
+		{
+			name:    "Test lookupCommand 2",
+			request: []string{"get"},
+			wantMsg: "-ERR wrong number of arguments for 'get' command\r\n",
+		},
+		{
+			name:    "Test lookupCommand 3",
+			request: []string{"xadd", "key", "*"},
+			wantMsg: "-ERR wrong number of arguments for 'xadd' command\r\n",
+		},
+		{
+			name:    "Test lookupCommand 4",
+			request: []string{"xadd", "key", "*", "field", "value"},
+			want:    "xadd",
+		},
+		{
+			name:    "Test lookupCommand 5",
+			request: []string{"FOO", "bar"},
+			wantMsg: "-ERR unknown command 'FOO', with args beginning with: 'bar' \r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, msg := lookupCommand(tt.request)
+			if msg != tt.wantMsg {
+				t.Errorf("lookupCommand() msg = %q, want %q", msg, tt.wantMsg)
+				return
+			}
+			if got != nil && got.name != tt.want {
+				t.Errorf("lookupCommand() = %v, want %v", got.name, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommand_keys(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []string
+		want    []string
+	}{
+		{
+			name:    "Test keys without keys",
+			request: []string{"ping"},
+			want:    nil,
+		},
+		{
+			name:    "Test keys with single key",
+			request: []string{"set", "key", "value", "PX", "100"},
+			want:    []string{"key"},
+		},
+		{
+			name:    "Test keys with movable keys",
+			request: []string{"xread", "block", "0", "streams", "a", "b", "0-0", "$"},
+			want:    []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := commands[tt.request[0]]
+			if got := cmd.keys(tt.request); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Command.keys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_handleSelect(t *testing.T) {
+	tests := []struct {
+		name   string
+		arg    string
+		want   string
+		wantDB int
+	}{
+		{name: "Test SELECT", arg: "1", want: "+OK\r\n", wantDB: 1},
+		{name: "Test SELECT out of range", arg: "16", want: "-ERR DB index is out of range\r\n", wantDB: 0},
+		{name: "Test SELECT negative", arg: "-1", want: "-ERR DB index is out of range\r\n", wantDB: 0},
+		{name: "Test SELECT not an integer", arg: "a", want: "-ERR value is not an integer or out of range\r\n", wantDB: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{storage: databases[0]}
+			got, err := handleSelect(s, []string{tt.arg})
+			if err != nil {
+				t.Fatalf("handleSelect() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("handleSelect() = %q, want %q", got, tt.want)
+			}
+			if s.db != tt.wantDB || s.storage != databases[tt.wantDB] {
+				t.Errorf("handleSelect() db = %v, want %v", s.db, tt.wantDB)
+			}
+		})
+	}
+}
+
+func Test_handleIncr(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string // "" for a missing key
+		proto int
+		want  string
+	}{
+		{name: "Test INCR missing key", proto: 2, want: ":1\r\n"},
+		{name: "Test INCR", value: "41", proto: 2, want: ":42\r\n"},
+		{name: "Test INCR with RESP3", value: "41", proto: 3, want: ":42\r\n"},
+		{name: "Test INCR not an integer", value: "a", proto: 2, want: "-ERR value is not an integer or out of range\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{storage: newDatabases(1)[0], w: ReplyWriter{proto: tt.proto}}
+			if tt.value != "" {
+				s.storage.Set("counter", tt.value, 0)
+			}
+
+			got, err := handleIncr(s, []string{"counter"})
+			if err != nil {
+				t.Fatalf("handleIncr() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("handleIncr() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
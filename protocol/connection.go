@@ -1,23 +1,35 @@
 package protocol
 
 import (
-	"bufio"
 	"fmt"
 	"net"
+	"sync"
+)
+
+const (
+	// replies are written as soon as this many bytes are pending
+	flushThreshold = 64 * 1024
+	// output buffers grown past this size are released after a flush
+	maxRetainedOutput = 1024 * 1024
 )
 
 // Connection represents a connection between a client and a server.
 type Connection struct {
 	conn   net.Conn
-	reader *bufio.Reader
+	reader *RespReader
 	offset int
+
+	// replies waiting to be flushed. The lock is needed because commands
+	// propagated by other clients are written to slave connections.
+	out  []byte
+	lock sync.Mutex
 }
 
 // NewConnection creates a new Connection instance.
 func NewConnection(c net.Conn) *Connection {
 	return &Connection{
 		conn:   c,
-		reader: bufio.NewReader(c),
+		reader: NewRespReader(c),
 		offset: 0,
 	}
 }
@@ -27,80 +39,64 @@ func (c *Connection) Close() error {
 	return c.conn.Close()
 }
 
-// GetLine returns an individual line from a command without CRLF
-func (c *Connection) GetLine() (int, string, error) {
-	s, err := c.reader.ReadString('\n')
+// Write writes the given string to the connection right away,
+// after the replies still buffered.
+func (c *Connection) Write(s string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	numBytes := len(s)
+	c.out = append(c.out, s...)
 
-	if len(s) > 0 {
-		if s[len(s)-1] == '\n' {
-			s = s[:len(s)-1]
-		}
+	return c.flush()
+}
 
-		if s[len(s)-1] == '\r' {
-			s = s[:len(s)-1]
-		}
+// Append buffers the given reply until the next Flush.
+func (c *Connection) Append(s string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.out = append(c.out, s...)
+	if len(c.out) >= flushThreshold {
+		return c.flush()
 	}
 
-	return numBytes, s, err
+	return nil
+}
+
+// Flush writes the buffered replies to the connection.
+func (c *Connection) Flush() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.flush()
 }
 
-// Write writes the given string to the connection
-func (c *Connection) Write(s string) error {
+func (c *Connection) flush() error {
 	var written int
 
-	for written < len(s) {
-		n, err := c.conn.Write([]byte(s[written:]))
+	for written < len(c.out) {
+		n, err := c.conn.Write(c.out[written:])
 		if err != nil {
+			c.out = c.out[:0]
 			return fmt.Errorf("Write failed: %v", err)
 		}
 		written += n
 	}
+
+	if cap(c.out) > maxRetainedOutput {
+		c.out = nil
+	} else {
+		c.out = c.out[:0]
+	}
+
 	return nil
 }
 
 // Read takes a RESP array and returns the individual requests inside a slice and the offset
 func (s *Server) Read() (int, []string, error) {
-	var o int
-
-	bytes, numElem, err := s.c.GetLine()
+	o, request, err := s.c.reader.ReadCommand()
 	if err != nil {
-		return 0, nil, fmt.Errorf("c.GetLine() failed: %w", err)
-	}
-	o += bytes
-
-	len, err := GetArrayLength(numElem)
-	if err != nil {
-		return 0, nil, fmt.Errorf("GetArrayLength() failed: %w", err)
-	}
-
-	var request []string
-
-	for i := 0; i < len; i++ {
-		bytes, line, err := s.c.GetLine()
-		if err != nil {
-			return 0, nil, fmt.Errorf("c.GetLine() failed: %w", err)
-		}
-		o += bytes
-
-		len, err := GetBulkStringLength(line)
-		if err != nil {
-			return 0, nil, fmt.Errorf("GetBulkStringLength() failed: %w", err)
-		}
-
-		bytes, s, err := s.c.GetLine()
-		if err != nil {
-			return 0, nil, fmt.Errorf("c.GetLine() failed: %w", err)
-		}
-		o += bytes
-
-		err = VerifyBulkStringLength(s, len)
-		if err != nil {
-			return 0, nil, fmt.Errorf("VerifyBulkStringLength() failed: %w", err)
-		}
-
-		request = append(request, s)
+		return 0, nil, fmt.Errorf("ReadCommand() failed: %w", err)
 	}
 
 	return o, request, nil
@@ -0,0 +1,182 @@
+package protocol
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// countingConn counts the writes made to the underlying connection.
+type countingConn struct {
+	net.Conn
+	writes *atomic.Int64
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(b)
+}
+
+// startTestServer serves a single client over the returned connection.
+func startTestServer(t testing.TB, writes *atomic.Int64) net.Conn {
+	client, server := net.Pipe()
+
+	s := NewMaster(NewConnection(countingConn{server, writes}), Opts{Role: "master"}, NewMasterConfig())
+	go s.Handle()
+
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func TestServer_HandlePipeline(t *testing.T) {
+	var writes atomic.Int64
+	client := startTestServer(t, &writes)
+
+	pipeline := ToRespArray([]string{"SET", "pipeline", "1"}) +
+		ToRespArray([]string{"INCR", "pipeline"}) +
+		ToRespArray([]string{"GET", "pipeline"})
+
+	go client.Write([]byte(pipeline))
+
+	r := NewRespReader(client)
+	want := []RespValue{
+		{Kind: RespSimpleString, Str: "OK"},
+		{Kind: RespInteger, Int: 2},
+		{Kind: RespBulkString, Str: "2"},
+	}
+	for i, w := range want {
+		got, err := r.ReadValue()
+		if err != nil {
+			t.Fatalf("ReadValue() error = %v", err)
+		}
+		if got.Kind != w.Kind || got.Str != w.Str || got.Int != w.Int {
+			t.Errorf("reply %d = %+v, want %+v", i, got, w)
+		}
+	}
+
+	if n := writes.Load(); n != 1 {
+		t.Errorf("replies written in %d writes, want 1", n)
+	}
+}
+
+func TestReplyWriter_AppendAllocs(t *testing.T) {
+	w := ReplyWriter{proto: 3}
+	b := make([]byte, 0, 1024)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		b = b[:0]
+		b = w.AppendMap(b, 1)
+		b = w.AppendBulk(b, "key")
+		b = w.AppendArray(b, 2)
+		b = w.AppendInteger(b, 42)
+		b = w.AppendDouble(b, 3.14)
+	})
+	if allocs != 0 {
+		t.Errorf("Append allocations = %v, want 0", allocs)
+	}
+}
+
+// BenchmarkServer_Pipeline sends batches of pipelined commands over TCP and
+// reports how many writes the server made per batch.
+func BenchmarkServer_Pipeline(b *testing.B) {
+	for _, depth := range []int{1, 16, 128} {
+		b.Run("depth="+strconv.Itoa(depth), func(b *testing.B) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatalf("Listen failed: %v", err)
+			}
+			defer l.Close()
+
+			var writes atomic.Int64
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+
+				NewMaster(NewConnection(countingConn{conn, &writes}), Opts{Role: "master"}, NewMasterConfig()).Handle()
+			}()
+
+			client, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				b.Fatalf("Dial failed: %v", err)
+			}
+			defer client.Close()
+
+			var pipeline []byte
+			for i := 0; i < depth; i++ {
+				key := "bench:" + strconv.Itoa(i)
+				if i%2 == 0 {
+					pipeline = append(pipeline, ToRespArray([]string{"SET", key, "value"})...)
+				} else {
+					pipeline = append(pipeline, ToRespArray([]string{"GET", key})...)
+				}
+			}
+
+			r := NewRespReader(client)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(pipeline); err != nil {
+					b.Fatalf("Write failed: %v", err)
+				}
+
+				for j := 0; j < depth; j++ {
+					if _, err := r.ReadValue(); err != nil {
+						b.Fatalf("ReadValue failed: %v", err)
+					}
+				}
+			}
+			b.StopTimer()
+
+			b.ReportMetric(float64(b.N*depth)/b.Elapsed().Seconds(), "cmds/s")
+			b.ReportMetric(float64(writes.Load())/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func TestServer_HandleNoMulti(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []string
+	}{
+		{
+			name:    "Test REPLICAOF inside MULTI",
+			request: []string{"REPLICAOF", "localhost", "6379"},
+		},
+		{
+			name:    "Test PSYNC inside MULTI",
+			request: []string{"PSYNC", "?", "-1"},
+		},
+		{
+			name:    "Test WAIT inside MULTI",
+			request: []string{"WAIT", "1", "0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var writes atomic.Int64
+			client := startTestServer(t, &writes)
+
+			go client.Write([]byte(ToRespArray([]string{"MULTI"}) + ToRespArray(tt.request) + ToRespArray([]string{"EXEC"})))
+
+			r := NewRespReader(client)
+			want := []RespValue{
+				{Kind: RespSimpleString, Str: "OK"},
+				{Kind: RespError, Str: "ERR Command not allowed inside a transaction"},
+				{Kind: RespError, Str: "EXECABORT Transaction discarded because of previous errors."},
+			}
+			for i, w := range want {
+				got, err := r.ReadValue()
+				if err != nil {
+					t.Fatalf("ReadValue() error = %v", err)
+				}
+				if got.Kind != w.Kind || got.Str != w.Str {
+					t.Errorf("reply %d = %+v, want %+v", i, got, w)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+package protocol
+
+import "hash/crc64"
+
+// Redis checksums RDB files with the Jones CRC-64 polynomial, reflected,
+// without the initial and final inversions hash/crc64 applies.
+var crc64Table = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// crc64Update returns the checksum updated with the given bytes, starting from 0.
+func crc64Update(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crc64Table, p)
+}
@@ -0,0 +1,26 @@
+package protocol
+
+import "testing"
+
+func Test_crc64Update(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []string
+		want  uint64
+	}{
+		{name: "Test check value", input: []string{"123456789"}, want: 0xe9c6d914c4b8d9ca},
+		{name: "Test incremental update", input: []string{"1234", "56789"}, want: 0xe9c6d914c4b8d9ca},
+		{name: "Test empty input", input: []string{}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var crc uint64
+			for _, p := range tt.input {
+				crc = crc64Update(crc, []byte(p))
+			}
+			if crc != tt.want {
+				t.Errorf("crc64Update() = %x, want %x", crc, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,762 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// memory overheads counted by the estimates of KeyStats
+const (
+	keyOverhead     = 56 // hash table entry, key and value headers
+	elementOverhead = 16 // header of each element of a collection
+)
+
+// Dump is the content of an RDB file loaded for inspection, expired keys
+// included. It can be exported to JSON lines or RESP commands and imported
+// back to write a new RDB file.
+type Dump struct {
+	Version int
+	Aux     map[string]string
+
+	dbs []map[string]*Entry
+}
+
+// KeyStats describes a key of a dump.
+type KeyStats struct {
+	DB       int
+	Key      string
+	Type     string
+	ExpireAt int64 // unix time in milliseconds, 0 if the key doesn't expire
+	Elements int
+	Memory   int64 // estimate of the bytes used by the key and its value
+}
+
+// NewDump returns an empty dump.
+func NewDump() *Dump {
+	d := &Dump{
+		Version: rdbSaveVersion,
+		Aux:     make(map[string]string),
+		dbs:     make([]map[string]*Entry, databaseCount),
+	}
+
+	for i := range d.dbs {
+		d.dbs[i] = make(map[string]*Entry)
+	}
+
+	return d
+}
+
+// ReadDump loads an RDB file, verifying its structure and checksum.
+func ReadDump(r io.Reader) (*Dump, error) {
+	dbs := newDatabases(databaseCount)
+
+	file := NewFile(r)
+	file.keepExpired = true
+	if err := file.load(dbs); err != nil {
+		return nil, err
+	}
+
+	d := NewDump()
+	d.Version = file.version
+	d.Aux = file.aux
+
+	for i, db := range dbs {
+		for _, sh := range db.shards {
+			for k, e := range sh.keys {
+				d.dbs[i][k] = e
+			}
+		}
+	}
+
+	return d, nil
+}
+
+// WriteRDB writes the dump as an RDB file.
+func (d *Dump) WriteRDB(w io.Writer) error {
+	snap := &Snapshot{
+		dbs: d.dbs,
+		aux: [][2]string{
+			{"redis-ver", "7.2.0"},
+			{"redis-bits", "64"},
+			{"ctime", strconv.FormatInt(time.Now().Unix(), 10)},
+		},
+	}
+
+	return snap.write(w)
+}
+
+// Keys returns the stats of every key, ordered by database and key.
+func (d *Dump) Keys() []KeyStats {
+	var stats []KeyStats
+	for i, keys := range d.dbs {
+		for key, e := range keys {
+			elements, memory := valueSize(e.value)
+			stats = append(stats, KeyStats{
+				DB:       i,
+				Key:      key,
+				Type:     e.value.Type().String(),
+				ExpireAt: e.expireAt,
+				Elements: elements,
+				Memory:   keyOverhead + int64(len(key)) + memory,
+			})
+		}
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].DB != stats[j].DB {
+			return stats[i].DB < stats[j].DB
+		}
+		return stats[i].Key < stats[j].Key
+	})
+
+	return stats
+}
+
+// valueSize returns the number of elements of a value and an estimate of
+// the bytes it uses: the strings it holds and an overhead per element.
+func valueSize(v Value) (int, int64) {
+	var n int
+	var size int64
+	add := func(strs ...string) {
+		n++
+		size += elementOverhead
+		for _, s := range strs {
+			size += int64(len(s))
+		}
+	}
+
+	switch v := v.(type) {
+	case String:
+		return 1, int64(len(v))
+	case *List:
+		for _, elem := range v.elems {
+			add(elem)
+		}
+	case *Set:
+		for m := range v.members {
+			add(m)
+		}
+	case *ZSet:
+		for m := range v.scores {
+			add(m)
+			size += 8
+		}
+	case *Hash:
+		for field, value := range v.fields {
+			add(field, value)
+		}
+	case *Stream:
+		for _, entry := range v.entries {
+			add(entry.id)
+			for field, value := range entry.kvpairs {
+				size += int64(len(field) + len(value))
+			}
+		}
+	}
+
+	return n, size
+}
+
+// record is a key written as a JSON line.
+type record struct {
+	DB       int             `json:"db"`
+	Key      string          `json:"key"`
+	Type     string          `json:"type"`
+	ExpireAt int64           `json:"expire_at,omitempty"`
+	Value    json.RawMessage `json:"value"`
+}
+
+type jsonStream struct {
+	Entries      []jsonStreamEntry `json:"entries"`
+	LastID       string            `json:"last_id"`
+	EntriesAdded int64             `json:"entries_added"`
+	MaxDeletedID string            `json:"max_deleted_id,omitempty"`
+	Groups       []jsonGroup       `json:"groups,omitempty"`
+}
+
+type jsonStreamEntry struct {
+	ID     string            `json:"id"`
+	Fields map[string]string `json:"fields"`
+}
+
+type jsonGroup struct {
+	Name        string         `json:"name"`
+	LastID      string         `json:"last_id"`
+	EntriesRead int64          `json:"entries_read"`
+	Pending     []jsonPending  `json:"pending,omitempty"`
+	Consumers   []jsonConsumer `json:"consumers,omitempty"`
+}
+
+type jsonPending struct {
+	ID            string `json:"id"`
+	Consumer      string `json:"consumer"`
+	DeliveryTime  int64  `json:"delivery_time"`
+	DeliveryCount int64  `json:"delivery_count"`
+}
+
+type jsonConsumer struct {
+	Name       string `json:"name"`
+	SeenTime   int64  `json:"seen_time"`
+	ActiveTime int64  `json:"active_time"`
+}
+
+// WriteJSON writes a JSON object per key. Sorted set scores are written as
+// strings so infinite scores are kept. JSON strings only hold UTF-8, other
+// bytes are replaced: the RESP export keeps binary values intact.
+func (d *Dump) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+
+	for _, stats := range d.Keys() {
+		e := d.dbs[stats.DB][stats.Key]
+
+		value, err := json.Marshal(jsonValue(e.value))
+		if err != nil {
+			return fmt.Errorf("json.Marshal failed for key %s: %v", stats.Key, err)
+		}
+
+		r := record{DB: stats.DB, Key: stats.Key, Type: stats.Type, ExpireAt: e.expireAt, Value: value}
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// jsonValue returns the value in the form it is marshaled to.
+func jsonValue(v Value) any {
+	switch v := v.(type) {
+	case String:
+		return string(v)
+
+	case *List:
+		return v.elems
+
+	case *Set:
+		return sortedKeys(v.members)
+
+	case *ZSet:
+		scores := make(map[string]string, len(v.scores))
+		for m, score := range v.scores {
+			scores[m] = formatScore(score)
+		}
+		return scores
+
+	case *Hash:
+		return v.fields
+
+	case *Stream:
+		stream := jsonStream{
+			Entries:      make([]jsonStreamEntry, 0, len(v.entries)),
+			LastID:       v.lastID,
+			EntriesAdded: v.entriesAdded,
+			MaxDeletedID: v.maxDeletedID,
+		}
+
+		// streams loaded from an RDB file always have one
+		if stream.MaxDeletedID == "" {
+			stream.MaxDeletedID = "0-0"
+		}
+
+		for _, entry := range v.entries {
+			stream.Entries = append(stream.Entries, jsonStreamEntry{ID: entry.id, Fields: entry.kvpairs})
+		}
+
+		for _, g := range v.groups {
+			group := jsonGroup{Name: g.name, LastID: g.lastID, EntriesRead: g.entriesRead}
+			for _, p := range g.pending {
+				group.Pending = append(group.Pending, jsonPending{p.id, p.consumer, p.deliveryTime, p.deliveryCount})
+			}
+			for _, c := range g.consumers {
+				group.Consumers = append(group.Consumers, jsonConsumer{c.name, c.seenTime, c.activeTime})
+			}
+			stream.Groups = append(stream.Groups, group)
+		}
+
+		return stream
+	}
+
+	return nil
+}
+
+// ReadJSON imports the keys written by WriteJSON.
+func ReadJSON(r io.Reader) (*Dump, error) {
+	d := NewDump()
+	dec := json.NewDecoder(r)
+
+	for n := 1; ; n++ {
+		var rec record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return d, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Decode failed for record %d: %v", n, err)
+		}
+
+		if rec.DB < 0 || rec.DB >= len(d.dbs) {
+			return nil, fmt.Errorf("DB index %d of key %s is out of range", rec.DB, rec.Key)
+		}
+
+		v, err := parseJSONValue(rec.Type, rec.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for key %s: %v", rec.Key, err)
+		}
+
+		d.dbs[rec.DB][rec.Key] = NewEntry(v, rec.ExpireAt)
+	}
+}
+
+// parseJSONValue parses a value marshaled from jsonValue.
+func parseJSONValue(t string, data json.RawMessage) (Value, error) {
+	switch t {
+	case "string":
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, err
+		}
+		return String(s), nil
+
+	case "list":
+		var elems []string
+		if err := json.Unmarshal(data, &elems); err != nil {
+			return nil, err
+		}
+		return NewList(elems...), nil
+
+	case "set":
+		var members []string
+		if err := json.Unmarshal(data, &members); err != nil {
+			return nil, err
+		}
+		return NewSet(members...), nil
+
+	case "zset":
+		var scores map[string]string
+		if err := json.Unmarshal(data, &scores); err != nil {
+			return nil, err
+		}
+
+		zset := NewZSet()
+		for m, s := range scores {
+			score, err := parseScore(s)
+			if err != nil {
+				return nil, err
+			}
+			zset.scores[m] = score
+		}
+		return zset, nil
+
+	case "hash":
+		hash := NewHash()
+		if err := json.Unmarshal(data, &hash.fields); err != nil {
+			return nil, err
+		}
+		return hash, nil
+
+	case "stream":
+		var js jsonStream
+		if err := json.Unmarshal(data, &js); err != nil {
+			return nil, err
+		}
+
+		stream := NewStream()
+		stream.lastID = js.LastID
+		stream.entriesAdded = js.EntriesAdded
+		stream.maxDeletedID = js.MaxDeletedID
+
+		for _, entry := range js.Entries {
+			stream.entries = append(stream.entries, &StreamEntry{id: entry.ID, kvpairs: entry.Fields})
+		}
+
+		for _, g := range js.Groups {
+			group := &ConsumerGroup{name: g.Name, lastID: g.LastID, entriesRead: g.EntriesRead}
+			for _, p := range g.Pending {
+				group.pending = append(group.pending, &PendingEntry{p.ID, p.Consumer, p.DeliveryTime, p.DeliveryCount})
+			}
+			for _, c := range g.Consumers {
+				group.consumers = append(group.consumers, &Consumer{c.Name, c.SeenTime, c.ActiveTime})
+			}
+			stream.groups = append(stream.groups, group)
+		}
+		return stream, nil
+	}
+
+	return nil, fmt.Errorf("unknown type %q", t)
+}
+
+// formatScore formats a sorted set score the way Redis replies with it.
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// parseScore parses a sorted set score, infinite scores included.
+func parseScore(s string) (float64, error) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, fmt.Errorf("invalid score %q", s)
+	}
+
+	return score, nil
+}
+
+// WriteRESP writes the commands rebuilding the keys, as accepted by
+// redis-cli --pipe.
+func (d *Dump) WriteRESP(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	db := -1
+
+	for _, stats := range d.Keys() {
+		if stats.DB != db {
+			db = stats.DB
+			if _, err := bw.WriteString(ToRespArray([]string{"SELECT", strconv.Itoa(db)})); err != nil {
+				return err
+			}
+		}
+
+		e := d.dbs[stats.DB][stats.Key]
+		for _, cmd := range respCommands(stats.Key, e) {
+			if _, err := bw.WriteString(ToRespArray(cmd)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// respCommands returns the commands rebuilding a key, as Redis rewrites it
+// to its append-only file.
+func respCommands(key string, e *Entry) [][]string {
+	var cmds [][]string
+
+	switch v := e.value.(type) {
+	case String:
+		cmds = append(cmds, []string{"SET", key, string(v)})
+
+	case *List:
+		cmds = append(cmds, append([]string{"RPUSH", key}, v.elems...))
+
+	case *Set:
+		cmds = append(cmds, append([]string{"SADD", key}, sortedKeys(v.members)...))
+
+	case *ZSet:
+		cmd := []string{"ZADD", key}
+		for _, m := range sortedKeys(v.scores) {
+			cmd = append(cmd, formatScore(v.scores[m]), m)
+		}
+		cmds = append(cmds, cmd)
+
+	case *Hash:
+		cmd := []string{"HSET", key}
+		for _, field := range sortedKeys(v.fields) {
+			cmd = append(cmd, field, v.fields[field])
+		}
+		cmds = append(cmds, cmd)
+
+	case *Stream:
+		cmds = append(cmds, streamCommands(key, v)...)
+	}
+
+	if e.expireAt != 0 {
+		cmds = append(cmds, []string{"PEXPIREAT", key, strconv.FormatInt(e.expireAt, 10)})
+	}
+
+	return cmds
+}
+
+// streamCommands returns the commands rebuilding a stream: its entries, its
+// metadata and its consumer groups with their consumers and pending entries.
+func streamCommands(key string, stream *Stream) [][]string {
+	var cmds [][]string
+
+	for _, entry := range stream.entries {
+		cmd := []string{"XADD", key, entry.id}
+		for _, field := range sortedKeys(entry.kvpairs) {
+			cmd = append(cmd, field, entry.kvpairs[field])
+		}
+		cmds = append(cmds, cmd)
+	}
+
+	lastID := stream.lastID
+	if lastID == "" {
+		lastID = "0-0"
+	}
+
+	if len(stream.entries) == 0 {
+		// an entry is needed to create the stream, trimmed right away
+		id := lastID
+		if id == "0-0" {
+			id = "0-1"
+		}
+		cmds = append(cmds, []string{"XADD", key, "MAXLEN", "0", id, "x", "y"})
+	}
+
+	maxDeletedID := stream.maxDeletedID
+	if maxDeletedID == "" {
+		maxDeletedID = "0-0"
+	}
+
+	cmds = append(cmds, []string{"XSETID", key, lastID,
+		"ENTRIESADDED", strconv.FormatInt(stream.entriesAdded, 10), "MAXDELETEDID", maxDeletedID})
+
+	for _, g := range stream.groups {
+		cmds = append(cmds, []string{"XGROUP", "CREATE", key, g.name, g.lastID,
+			"ENTRIESREAD", strconv.FormatInt(g.entriesRead, 10)})
+
+		for _, c := range g.consumers {
+			cmds = append(cmds, []string{"XGROUP", "CREATECONSUMER", key, g.name, c.name})
+		}
+
+		for _, p := range g.pending {
+			cmds = append(cmds, []string{"XCLAIM", key, g.name, p.consumer, "0", p.id,
+				"TIME", strconv.FormatInt(p.deliveryTime, 10),
+				"RETRYCOUNT", strconv.FormatInt(p.deliveryCount, 10), "FORCE", "JUSTID"})
+		}
+	}
+
+	return cmds
+}
+
+// sortedKeys returns the keys of the map in order, so exports are reproducible.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// ReadRESP imports the keys written by WriteRESP.
+func ReadRESP(r io.Reader) (*Dump, error) {
+	d := NewDump()
+	reader := NewRespReader(r)
+	db := 0
+
+	for n := 1; ; n++ {
+		_, request, err := reader.ReadCommand()
+		if err == io.EOF {
+			return d, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ReadCommand failed for command %d: %v", n, err)
+		}
+
+		if len(request) < 2 {
+			return nil, fmt.Errorf("command %d is too short: %q", n, request)
+		}
+
+		if strings.ToUpper(request[0]) == "SELECT" {
+			if db, err = strconv.Atoi(request[1]); err != nil || db < 0 || db >= len(d.dbs) {
+				return nil, fmt.Errorf("invalid DB index %q in command %d", request[1], n)
+			}
+			continue
+		}
+
+		if err := applyCommand(d.dbs[db], request); err != nil {
+			return nil, fmt.Errorf("command %d %s failed: %v", n, strings.ToUpper(request[0]), err)
+		}
+	}
+}
+
+var errSyntax = errors.New("syntax error")
+
+// applyCommand runs one of the commands written by respCommands.
+func applyCommand(keys map[string]*Entry, request []string) error {
+	cmd := strings.ToUpper(request[0])
+	if cmd == "XGROUP" {
+		// the key follows the subcommand
+		if len(request) < 3 {
+			return errSyntax
+		}
+		request = append([]string{request[0], request[2], request[1]}, request[3:]...)
+	}
+	key, args := request[1], request[2:]
+
+	var v Value
+	if e, ok := keys[key]; ok {
+		v = e.value
+	}
+
+	// the value a command creates, nil if it modifies v
+	var created Value
+
+	switch cmd {
+	case "SET":
+		if len(args) != 1 {
+			return errSyntax
+		}
+		created = String(args[0])
+
+	case "RPUSH", "SADD":
+		if len(args) == 0 || v != nil {
+			return errSyntax
+		}
+		if cmd == "RPUSH" {
+			created = NewList(args...)
+		} else {
+			created = NewSet(args...)
+		}
+
+	case "ZADD":
+		if len(args) == 0 || len(args)%2 != 0 || v != nil {
+			return errSyntax
+		}
+		zset := NewZSet()
+		for i := 0; i < len(args); i += 2 {
+			score, err := parseScore(args[i])
+			if err != nil {
+				return err
+			}
+			zset.scores[args[i+1]] = score
+		}
+		created = zset
+
+	case "HSET":
+		if len(args) == 0 || len(args)%2 != 0 || v != nil {
+			return errSyntax
+		}
+		hash := NewHash()
+		for i := 0; i < len(args); i += 2 {
+			hash.fields[args[i]] = args[i+1]
+		}
+		created = hash
+
+	case "PEXPIREAT":
+		if len(args) != 1 || v == nil {
+			return errSyntax
+		}
+		t, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		keys[key].expireAt = t
+		return nil
+
+	case "XADD", "XSETID", "XGROUP", "XCLAIM":
+		stream, ok := v.(*Stream)
+		if v != nil && !ok {
+			return ErrWrongType
+		}
+		if stream == nil {
+			stream = NewStream()
+			created = stream
+		}
+
+		if err := applyStreamCommand(stream, cmd, args); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unsupported command %s", cmd)
+	}
+
+	if created != nil {
+		keys[key] = NewEntry(created, 0)
+	}
+
+	return nil
+}
+
+// applyStreamCommand runs one of the commands written by streamCommands.
+func applyStreamCommand(stream *Stream, cmd string, args []string) error {
+	switch cmd {
+	case "XADD":
+		if len(args) >= 2 && strings.ToUpper(args[0]) == "MAXLEN" {
+			// the stream was only created, its entry trimmed
+			if len(args) != 5 || args[1] != "0" {
+				return errSyntax
+			}
+			stream.lastID = args[2]
+			return nil
+		}
+
+		if len(args) < 3 || len(args)%2 != 1 {
+			return errSyntax
+		}
+
+		entry, err := NewStreamEntry(args[0], args[1:])
+		if err != nil {
+			return err
+		}
+		stream.entries = append(stream.entries, entry)
+		stream.lastID = entry.id
+		stream.entriesAdded++
+
+	case "XSETID":
+		if len(args) != 5 || strings.ToUpper(args[1]) != "ENTRIESADDED" || strings.ToUpper(args[3]) != "MAXDELETEDID" {
+			return errSyntax
+		}
+		added, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return err
+		}
+		stream.lastID, stream.entriesAdded, stream.maxDeletedID = args[0], added, args[4]
+
+	case "XGROUP":
+		switch {
+		case len(args) == 5 && strings.ToUpper(args[0]) == "CREATE" && strings.ToUpper(args[3]) == "ENTRIESREAD":
+			entriesRead, err := strconv.ParseInt(args[4], 10, 64)
+			if err != nil {
+				return err
+			}
+			stream.groups = append(stream.groups, &ConsumerGroup{name: args[1], lastID: args[2], entriesRead: entriesRead})
+
+		case len(args) == 3 && strings.ToUpper(args[0]) == "CREATECONSUMER":
+			group := findGroup(stream, args[1])
+			if group == nil {
+				return fmt.Errorf("no group %s", args[1])
+			}
+			// the times of the consumer aren't part of the commands
+			group.consumers = append(group.consumers, &Consumer{name: args[2], seenTime: time.Now().UnixMilli(), activeTime: -1})
+
+		default:
+			return errSyntax
+		}
+
+	case "XCLAIM":
+		if len(args) != 10 {
+			return errSyntax
+		}
+		group := findGroup(stream, args[0])
+		if group == nil {
+			return fmt.Errorf("no group %s", args[0])
+		}
+		deliveryTime, err1 := strconv.ParseInt(args[5], 10, 64)
+		deliveryCount, err2 := strconv.ParseInt(args[7], 10, 64)
+		if err := errors.Join(err1, err2); err != nil {
+			return err
+		}
+		group.pending = append(group.pending, &PendingEntry{args[3], args[1], deliveryTime, deliveryCount})
+	}
+
+	return nil
+}
+
+// findGroup returns the consumer group with the given name, nil if there is none.
+func findGroup(stream *Stream, name string) *ConsumerGroup {
+	for _, g := range stream.groups {
+		if g.name == name {
+			return g
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadDump(t *testing.T) {
+	stream := NewStream()
+	for _, id := range []string{"1-1", "2-0", "2-1"} {
+		entry, _ := NewStreamEntry(id, []string{"f", id, "g", "x"})
+		stream.entries = append(stream.entries, entry)
+	}
+	stream.lastID = "3-0"
+	stream.maxDeletedID = "3-0"
+	stream.entriesAdded = 4
+	stream.groups = []*ConsumerGroup{{
+		name:        "grp",
+		lastID:      "2-0",
+		entriesRead: 2,
+		pending:     []*PendingEntry{{id: "1-1", consumer: "alice", deliveryTime: 1, deliveryCount: 2}},
+		consumers:   []*Consumer{{name: "alice", seenTime: 3, activeTime: 4}},
+	}}
+
+	empty := NewStream()
+	empty.lastID = "5-5"
+	empty.entriesAdded = 1
+	empty.maxDeletedID = "5-5"
+
+	zset := NewZSet()
+	zset.scores["a"] = 1.5
+	zset.scores["b"] = math.Inf(-1)
+	zset.scores["c"] = 0.1
+
+	hash := NewHash()
+	hash.fields["field"] = "value"
+
+	d := NewDump()
+	d.dbs[0]["str"] = NewEntry(String("value"), time.Now().Add(time.Hour).UnixMilli())
+	d.dbs[0]["expired"] = NewEntry(String("value"), 1)
+	d.dbs[0]["binary"] = NewEntry(String("\x00\xff"), 0)
+	d.dbs[0]["list"] = NewEntry(NewList("a", "1", "300"), 0)
+	d.dbs[0]["set"] = NewEntry(NewSet("a", "b"), 0)
+	d.dbs[3]["zset"] = NewEntry(zset, 0)
+	d.dbs[3]["hash"] = NewEntry(hash, 0)
+	d.dbs[3]["stream"] = NewEntry(stream, 0)
+	d.dbs[3]["empty"] = NewEntry(empty, 0)
+
+	var rdb bytes.Buffer
+	if err := d.WriteRDB(&rdb); err != nil {
+		t.Fatalf("WriteRDB() error = %v", err)
+	}
+
+	loaded, err := ReadDump(&rdb)
+	if err != nil {
+		t.Fatalf("ReadDump() error = %v", err)
+	}
+
+	if len(loaded.Keys()) != 9 {
+		t.Errorf("ReadDump() keys = %v, want 9 keys", loaded.Keys())
+	}
+
+	if stats := loaded.Keys()[2]; stats.Key != "list" || stats.Type != "list" || stats.Elements != 3 || stats.Memory != keyOverhead+4+3*elementOverhead+5 {
+		t.Errorf("Keys()[2] = %+v", stats)
+	}
+
+	tests := []struct {
+		name   string
+		write  func(d *Dump, w io.Writer) error
+		read   func(r io.Reader) (*Dump, error)
+		binary bool
+	}{
+		{name: "Test JSON lines", write: (*Dump).WriteJSON, read: ReadJSON},
+		{name: "Test RESP commands", write: (*Dump).WriteRESP, read: ReadRESP, binary: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.write(loaded, &buf); err != nil {
+				t.Fatalf("write error = %v", err)
+			}
+
+			imported, err := tt.read(&buf)
+			if err != nil {
+				t.Fatalf("read error = %v", err)
+			}
+
+			for i, keys := range loaded.dbs {
+				got := imported.dbs[i]
+				if !tt.binary {
+					// JSON strings only hold UTF-8
+					if e, ok := got["binary"]; ok && e.value == String("\x00�") {
+						got["binary"] = keys["binary"]
+					}
+				}
+
+				// the commands don't give the times of the consumers
+				if e, ok := got["stream"]; ok && tt.binary {
+					c := e.value.(*Stream).groups[0].consumers[0]
+					c.seenTime, c.activeTime = 3, 4
+				}
+
+				if !reflect.DeepEqual(got, keys) {
+					t.Errorf("DB %d = %v, want %v", i, got, keys)
+				}
+			}
+
+			// the imported keys are written back to an RDB file
+			var rdb bytes.Buffer
+			if err := imported.WriteRDB(&rdb); err != nil {
+				t.Fatalf("WriteRDB() error = %v", err)
+			}
+			if _, err := ReadDump(&rdb); err != nil {
+				t.Errorf("ReadDump() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestReadRESP(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []string
+		wantErr bool
+	}{
+		{name: "Test unsupported command", input: []string{ToRespArray([]string{"INCR", "a"})}, wantErr: true},
+		{name: "Test invalid DB", input: []string{ToRespArray([]string{"SELECT", "16"})}, wantErr: true},
+		{name: "Test invalid score", input: []string{ToRespArray([]string{"ZADD", "z", "nan", "a"})}, wantErr: true},
+		{name: "Test expiry of a missing key", input: []string{ToRespArray([]string{"PEXPIREAT", "a", "1"})}, wantErr: true},
+		{
+			name: "Test wrong type",
+			input: []string{
+				ToRespArray([]string{"SET", "a", "1"}),
+				ToRespArray([]string{"XADD", "a", "1-1", "f", "v"}),
+			},
+			wantErr: true,
+		},
+		{
+			name: "Test consumer of a missing group",
+			input: []string{
+				ToRespArray([]string{"XADD", "s", "1-1", "f", "v"}),
+				ToRespArray([]string{"XGROUP", "CREATECONSUMER", "s", "grp", "alice"}),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			for _, cmd := range tt.input {
+				buf.WriteString(cmd)
+			}
+
+			_, err := ReadRESP(&buf)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ReadRESP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
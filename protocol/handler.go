@@ -1,33 +1,62 @@
 package protocol
 
 import (
-	"encoding/base64"
+	"bytes"
 	"errors"
 	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Server represents a server
 type Server struct {
-	c       *Connection
-	opts    Opts
-	storage *Storage
-	queuing bool
-	queue   [][]string
+	c           *Connection
+	opts        Opts
+	storage     *Storage
+	db          int
+	id          int64
+	name        string
+	w           ReplyWriter
+	queuing     bool
+	queue       [][]string
+	queueFailed bool
+
+	// set while EXEC holds the storage locks of the queued commands
+	locked bool
+
+	// set on the replication link a slave keeps with its master
+	fromMaster bool
+	// replication offset of the last command applied out of a transaction
+	applied int
+
+	// set on the client replaying the append-only file
+	replay bool
+
+	// deterministic form of the running write command, propagated in its place
+	rewritten []string
+	// write commands to propagate once the running command or transaction ends
+	ops []op
 
 	// for master only
 	mc *MasterConfig
 }
 
+var nextClientID atomic.Int64
+
 // NewMaster is the master constructor
 func NewMaster(conn *Connection, o Opts, mc *MasterConfig) *Server {
 	return &Server{
 		c:       conn,
 		opts:    o,
-		storage: storage,
+		storage: databases[0],
+		id:      nextClientID.Add(1),
 		mc:      mc,
 		queuing: false,
 		queue:   make([][]string, 0),
@@ -36,371 +65,627 @@ func NewMaster(conn *Connection, o Opts, mc *MasterConfig) *Server {
 
 // MasterConfig represents the configuration used by master
 type MasterConfig struct {
-	slaves     *Slaves
-	wg         *sync.WaitGroup
-	propOffset int
+	slaves *Slaves
 }
 
 // NewMasterConfig is the MasterConfig constructor
 func NewMasterConfig() *MasterConfig {
 	return &MasterConfig{
-		slaves:     list,
-		propOffset: 0,
+		slaves: list,
 	}
 }
 
 // NewSlave is the slave constructor
 func NewSlave(conn *Connection) *Server {
 	return &Server{
-		c:       conn,
-		storage: storage,
+		c:          conn,
+		storage:    databases[0],
+		id:         nextClientID.Add(1),
+		fromMaster: true,
 	}
 }
 
 // Handle reads and handles
 func (s *Server) Handle() {
 	defer s.c.Close()
+	defer s.c.Flush()
 
-	s.processRDB()
+	if s.mc != nil {
+		defer s.mc.slaves.RemoveSlave(s.c.conn.RemoteAddr(), s.c)
+	}
 
 	for {
 		o, request, err := s.Read()
 		if err != nil {
 			fmt.Printf("conn.Read() failed: %v\n", err)
+
+			var perr ProtocolError
+			if errors.As(err, &perr) {
+				s.reply(ToSimpleError("ERR " + perr.Error()))
+			}
+
 			return
 		}
 
-		fmt.Printf("Received request: %v\n", request)
+		// empty inline commands are silently ignored
+		if len(request) > 0 {
+			err = s.HandleRequest(request)
+			if err != nil {
+				fmt.Printf("protocol.HandleRequest() failed: %v\n", err)
+			}
+		}
 
-		err = s.HandleRequest(request)
-		if err != nil {
-			fmt.Printf("protocol.HandleRequest() failed: %v\n", err)
+		// replies to pipelined commands are sent together once every request has been handled
+		if s.c.reader.Buffered() == 0 {
+			if err := s.c.Flush(); err != nil {
+				fmt.Printf("Flush() failed: %v\n", err)
+				return
+			}
 		}
 
-		if s.opts.Role != "master" && (len(request) <= 1 || request[1] != "GETACK") {
+		// GETACK is counted once acknowledged
+		if s.fromMaster && !isGetack(request) {
 			s.c.offset += o
 		}
+
+		if s.fromMaster {
+			// master writes every command as an array of bulk strings
+			list.Feed(ToRespArray(request))
+		}
+
+		// the next handshake resumes the replication from there
+		if s.fromMaster && !s.queuing && s.applied != s.c.offset {
+			s.applied = s.c.offset
+			list.SetOffset(s.applied)
+		}
 	}
 }
 
+// isGetack reports whether the request is the REPLCONF GETACK master sends to its slaves.
+func isGetack(request []string) bool {
+	return len(request) > 1 && strings.EqualFold(request[0], "REPLCONF") && strings.EqualFold(request[1], "GETACK")
+}
+
 // HandleRequest responds to the request recieved.
 func (s *Server) HandleRequest(request []string) error {
 	if len(request) == 0 {
 		return fmt.Errorf("empty request")
 	}
 
-	switch strings.ToUpper(request[0]) {
-	case "EXEC":
-		if err := handleExec(s); err != nil {
-			return fmt.Errorf("MULTI failed: %v", err)
-		}
-	case "MULTI":
-		if err := handleMulti(s); err != nil {
-			return fmt.Errorf("MULTI failed: %v", err)
-		}
-	case "DISCARD":
-		if err := handleDiscard(s); err != nil {
-			return fmt.Errorf("MULTI failed: %v", err)
-		}
-	default:
+	cmd, msg := lookupCommand(request)
+	if cmd == nil {
 		if s.queuing {
-			s.queue = append(s.queue, request)
+			s.queueFailed = true
+		}
 
-			if err := s.c.Write("+QUEUED\r\n"); err != nil {
-				return fmt.Errorf("Write failed: %v", err)
-			}
+		return s.reply(msg)
+	}
 
-			return nil
+	// the master link keeps streaming while the dataset loads
+	if persistence.Loading() && !s.fromMaster && !cmd.isSet(flagLoading) {
+		if s.queuing {
+			s.queueFailed = true
 		}
 
-		response, err := s.processRequest(request)
-		if err != nil {
-			return fmt.Errorf("processRequest failed: %v", err)
+		return s.reply(ToSimpleError("LOADING Redis is loading the dataset in memory"))
+	}
+
+	// a slave only changes its dataset the way its master does
+	if msg := s.replicaError(cmd); msg != "" {
+		if s.queuing {
+			s.queueFailed = true
 		}
 
-		s.c.Write(response)
+		return s.reply(msg)
 	}
 
-	return nil
+	if s.queuing && cmd.isSet(flagNoMulti) {
+		s.queueFailed = true
+
+		return s.reply(ToSimpleError("ERR Command not allowed inside a transaction"))
+	}
+
+	if s.queuing && cmd.name != "exec" && cmd.name != "multi" && cmd.name != "discard" {
+		s.queue = append(s.queue, request)
+
+		return s.reply("+QUEUED\r\n")
+	}
+
+	return s.reply(s.call(cmd, request))
 }
 
-func handleMulti(s *Server) error {
-	if !s.queuing {
-		s.queuing = true
-	} else {
-		return errors.New("Multi Already Called")
+// replicaError returns the error a slave replies to its clients with when
+// they can't run the command, or "" if they can.
+func (s *Server) replicaError(cmd *Command) string {
+	if s.fromMaster || s.replay {
+		return ""
 	}
 
-	if err := s.c.Write("+OK\r\n"); err != nil {
-		return fmt.Errorf("Write failed: %v", err)
+	state := link.status()
+	if state == linkNone {
+		return ""
+	}
+
+	if cmd.isSet(flagWrite) && s.opts.ReplicaReadOnly == "yes" {
+		return ToSimpleError("READONLY You can't write against a read only replica.")
+	}
+
+	if state != linkConnected && !cmd.isSet(flagStale) && s.opts.ReplicaServeStaleData == "no" {
+		return ToSimpleError("MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.")
+	}
+
+	return ""
+}
+
+// reply buffers the response to the client until the connection is flushed.
+// Nothing is sent back over the replication link from master, nor while
+// replaying the append-only file.
+func (s *Server) reply(response string) error {
+	if response == "" || s.fromMaster || s.replay {
+		return nil
+	}
+
+	if err := s.c.Append(response); err != nil {
+		return fmt.Errorf("Append failed: %v", err)
 	}
 
 	return nil
 }
 
-func handleExec(s *Server) error {
-	if !s.queuing {
-		if err := s.c.Write("-ERR EXEC without MULTI\r\n"); err != nil {
-			return fmt.Errorf("Write failed: %v", err)
+// call executes a validated request and returns the response.
+// Errors returned by the handler are reported to the client as RESP errors.
+// Blocking commands acquire the storage locks themselves so they can release
+// them while waiting.
+func (s *Server) call(cmd *Command, request []string) string {
+	if !cmd.isSet(flagBlocking) {
+		unlock := s.lock([]*Command{cmd}, [][]string{request})
+		defer unlock()
+	} else if !s.locked {
+		// the client mustn't wait for the replies pipelined before a blocking command
+		if err := s.c.Flush(); err != nil {
+			return ""
 		}
-	} else {
-		if len(s.queue) == 0 {
-			if s.queuing != false {
-				s.queuing = false
-			}
-
-			if err := s.c.Write("*0\r\n"); err != nil {
-				return fmt.Errorf("Write failed: %v", err)
-			}
-		} else {
-			s.queuing = false
-			responses := []string{}
+	}
 
-			for _, request := range s.queue {
-				response, err := s.processRequest(request)
-				if err != nil {
-					return fmt.Errorf("processRequest failed: %v", err)
-				}
+	// the write locks of the keys are held
+	if cmd.isSet(flagWrite) && !cmd.isSet(flagBlocking) {
+		s.storage.expire(cmd.keys(request))
+	}
 
-				if response == "" {
-					continue
-				}
+	response, err := cmd.handler(s, request[1:])
+	rewritten := s.rewritten
+	s.rewritten = nil
 
-				responses = append(responses, response)
-			}
+	if err != nil {
+		fmt.Printf("%s failed: %v\n", strings.ToUpper(cmd.name), err)
+		return ToSimpleError(fmt.Sprintf("ERR %v", err))
+	}
 
-			s.queue = [][]string{}
+	if cmd.isSet(flagWrite) && !strings.HasPrefix(response, "-") {
+		persistence.dirty.Add(1)
 
-			respArr := fmt.Sprintf("*%d\r\n", len(responses))
-			for _, s := range responses {
-				respArr += s
-			}
+		if rewritten != nil {
+			request = rewritten
+		}
+		s.ops = append(s.ops, op{db: s.db, request: request})
 
-			s.c.Write(respArr)
+		// EXEC propagates the commands of the transaction together
+		if !s.locked {
+			s.propagate()
 		}
 	}
 
-	return nil
+	return response
 }
 
-func handleDiscard(s *Server) error {
-	if s.queuing {
-		s.queuing = false
-		s.queue = [][]string{}
+// op is a write command to propagate, with the database it ran against.
+type op struct {
+	db      int
+	request []string
+}
 
-		if err := s.c.Write("+OK\r\n"); err != nil {
-			return fmt.Errorf("Write failed: %v", err)
-		}
-	} else {
-		if err := s.c.Write("-ERR DISCARD without MULTI\r\n"); err != nil {
-			return fmt.Errorf("Write failed: %v", err)
-		}
+// propagate appends the write commands run since the last call to the
+// append-only file and sends them to the slaves, while the locks of the keys
+// they modified are still held so they are propagated in the order they ran.
+// The commands of a transaction are wrapped in MULTI and EXEC to be applied
+// atomically, unless there is a single one.
+func (s *Server) propagate() {
+	ops := s.ops
+	s.ops = nil
+
+	if len(ops) == 0 {
+		return
 	}
 
-	return nil
+	if len(ops) > 1 {
+		ops = slices.Concat(
+			[]op{{db: ops[0].db, request: []string{"MULTI"}}},
+			ops,
+			[]op{{db: ops[len(ops)-1].db, request: []string{"EXEC"}}},
+		)
+	}
+
+	aof.Feed(ops...)
+
+	if s.mc != nil && !link.isSlave() {
+		s.mc.slaves.PropagateCommands(ops)
+	}
 }
 
-var (
-	waitLock = sync.Mutex{}
-)
+// lock acquires the storage locks needed to run the given requests together.
+// A transaction may SELECT other databases on the way, so the locks of every
+// database it reaches are acquired, in the order of their indexes.
+func (s *Server) lock(cmds []*Command, requests [][]string) func() {
+	if s.locked {
+		return func() {}
+	}
 
-func (s *Server) processRequest(request []string) (string, error) {
-	var response string
-	var err error
+	type dbLock struct {
+		keys       []string
+		write, all bool
+	}
 
-	switch strings.ToUpper(request[0]) {
-	case "PING":
-		response, err = handlePing(s)
-		if err != nil {
-			return "", fmt.Errorf("PING failed: %v", err)
-		}
-	case "ECHO":
-		if len(request) != 2 {
-			return "", fmt.Errorf("ECHO expects 1 argument")
-		}
-		response = handleEcho(request[1])
-	case "SET":
-		response, err = handleSet(s, request[1:])
-		if err != nil {
-			return "", fmt.Errorf("SET failed: %v", err)
-		}
+	locks := make(map[int]*dbLock)
+	db := s.db
 
-		if s.opts.Role == "master" {
-			err := handlePropagation(s, request)
-			if err != nil {
-				return "", fmt.Errorf("Propagation failed: %v", err)
+	for i, cmd := range cmds {
+		if cmd.isSet(flagAllDBs) {
+			for idx := range databases {
+				if _, ok := locks[idx]; !ok {
+					locks[idx] = &dbLock{}
+				}
+				locks[idx].all = true
 			}
+			continue
 		}
-	case "GET":
-		if len(request) != 2 {
-			return "", fmt.Errorf("GET expects 1 argument")
-		}
-		response, err = handleGet(s, request[1])
-		if err != nil {
-			return "", fmt.Errorf("GET failed: %v", err)
-		}
-	case "INFO":
-		if len(request) != 2 {
-			return "", fmt.Errorf("INFO expects 1 argument")
-		}
-		response, err = handleInfo(request[1], s)
-		if err != nil {
-			return "", fmt.Errorf("INFO failed: %v", err)
-		}
-	case "REPLCONF":
-		response, err = handleReplconf(s, request[1:])
-		if err != nil {
-			return "", fmt.Errorf("REPLCONF failed: %v", err)
+
+		if cmd.name == "select" {
+			if idx, err := dbIndex(requests[i][1]); err == nil {
+				db = idx
+			}
+			continue
 		}
-	case "PSYNC":
-		response, err = handlePsync(request[1:], s)
-		if err != nil {
-			return "", fmt.Errorf("PSYNC failed: %v", err)
+
+		keys := cmd.keys(requests[i])
+		if len(keys) == 0 && !cmd.isSet(flagKeyspace) {
+			continue
 		}
 
-		s.mc.slaves.AddSlave(s.c.conn.RemoteAddr(), s.c)
-	case "WAIT":
-		waitLock.Lock()
-		response, err = handleWait(request[1:], s)
-		waitLock.Unlock()
-		if err != nil {
-			return "", fmt.Errorf("WAIT failed: %v", err)
+		l, ok := locks[db]
+		if !ok {
+			l = &dbLock{}
+			locks[db] = l
 		}
-	case "CONFIG":
-		if request[1] == "GET" {
-			response, err = handleConfigGet(request[2:], s)
-			if err != nil {
-				return "", fmt.Errorf("CONFIG GET failed: %v", err)
-			}
+
+		l.keys = append(l.keys, keys...)
+		l.write = l.write || cmd.isSet(flagWrite)
+		l.all = l.all || cmd.isSet(flagKeyspace)
+	}
+
+	indexes := make([]int, 0, len(locks))
+	for idx := range locks {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+
+	unlocks := make([]func(), 0, len(indexes))
+	for _, idx := range indexes {
+		l := locks[idx]
+		if l.all {
+			unlocks = append(unlocks, databases[idx].LockAll(l.write))
 		} else {
-			return "", fmt.Errorf("Invalid CONFIG command: %s", request[1])
+			unlocks = append(unlocks, databases[idx].Lock(l.keys, l.write))
 		}
-	case "KEYS":
-		if request[1] == "*" {
-			response, err = handleKeys(s)
-			if err != nil {
-				return "", fmt.Errorf("KEYS failed: %v", err)
-			}
+	}
+
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
 		}
-	case "TYPE":
-		response, err = handleType(request[1:], s)
-		if err != nil {
-			return "", fmt.Errorf("TYPE failed: %v", err)
+	}
+}
+
+// lockKeys acquires the storage locks of the given keys unless EXEC already holds them.
+func (s *Server) lockKeys(keys []string, write bool) func() {
+	if s.locked {
+		return func() {}
+	}
+
+	return s.storage.Lock(keys, write)
+}
+
+// lockAll acquires every storage lock unless EXEC already holds them.
+func (s *Server) lockAll(write bool) func() {
+	if s.locked {
+		return func() {}
+	}
+
+	return s.storage.LockAll(write)
+}
+
+func handleMulti(s *Server, args []string) (string, error) {
+	if s.queuing {
+		return ToSimpleError("ERR MULTI calls can not be nested"), nil
+	}
+
+	s.queuing = true
+
+	return "+OK\r\n", nil
+}
+
+func handleExec(s *Server, args []string) (string, error) {
+	if !s.queuing {
+		return ToSimpleError("ERR EXEC without MULTI"), nil
+	}
+
+	queue, failed := s.queue, s.queueFailed
+	s.queuing = false
+	s.queueFailed = false
+	s.queue = [][]string{}
+
+	if failed {
+		return ToSimpleError("EXECABORT Transaction discarded because of previous errors."), nil
+	}
+
+	cmds := make([]*Command, len(queue))
+	for i, request := range queue {
+		cmds[i], _ = lookupCommand(request)
+
+		// the server may have become a slave, or lost its master, since the command was queued
+		if msg := s.replicaError(cmds[i]); msg != "" {
+			return "-EXECABORT Transaction discarded because of: " + strings.TrimPrefix(msg, "-"), nil
 		}
-	case "XADD":
-		response, err = handleXadd(request[1:], s)
+	}
+
+	unlock := s.lock(cmds, queue)
+	s.locked = true
+	defer func() {
+		s.locked = false
+		unlock()
+	}()
+
+	respArr := s.w.AppendArray(nil, len(queue))
+	for i, request := range queue {
+		respArr = append(respArr, s.call(cmds[i], request)...)
+	}
+
+	s.propagate()
+
+	return string(respArr), nil
+}
+
+func handleDiscard(s *Server, args []string) (string, error) {
+	if !s.queuing {
+		return ToSimpleError("ERR DISCARD without MULTI"), nil
+	}
+
+	s.queuing = false
+	s.queueFailed = false
+	s.queue = [][]string{}
+
+	return "+OK\r\n", nil
+}
+
+var (
+	waitLock = sync.Mutex{}
+)
+
+func handlePing(s *Server, args []string) (string, error) {
+	if len(args) > 1 {
+		return ToSimpleError("ERR wrong number of arguments for 'ping' command"), nil
+	}
+
+	if len(args) == 1 {
+		return s.w.Bulk(args[0]), nil
+	}
+
+	return "+PONG\r\n", nil
+}
+
+func handleEcho(s *Server, args []string) (string, error) {
+	return s.w.Bulk(args[0]), nil
+}
+
+func handleSelect(s *Server, args []string) (string, error) {
+	idx, err := dbIndex(args[0])
+	if err != nil {
+		return ToSimpleError(err.Error()), nil
+	}
+
+	s.db = idx
+	s.storage = databases[idx]
+
+	return "+OK\r\n", nil
+}
+
+// dbIndex parses the index of a database given to SELECT.
+func dbIndex(arg string) (int, error) {
+	idx, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, errors.New("ERR value is not an integer or out of range")
+	}
+
+	if idx < 0 || idx >= len(databases) {
+		return 0, errors.New("ERR DB index is out of range")
+	}
+
+	return idx, nil
+}
+
+// handleHello switches the protocol version of the connection and replies
+// with the server properties. Only the default user exists, without password.
+func handleHello(s *Server, args []string) (string, error) {
+	proto := s.w.Proto()
+	name := s.name
+
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
 		if err != nil {
-			return "", fmt.Errorf("XADD failed: %v", err)
+			return ToSimpleError("ERR Protocol version is not an integer or out of range"), nil
 		}
-	case "XRANGE":
-		response, err = handleXrange(request[1:], s)
-		if err != nil {
-			return "", fmt.Errorf("XRANGE failed: %v", err)
+
+		if v < 2 || v > 3 {
+			return ToSimpleError("NOPROTO unsupported protocol version"), nil
 		}
-	case "XREAD":
-		if request[1] == "streams" {
-			response, err = handleXread(-1, request[2:], s)
-			if err != nil {
-				return "", fmt.Errorf("XREAD failed: %v", err)
-			}
-		} else if request[1] == "block" {
-			timeout, err := strconv.Atoi(request[2])
-			if err != nil {
-				return "", fmt.Errorf("Atoi failed: %v", err)
-			}
+		proto = v
 
-			if request[3] != "streams" {
-				return "", fmt.Errorf("XREAD block %d be followed by \"streams\", found: %s", timeout, request[1])
-			}
+		for i := 1; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "AUTH":
+				if i+2 >= len(args) {
+					return ToSimpleError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i])), nil
+				}
 
-			response, err = handleXread(timeout, request[4:], s)
-			if err != nil {
-				return "", fmt.Errorf("XREAD failed: %v", err)
+				if args[i+1] != "default" {
+					return ToSimpleError("WRONGPASS invalid username-password pair or user is disabled."), nil
+				}
+				i += 2
+			case "SETNAME":
+				if i+1 >= len(args) {
+					return ToSimpleError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i])), nil
+				}
+
+				if !validClientName(args[i+1]) {
+					return ToSimpleError("ERR Client names cannot contain spaces, newlines or special characters."), nil
+				}
+				name = args[i+1]
+				i++
+			default:
+				return ToSimpleError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i])), nil
 			}
-		} else {
-			return "", fmt.Errorf("XREAD must be followed by \"streams\", found: %s", request[1])
-		}
-	case "INCR":
-		response, err = handleIncr(request[1], s)
-		if err != nil {
-			return "", fmt.Errorf("INCR failed: %v", err)
 		}
-	default:
-		return "", fmt.Errorf("unknown command: %s", request[0])
 	}
 
-	return response, nil
-}
+	s.w.proto = proto
+	s.name = name
 
-func handlePing(s *Server) (string, error) {
-	if s.opts.Role == "master" {
-		return "+PONG\r\n", nil
+	role := "master"
+	if link.isSlave() {
+		role = "replica"
 	}
 
-	return "", fmt.Errorf("temp: %s", "temp")
+	ret := s.w.Map(7)
+	ret += s.w.Bulk("server") + s.w.Bulk("redis")
+	ret += s.w.Bulk("version") + s.w.Bulk("7.2.0")
+	ret += s.w.Bulk("proto") + s.w.Integer(proto)
+	ret += s.w.Bulk("id") + s.w.Integer(int(s.id))
+	ret += s.w.Bulk("mode") + s.w.Bulk("standalone")
+	ret += s.w.Bulk("role") + s.w.Bulk(role)
+	ret += s.w.Bulk("modules") + s.w.Array(0)
+
+	return ret, nil
 }
 
-func handleEcho(message string) string {
-	return fmt.Sprintf("$%d\r\n%s\r\n", len(message), message)
+// validClientName reports whether name only holds printable characters without spaces.
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+
+	return true
 }
 
-func handleSet(s *Server, request []string) (string, error) {
-	key := request[0]
-	value := request[1]
+func handleSet(s *Server, args []string) (string, error) {
+	key := args[0]
+	value := args[1]
 
 	var expireAt int64
-	if len(request) == 4 {
-		expireAfter, err := strconv.ParseInt(request[3], 10, 64)
+	for i := 2; i < len(args); i++ {
+		unit := strings.ToUpper(args[i])
+		if (unit != "EX" && unit != "PX" && unit != "EXAT" && unit != "PXAT") || i+1 >= len(args) || expireAt != 0 {
+			return ToSimpleError("ERR syntax error"), nil
+		}
+
+		i++
+		t, err := strconv.ParseInt(args[i], 10, 64)
 		if err != nil {
-			return "", fmt.Errorf("Atoi failed: %v", err)
+			return ToSimpleError("ERR value is not an integer or out of range"), nil
+		}
+
+		if t <= 0 {
+			return ToSimpleError("ERR invalid expire time in 'set' command"), nil
+		}
+
+		switch unit {
+		case "EX":
+			expireAt = time.Now().UnixMilli() + t*1000
+		case "PX":
+			expireAt = time.Now().UnixMilli() + t
+		case "EXAT":
+			expireAt = t * 1000
+		case "PXAT":
+			expireAt = t
 		}
-		expireAt = time.Now().UnixMilli() + expireAfter
 	}
 
 	s.storage.Set(key, value, expireAt)
 
-	if s.opts.Role == "master" {
-		return "+OK\r\n", nil
+	// relative expiry times would be counted again from the time they are applied
+	if expireAt != 0 {
+		s.rewritten = []string{"SET", key, value, "PXAT", strconv.FormatInt(expireAt, 10)}
 	}
 
-	return "", nil
+	return "+OK\r\n", nil
 }
 
-func handleGet(s *Server, key string) (string, error) {
-	value := s.storage.Get(key)
-	if value == nil {
-		return "$-1\r\n", nil
+func handleGet(s *Server, args []string) (string, error) {
+	value, ok, err := s.storage.Get(args[0])
+	if err != nil {
+		return ToSimpleError(err.Error()), nil
+	}
+
+	if !ok {
+		return s.w.Null(), nil
 	}
 
-	return fmt.Sprintf("$%d\r\n%s\r\n", len(*value), *value), nil
+	return s.w.Bulk(value), nil
 }
 
-func handleInfo(arg string, s *Server) (string, error) {
-	var ret string
+func handleInfo(s *Server, args []string) (string, error) {
+	section := "default"
+	if len(args) > 0 {
+		section = strings.ToLower(args[0])
+	}
+	all := section == "default" || section == "all" || section == "everything"
+
+	var sections []string
+
+	if all || section == "persistence" {
+		sections = append(sections, persistence.info())
+	}
 
-	if arg == "replication" {
-		ret += "# Replication\r\n"
-		if s.opts.Role == "slave" {
+	if all || section == "replication" {
+		ret := "# Replication\r\n"
+		if link.isSlave() {
 			ret += "role:slave\r\n"
+			ret += link.info(time.Now())
 		} else {
 			ret += "role:master\r\n"
 		}
 
-		ret += fmt.Sprintf("master_replid:%s\r\n", s.opts.ReplID)
+		ret += list.info()
 
-		ret += fmt.Sprintf("master_repl_offset:%d\r\n", s.mc.propOffset)
-	} else {
-		return "", fmt.Errorf("temp: %s", "temp")
+		sections = append(sections, ret)
 	}
 
-	return fmt.Sprintf("$%d\r\n%s\r\n", len(ret), ret), nil
+	return s.w.Verbatim("txt", strings.Join(sections, "\r\n")), nil
 }
 
-func handleReplconf(s *Server, request []string) (string, error) {
-	switch request[0] {
+func handleReplconf(s *Server, args []string) (string, error) {
+	if len(args) == 0 {
+		return "+OK\r\n", nil
+	}
+
+	switch strings.ToUpper(args[0]) {
 	case "ACK":
 		// This logic is ran by master
-		ack, err := strconv.Atoi(request[1])
+		if len(args) != 2 || s.mc == nil {
+			return "", nil
+		}
+
+		ack, err := strconv.Atoi(args[1])
 		if err != nil {
 			return "", fmt.Errorf("strconf.Atoi failed: %v", err)
 		}
@@ -410,17 +695,16 @@ func handleReplconf(s *Server, request []string) (string, error) {
 		if err := s.mc.slaves.Ack(s.c.conn.RemoteAddr(), ack); err != nil {
 			return "", fmt.Errorf("ack slave response filed: %w", err)
 		}
-
-		if s.mc.wg != nil {
-			s.mc.wg.Done()
-		}
 	case "GETACK":
 		// This logic is ran by slave
 		curr := s.c.offset
 		ret := fmt.Sprintf("*3\r\n$8\r\nREPLCONF\r\n$3\r\nACK\r\n$%d\r\n%d\r\n", len(strconv.Itoa(curr)), curr)
 		s.c.offset += 37
 
-		return ret, nil
+		// the acknowledgement is the only reply a slave sends to its master
+		if err := s.c.Write(ret); err != nil {
+			return "", fmt.Errorf("Write failed: %v", err)
+		}
 	default:
 		return "+OK\r\n", nil
 	}
@@ -428,127 +712,296 @@ func handleReplconf(s *Server, request []string) (string, error) {
 	return "", nil
 }
 
-func handlePsync(request []string, server *Server) (string, error) {
-	var ret string
+// handleReplicaof makes the server a slave of the given master, its dataset
+// being replaced on synchronization, or promotes it to master with NO ONE.
+func handleReplicaof(s *Server, args []string) (string, error) {
+	if strings.EqualFold(args[0], "no") && strings.EqualFold(args[1], "one") {
+		if link.isSlave() {
+			link.stop()
+			list.Promote()
+			fmt.Println("Promoted to master")
+		}
 
-	emptyRDB, err := base64.StdEncoding.DecodeString("UkVESVMwMDEx+glyZWRpcy12ZXIFNy4yLjD6CnJlZGlzLWJpdHPAQPoFY3RpbWXCbQi8ZfoIdXNlZC1tZW3CsMQQAPoIYW9mLWJhc2XAAP/wbjv+wP9aog==")
-	if err != nil {
-		return "", fmt.Errorf("DecodeString failed: %v", err)
+		return "+OK\r\n", nil
 	}
 
-	if request[0] == "?" {
-		ret += fmt.Sprintf("+FULLRESYNC %s 0\r\n", server.opts.ReplID)
+	if port, err := strconv.Atoi(args[1]); err != nil || port < 0 || port > 65535 {
+		return ToSimpleError("ERR Invalid master port"), nil
+	}
 
+	if link.replicating(args[0], args[1]) {
+		return "+OK Already connected to specified master\r\n", nil
 	}
 
-	ret += fmt.Sprintf("$%d\r\n%s", len(string(emptyRDB)), string(emptyRDB))
+	link.stop()
+	link.start(s.opts, args[0], args[1])
 
-	server.mc.slaves.AddSlave(server.c.conn.RemoteAddr(), server.c)
+	// PSYNC is refused from now on: the slaves attached before, even by a
+	// PSYNC holding the locks meanwhile, don't receive the stream of the new master
+	unlock := lockDatabases(databases, true)
+	list.Demote()
+	unlock()
 
-	return ret, nil
+	fmt.Printf("Replicating master %s\n", net.JoinHostPort(args[0], args[1]))
+
+	return "+OK\r\n", nil
+}
+
+// handlePsync resumes the replication of a slave from the backlog if it
+// holds every command the slave missed, or starts a full resynchronization:
+// the slave receives a snapshot of the dataset, then the commands propagated
+// since it was taken. PSYNC holds the locks of every database so no write
+// slips between the two.
+func handlePsync(server *Server, args []string) (string, error) {
+	addr := server.c.conn.RemoteAddr()
+
+	// the stream of master isn't passed on to the slaves of a slave
+	if link.isSlave() {
+		return ToSimpleError("ERR PSYNC isn't supported by a replica, replicate its master instead"), nil
+	}
+
+	// a slave asks for the offset following the last byte it received
+	if offset, err := strconv.Atoi(args[1]); err == nil && args[0] != "?" {
+		if server.mc.slaves.PartialSync(addr, server.c, args[0], offset-1) {
+			fmt.Printf("Partial resynchronization with %s accepted from offset %d\n", addr, offset)
+			return "", nil
+		}
+	}
+
+	snap := persistence.snapshot(databases, server.opts)
+	offset := server.mc.slaves.AddSlave(addr, server.c)
+	fullresync := fmt.Sprintf("+FULLRESYNC %s %d\r\n", server.mc.slaves.ReplID(), offset)
+
+	// the slave is written to without holding the locks, a slow one holding back no client
+	go func() {
+		if err := server.c.Write(fullresync); err != nil {
+			fmt.Printf("Full resynchronization with %s failed: Write failed: %v\n", addr, err)
+			server.mc.slaves.RemoveSlave(addr, server.c)
+			server.c.Close()
+			return
+		}
+
+		if err := sendSnapshot(server.c, snap); err != nil {
+			fmt.Printf("Full resynchronization with %s failed: %v\n", addr, err)
+			server.mc.slaves.RemoveSlave(addr, server.c)
+			server.c.Close()
+			return
+		}
+
+		if err := server.mc.slaves.SlaveOnline(addr); err != nil {
+			fmt.Printf("SlaveOnline failed: %v\n", err)
+		}
+	}()
+
+	return "", nil
 }
 
-func handlePropagation(master *Server, request []string) error {
-	propCmd := ToRespArray(request)
-	if err := master.mc.slaves.Propagate(propCmd); err != nil {
-		return fmt.Errorf("cannot propagate: %w", err)
+// sendSnapshot writes the snapshot as the RDB payload of a full
+// resynchronization: a bulk string without trailing CRLF.
+func sendSnapshot(c *Connection, snap *Snapshot) error {
+	var buf bytes.Buffer
+	if err := snap.write(&buf); err != nil {
+		return fmt.Errorf("write failed: %v", err)
+	}
+
+	if err := c.Write(fmt.Sprintf("$%d\r\n%s", buf.Len(), buf.String())); err != nil {
+		return fmt.Errorf("Write failed: %v", err)
 	}
-	master.mc.propOffset += len(propCmd)
 
 	return nil
 }
 
-func handleWait(request []string, master *Server) (string, error) {
-	numReplicas, err := strconv.Atoi(request[0])
+func handleWait(master *Server, args []string) (string, error) {
+	numReplicas, err := strconv.Atoi(args[0])
 	if err != nil {
-		return "", fmt.Errorf("Atoi failed: %v", err)
+		return ToSimpleError("ERR value is not an integer or out of range"), nil
 	}
 
-	t, err := strconv.Atoi(request[1])
+	t, err := strconv.Atoi(args[1])
 	if err != nil {
-		return "", fmt.Errorf("Atoi failed: %v", err)
+		return ToSimpleError("ERR timeout is not an integer or out of range"), nil
 	}
 
-	notAcked := master.mc.slaves.NotSyncedSlaveCount(master.mc.propOffset)
+	// the writes made on a slave aren't propagated, nor acknowledged
+	if link.isSlave() {
+		return ToSimpleError("ERR WAIT cannot be used with replica instances"), nil
+	}
 
-	if notAcked == 0 {
-		return fmt.Sprintf(":%d\r\n", master.mc.slaves.Count()), nil
+	waitLock.Lock()
+	defer waitLock.Unlock()
 
+	target := master.mc.slaves.Offset()
+
+	acked := master.mc.slaves.SyncedSlaveCount(target)
+	if acked >= numReplicas {
+		return master.w.Integer(acked), nil
 	}
 
-	if err := master.mc.slaves.Propagate("*3\r\n$8\r\nREPLCONF\r\n$6\r\nGETACK\r\n$1\r\n*\r\n"); err != nil {
-		return "", fmt.Errorf("Propagate failed: %v", err)
+	master.mc.slaves.Propagate("*3\r\n$8\r\nREPLCONF\r\n$6\r\nGETACK\r\n$1\r\n*\r\n")
+
+	var timeout <-chan time.Time
+	if t > 0 {
+		timeout = time.After(time.Duration(t) * time.Millisecond)
 	}
 
-	master.mc.wg = &sync.WaitGroup{}
-	master.mc.wg.Add(min(numReplicas, master.mc.slaves.Count()))
+	for acked < numReplicas {
+		notify := master.mc.slaves.AckNotify()
 
-	ch := make(chan struct{})
-	go func() {
-		defer close(ch)
-		master.mc.wg.Wait()
-	}()
+		acked = master.mc.slaves.SyncedSlaveCount(target)
+		if acked >= numReplicas {
+			break
+		}
 
-	select {
-	case <-ch:
-	case <-time.After(time.Duration(t) * time.Millisecond):
+		select {
+		case <-notify:
+		case <-timeout:
+			return master.w.Integer(master.mc.slaves.SyncedSlaveCount(target)), nil
+		}
 	}
 
-	notAcked = master.mc.slaves.NotSyncedSlaveCount(master.mc.propOffset)
+	return master.w.Integer(acked), nil
+}
 
-	fmt.Printf("master.offset = %d, not acked = %d\n", master.mc.propOffset, notAcked)
+func handleConfig(s *Server, args []string) (string, error) {
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		if len(args) != 2 {
+			return ToSimpleError("ERR wrong number of arguments for 'config|get' command"), nil
+		}
 
-	master.mc.propOffset += 37
+		return handleConfigGet(s, args[1:])
+	case "SET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return ToSimpleError("ERR wrong number of arguments for 'config|set' command"), nil
+		}
 
-	return fmt.Sprintf(":%d\r\n", master.mc.slaves.Count()-notAcked), nil
+		return handleConfigSet(s, args[1:])
+	default:
+		return ToSimpleError(fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", args[0])), nil
+	}
 }
 
-func handleConfigGet(request []string, s *Server) (string, error) {
-	switch request[0] {
+func handleConfigGet(s *Server, args []string) (string, error) {
+	switch strings.ToLower(args[0]) {
 	case "dir":
-		return fmt.Sprintf("*2\r\n$3\r\ndir\r\n$%d\r\n%s\r\n", len(s.opts.Dir), s.opts.Dir), nil
+		return s.w.Map(1) + s.w.Bulk("dir") + s.w.Bulk(s.opts.Dir), nil
 	case "dbfilename":
-		return fmt.Sprintf("*2\r\n$3\r\ndbfilename\r\n$%d\r\n%s\r\n", len(s.opts.Dbfilename), s.opts.Dbfilename), nil
+		return s.w.Map(1) + s.w.Bulk("dbfilename") + s.w.Bulk(s.opts.Dbfilename), nil
+	case "save":
+		return s.w.Map(1) + s.w.Bulk("save") + s.w.Bulk(formatSavePoints(persistence.SavePoints())), nil
 	default:
-		return "", fmt.Errorf("Invalid config get param: %v", request[0])
+		return s.w.Map(0), nil
 	}
 }
 
-func handleKeys(s *Server) (string, error) {
-	var keys []string
-	for k := range s.storage.cache {
-		fmt.Printf("Found key: %s\n", k)
-		keys = append(keys, k)
+// handleConfigSet sets parameters given as name and value pairs.
+// Every value is validated before any parameter is changed.
+func handleConfigSet(s *Server, args []string) (string, error) {
+	var savePoints []SavePoint
+
+	for i := 0; i < len(args); i += 2 {
+		switch strings.ToLower(args[i]) {
+		case "save":
+			points, err := parseSavePoints(args[i+1])
+			if err != nil {
+				return ToSimpleError(fmt.Sprintf("ERR Invalid argument '%s' for CONFIG SET 'save' - Invalid save parameters", args[i+1])), nil
+			}
+			savePoints = points
+		default:
+			return ToSimpleError(fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[i])), nil
+		}
 	}
 
-	return ToRespArray(keys), nil
+	if savePoints != nil {
+		persistence.SetSavePoints(savePoints)
+	}
+
+	return "+OK\r\n", nil
 }
 
-func handleType(request []string, s *Server) (string, error) {
-	if len(request) > 1 {
-		return "", fmt.Errorf("Invalid key in type command: %s", request)
+func handleSave(s *Server, args []string) (string, error) {
+	err := persistence.Save(s.opts, persistence.snapshot(databases, s.opts))
+	if errors.Is(err, ErrSaveInProgress) {
+		return ToSimpleError(err.Error()), nil
+	}
+	if err != nil {
+		return "", err
 	}
 
-	fmt.Println(request[0])
+	return "+OK\r\n", nil
+}
 
-	_, ok := s.storage.GetStream(request[0])
-	if ok {
-		return "+stream\r\n", nil
+func handleBgsave(s *Server, args []string) (string, error) {
+	err := persistence.BackgroundSave(s.opts, persistence.snapshot(databases, s.opts))
+	if err != nil {
+		return ToSimpleError(err.Error()), nil
+	}
+
+	return s.w.SimpleString("Background saving started"), nil
+}
+
+func handleBgrewriteaof(s *Server, args []string) (string, error) {
+	err := aof.BackgroundRewrite(s.opts, persistence.snapshot(databases, s.opts))
+	if errors.Is(err, ErrRewriteInProgress) {
+		return ToSimpleError(err.Error()), nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return s.w.SimpleString("Background append only file rewriting started"), nil
+}
+
+func handleLastsave(s *Server, args []string) (string, error) {
+	return s.w.Integer(int(persistence.LastSave())), nil
+}
+
+// handleShutdown saves the databases if save points are configured, unless
+// told otherwise, and exits. The server keeps running if saving fails.
+func handleShutdown(s *Server, args []string) (string, error) {
+	save := len(persistence.SavePoints()) > 0
+	for _, arg := range args {
+		switch strings.ToUpper(arg) {
+		case "NOSAVE":
+			save = false
+		case "SAVE":
+			save = true
+		default:
+			return ToSimpleError("ERR syntax error"), nil
+		}
+	}
+
+	var snap *Snapshot
+	if save {
+		snap = persistence.snapshot(databases, s.opts)
 	}
 
-	value := s.storage.Get(request[0])
-	if value != nil {
-		return "+string\r\n", nil
+	if err := persistence.Shutdown(s.opts, snap); err != nil {
+		fmt.Printf("Shutdown failed: %v\n", err)
+		return ToSimpleError("ERR Errors trying to SHUTDOWN. Check logs."), nil
 	}
 
-	return "+none\r\n", nil
+	os.Exit(0)
+
+	return "", nil
+}
+
+func handleKeys(s *Server, args []string) (string, error) {
+	return s.w.StringArray(s.storage.Keys(args[0])), nil
 }
 
-func handleXadd(request []string, s *Server) (string, error) {
-	stream, ok := s.storage.GetStream(request[0])
+func handleType(s *Server, args []string) (string, error) {
+	return s.w.SimpleString(s.storage.Type(args[0])), nil
+}
+
+func handleXadd(s *Server, request []string) (string, error) {
+	stream, ok, err := s.storage.GetStream(request[0])
+	if err != nil {
+		return ToSimpleError(err.Error()), nil
+	}
+
 	if !ok {
-		s.storage.AddStream(request[0])
-		stream, _ = s.storage.GetStream(request[0])
+		stream = NewStream()
 	}
 
 	id := request[1]
@@ -582,23 +1035,36 @@ func handleXadd(request []string, s *Server) (string, error) {
 		return msg, nil
 	}
 
+	if len(request[2:])%2 != 0 {
+		return ToSimpleError("ERR wrong number of arguments for 'xadd' command"), nil
+	}
+
 	entry, err := NewStreamEntry(id, request[2:])
 	if err != nil {
 		return "", fmt.Errorf("NewStreamEntry failed: %v", err)
 	}
 
 	stream.entries = append(stream.entries, entry)
+	stream.lastID = id
+	stream.entriesAdded++
 
-	if s.mc.wg != nil {
-		s.mc.wg.Done()
+	if !ok {
+		s.storage.SetValue(request[0], stream, 0)
+	}
+
+	s.storage.signal(request[0])
+
+	// the ID generated is propagated so the entry gets the same one everywhere
+	if id != request[1] {
+		s.rewritten = slices.Concat([]string{"XADD", request[0], id}, request[2:])
 	}
 
-	return ToBulkString(id), nil
+	return s.w.Bulk(id), nil
 }
 
-func handleXrange(request []string, s *Server) (string, error) {
+func handleXrange(s *Server, request []string) (string, error) {
 	if len(request) != 3 {
-		return "", fmt.Errorf("invalid XRANGE request: %s", request)
+		return ToSimpleError("ERR syntax error"), nil
 	}
 
 	key := request[0]
@@ -608,9 +1074,13 @@ func handleXrange(request []string, s *Server) (string, error) {
 	var endIdx int
 	foundEnd := false
 
-	stream, ok := s.storage.GetStream(key)
+	stream, ok, err := s.storage.GetStream(key)
+	if err != nil {
+		return ToSimpleError(err.Error()), nil
+	}
+
 	if !ok {
-		return "", fmt.Errorf("Stream with key doesn't exist: %v", stream)
+		return s.w.Array(0), nil
 	}
 
 	entries := stream.entries
@@ -717,69 +1187,125 @@ func handleXrange(request []string, s *Server) (string, error) {
 		}
 	}
 
-	entries = entries[startIdx:endIdx]
+	return string(appendStreamEntries(s.w, nil, entries[startIdx:endIdx])), nil
+}
 
-	resp := fmt.Sprintf("*%d\r\n", len(entries))
-	for _, entry := range entries {
-		resp += fmt.Sprintf("*2\r\n")
-		resp += ToBulkString(entry.id)
-		resp += fmt.Sprintf("*%d\r\n", len(entry.kvpairs)*2)
-		for k, v := range entry.kvpairs {
-			resp += ToBulkString(k)
-			resp += ToBulkString(v)
+func handleXread(s *Server, args []string) (string, error) {
+	timeout := -1
+	count := 0
+
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "BLOCK":
+			if i+1 >= len(args) {
+				return ToSimpleError("ERR syntax error"), nil
+			}
+
+			t, err := strconv.Atoi(args[i+1])
+			if err != nil || t < 0 {
+				return ToSimpleError("ERR timeout is not an integer or out of range"), nil
+			}
+
+			timeout = t
+			i++
+		case "COUNT":
+			if i+1 >= len(args) {
+				return ToSimpleError("ERR syntax error"), nil
+			}
+
+			c, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return ToSimpleError("ERR value is not an integer or out of range"), nil
+			}
+
+			count = c
+			i++
+		case "STREAMS":
+			streams := args[i+1:]
+			if len(streams) == 0 || len(streams)%2 != 0 {
+				return ToSimpleError("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified."), nil
+			}
+
+			return blockStreams(s, timeout, count, streams[:len(streams)/2], streams[len(streams)/2:])
+		default:
+			return ToSimpleError("ERR syntax error"), nil
 		}
 	}
 
-	return resp, nil
+	return ToSimpleError("ERR syntax error"), nil
 }
 
-func handleXread(timeout int, request []string, s *Server) (string, error) {
-	curr := make([]*StreamEntry, len(s.storage.streams[request[0]].entries))
-	copy(curr, s.storage.streams[request[0]].entries)
-
+// blockStreams reads the given streams, waiting up to timeout milliseconds
+// (forever if 0) for new entries when there are none yet.
+// A negative timeout or a call from EXEC never blocks.
+func blockStreams(s *Server, timeout int, count int, keys []string, ids []string) (string, error) {
+	var deadline <-chan time.Time
 	if timeout > 0 {
-		time.Sleep(time.Duration(timeout) * time.Millisecond)
-	} else if timeout == 0 {
-		s.mc.wg = &sync.WaitGroup{}
-		s.mc.wg.Add(1)
+		deadline = time.After(time.Duration(timeout) * time.Millisecond)
+	}
 
-		ch := make(chan struct{})
-		go func() {
-			defer close(ch)
-			s.mc.wg.Wait()
-		}()
+	for {
+		unlock := s.lockKeys(keys, false)
 
-		select {
-		case <-ch:
+		for i, key := range keys {
+			stream, ok, err := s.storage.GetStream(key)
+			if err != nil {
+				unlock()
+				return ToSimpleError(err.Error()), nil
+			}
+
+			// $ stands for the last entry present when the command was called
+			if ids[i] == "$" {
+				ids[i] = "0-0"
+				if ok && len(stream.entries) > 0 {
+					ids[i] = stream.entries[len(stream.entries)-1].id
+				}
+			}
 		}
-	}
 
-	if len(request) < 2 || len(request)%2 != 0 {
-		return "", fmt.Errorf("invalid request for XREAD: %v", request)
+		response, err := readStreams(s, count, keys, ids)
+		if err != nil || response != "" || timeout < 0 || s.locked {
+			unlock()
+
+			if response == "" && err == nil {
+				return s.w.Null(), nil
+			}
+
+			return response, err
+		}
+
+		notify := s.storage.watch(keys)
+		unlock()
+
+		select {
+		case <-notify:
+			s.storage.unwatch(keys, notify)
+		case <-deadline:
+			s.storage.unwatch(keys, notify)
+			return s.w.Null(), nil
+		}
 	}
+}
 
-	responses := make([]string, 0)
+// readStreams returns the entries following the given IDs in each stream,
+// or an empty string if there's none.
+func readStreams(s *Server, count int, keys []string, ids []string) (string, error) {
+	responses := make([][]byte, 0)
 
-	for i := 0; i < (len(request))/2; i++ {
-		streamKey := request[i]
-		streamID := request[(len(request))/2+i]
+	for i, streamKey := range keys {
+		stream, ok, err := s.storage.GetStream(streamKey)
+		if err != nil {
+			return ToSimpleError(err.Error()), nil
+		}
 
-		stream, ok := s.storage.GetStream(streamKey)
 		if !ok {
 			continue
 		}
 		entries := stream.entries
 
-		if streamID == "$" {
-			if len(curr) == len(entries) {
-				return "$-1\r\n", nil
-			}
-			streamID = entries[len(entries)-1-(len(entries)-len(curr))].id
-		}
-
-		reqMilli, reqSeq, err := getTimeAndSeq(streamID)
+		reqMilli, reqSeq, err := getTimeAndSeq(ids[i])
 		if err != nil {
-			return "", fmt.Errorf("getTimeAndSeq failed: %v", err)
+			return ToSimpleError("ERR Invalid stream ID specified as stream command argument"), nil
 		}
 
 		startIdx := -1
@@ -800,52 +1326,74 @@ func handleXread(timeout int, request []string, s *Server) (string, error) {
 		}
 
 		entries = entries[startIdx:]
-		if len(entries) == 0 {
-			continue
+		if count > 0 && len(entries) > count {
+			entries = entries[:count]
 		}
 
-		resp := fmt.Sprintf("*2\r\n")
-		resp += ToBulkString(streamKey)
-		resp += fmt.Sprintf("*%d\r\n", len(entries))
-		for _, entry := range entries {
-			resp += fmt.Sprintf("*2\r\n")
-			resp += ToBulkString(entry.id)
-			resp += fmt.Sprintf("*%d\r\n", len(entry.kvpairs)*2)
-			for k, v := range entry.kvpairs {
-				resp += ToBulkString(k)
-				resp += ToBulkString(v)
-			}
+		// RESP3 replies with a map of streams, RESP2 with an array of pairs
+		var resp []byte
+		if !s.w.resp3() {
+			resp = s.w.AppendArray(resp, 2)
 		}
+		resp = s.w.AppendBulk(resp, streamKey)
+		resp = appendStreamEntries(s.w, resp, entries)
 
 		responses = append(responses, resp)
 	}
 
 	if len(responses) == 0 {
-		return "$-1\r\n", nil
+		return "", nil
+	}
+
+	var finalResponse []byte
+	if s.w.resp3() {
+		finalResponse = s.w.AppendMap(finalResponse, len(responses))
+	} else {
+		finalResponse = s.w.AppendArray(finalResponse, len(responses))
 	}
 
-	finalResponse := fmt.Sprintf("*%d\r\n", len(responses))
 	for _, streamResponse := range responses {
-		finalResponse += streamResponse
+		finalResponse = append(finalResponse, streamResponse...)
 	}
 
-	return finalResponse, nil
+	return string(finalResponse), nil
 }
 
-func handleIncr(key string, s *Server) (string, error) {
-	if value := s.storage.Get(key); value != nil {
-		val, err := strconv.Atoi(*value)
+func handleIncr(s *Server, args []string) (string, error) {
+	key := args[0]
+
+	value, ok, err := s.storage.Get(key)
+	if err != nil {
+		return ToSimpleError(err.Error()), nil
+	}
+
+	if ok {
+		val, err := strconv.Atoi(value)
 		if err != nil {
-			return "-ERR value is not an integer or out of range\r\n", nil
+			return ToSimpleError("ERR value is not an integer or out of range"), nil
 		}
 
-		incremented := strconv.Itoa(val + 1)
+		s.storage.Update(key, String(strconv.Itoa(val+1)))
 
-		*value = incremented
-
-		return fmt.Sprintf(":%s\r\n", incremented), nil
+		return s.w.Integer(val + 1), nil
 	}
 	s.storage.Set(key, "1", 0)
 
-	return ":1\r\n", nil
+	return s.w.Integer(1), nil
+}
+
+// appendStreamEntries appends stream entries as an array of ID and field value pairs.
+func appendStreamEntries(w ReplyWriter, b []byte, entries []*StreamEntry) []byte {
+	b = w.AppendArray(b, len(entries))
+	for _, entry := range entries {
+		b = w.AppendArray(b, 2)
+		b = w.AppendBulk(b, entry.id)
+		b = w.AppendArray(b, len(entry.kvpairs)*2)
+		for k, v := range entry.kvpairs {
+			b = w.AppendBulk(b, k)
+			b = w.AppendBulk(b, v)
+		}
+	}
+
+	return b
 }
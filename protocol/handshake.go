@@ -1,122 +1,184 @@
 package protocol
 
 import (
+	"bytes"
 	"fmt"
-	"io"
 	"strconv"
+	"strings"
 )
 
-// Handshake handles the handshake process from slave
-func (s *Server) Handshake(o Opts) error {
+// Handshake handles the handshake process from slave. It reports whether
+// master sent a snapshot of the dataset.
+func (s *Server) Handshake(o Opts) (bool, error) {
 	err := sendPing(s.c)
 	if err != nil {
-		return fmt.Errorf("sendPing failed: %v", err)
+		return false, fmt.Errorf("sendPing failed: %v", err)
 	}
 
-	_, response, err := s.c.GetLine()
+	err = sendReplconf(s.c, o.PortNum)
 	if err != nil {
-		return fmt.Errorf("conn.GetLine() failed: %v", err)
+		return false, fmt.Errorf("sendReplconf failed: %v", err)
 	}
 
-	if response != "+PONG" {
-		return fmt.Errorf("Didn't receive \"PONG\": %s", response)
+	replID, offset := list.Replication()
+	newID, offset, full, err := sendPsync(s.c, replID, offset)
+	if err != nil {
+		return false, fmt.Errorf("sendPsync failed: %v", err)
 	}
 
-	err = sendReplconf(s.c, o.PortNum)
-	if err != nil {
-		return fmt.Errorf("sendReplconf failed: %v", err)
+	if full {
+		link.syncing(s.c)
+
+		err = readRDB(s.c, o)
+		if err != nil {
+			return false, fmt.Errorf("readRDB failed: %v", err)
+		}
+
+		list.SetReplication(newID, offset)
+	} else if newID != replID {
+		// master was promoted from a slave of the same history
+		list.ChangeReplID(newID, offset)
 	}
 
-	err = sendPsync(s.c)
+	// the commands streamed next follow the offset of the dataset
+	s.c.offset = offset
+	s.applied = offset
+
+	return full, nil
+}
+
+// readSimpleString reads a reply from master and returns the simple string it holds.
+func readSimpleString(c *Connection) (string, error) {
+	reply, err := c.reader.ReadValue()
 	if err != nil {
-		return fmt.Errorf("sendPsync failed: %v", err)
+		return "", fmt.Errorf("ReadValue failed: %v", err)
 	}
 
-	err = readRDB(s.c)
-	if err != nil {
-		return fmt.Errorf("readRDB failed: %v", err)
+	if reply.Kind != RespSimpleString {
+		return "", fmt.Errorf("Expected simple string, got %c%s", reply.Kind, reply.Str)
 	}
 
-	return nil
+	return reply.Str, nil
 }
 
 func sendPing(c *Connection) error {
-	err := c.Write("*1\r\n$4\r\nPING\r\n")
+	err := c.Write(ToRespArray([]string{"PING"}))
 	if err != nil {
 		return fmt.Errorf("c.Write failed: %v", err)
 	}
+
+	response, err := readSimpleString(c)
+	if err != nil {
+		return err
+	}
+
+	if response != "PONG" {
+		return fmt.Errorf("Didn't receive \"PONG\": %s", response)
+	}
+
 	return nil
 }
 
 func sendReplconf(c *Connection, port string) error {
-	c.Write(fmt.Sprintf("*3\r\n$8\r\nREPLCONF\r\n$14\r\nlistening-port\r\n$%d\r\n%s\r\n", len(port), port))
-	_, ok, err := c.GetLine()
+	err := c.Write(ToRespArray([]string{"REPLCONF", "listening-port", port}))
+	if err != nil {
+		return fmt.Errorf("c.Write failed: %v", err)
+	}
+
+	ok, err := readSimpleString(c)
 	if err != nil {
-		return fmt.Errorf("conn.GetLine failed: %v", err)
+		return err
 	}
 
-	if ok != "+OK" {
+	if ok != "OK" {
 		return fmt.Errorf("Didn't recieve \"OK\": %s", ok)
 	}
 
-	err = c.Write("*3\r\n$8\r\nREPLCONF\r\n$4\r\ncapa\r\n$6\r\npsync2\r\n")
+	err = c.Write(ToRespArray([]string{"REPLCONF", "capa", "psync2"}))
 	if err != nil {
 		return fmt.Errorf("c.Write failed: %v", err)
 	}
 
-	_, ok, err = c.GetLine()
+	ok, err = readSimpleString(c)
 	if err != nil {
-		return fmt.Errorf("conn.GetLine failed: %v", err)
+		return err
 	}
 
-	if ok != "+OK" {
+	if ok != "OK" {
 		return fmt.Errorf("Didn't recieve \"OK\": %s", ok)
 	}
 
 	return nil
 }
 
-func sendPsync(c *Connection) error {
-	err := c.Write("*3\r\n$5\r\nPSYNC\r\n$1\r\n?\r\n$2\r\n-1\r\n")
-	if err != nil {
-		return fmt.Errorf("c.Write failed: %v", err)
+// sendPsync asks master to resume the replication after the given offset of
+// the given history, or for a full resynchronization if there is no ID. It
+// returns the replication ID and offset master continues from, and whether
+// a snapshot follows.
+func sendPsync(c *Connection, replID string, offset int) (string, int, bool, error) {
+	request := []string{"PSYNC", "?", "-1"}
+	if replID != "" {
+		request = []string{"PSYNC", replID, strconv.Itoa(offset + 1)}
 	}
 
-	_, full, err := c.GetLine()
+	err := c.Write(ToRespArray(request))
 	if err != nil {
-		return fmt.Errorf("conn.GetLine failed: %v", err)
+		return "", 0, false, fmt.Errorf("c.Write failed: %v", err)
 	}
 
-	if full[:11] != "+FULLRESYNC" {
-		return fmt.Errorf("Didn't recieve \"+FULLRESYNC\": %s", full)
+	reply, err := readSimpleString(c)
+	if err != nil {
+		return "", 0, false, err
 	}
 
-	return nil
+	args := strings.Fields(reply)
+	switch {
+	case len(args) == 3 && args[0] == "FULLRESYNC":
+		offset, err := strconv.Atoi(args[2])
+		if err != nil {
+			return "", 0, false, fmt.Errorf("Invalid offset: %s", reply)
+		}
+
+		return args[1], offset, true, nil
+
+	case len(args) == 2 && args[0] == "CONTINUE" && replID != "":
+		return args[1], offset, false, nil
+
+	default:
+		return "", 0, false, fmt.Errorf("Didn't recieve \"+FULLRESYNC\" or \"+CONTINUE\": %s", reply)
+	}
 }
 
-func readRDB(c *Connection) error {
-	_, token, err := c.GetLine()
-	fmt.Println("Received RDB token:", token)
+// readRDB reads the snapshot sent by master and replaces the dataset with
+// it. The append-only file, if enabled, is rewritten from the new dataset.
+func readRDB(c *Connection, o Opts) error {
+	rdb, err := c.reader.ReadRDB()
 	if err != nil {
-		return fmt.Errorf("conn.GetLine failed: %v", err)
+		return fmt.Errorf("ReadRDB failed: %v", err)
 	}
 
-	if token[0] != '$' {
-		return fmt.Errorf("Expected $, got %c", token[0])
+	loaded := newDatabases(len(databases))
+	file := NewFile(bytes.NewReader(rdb))
+	if err := file.load(loaded); err != nil {
+		return fmt.Errorf("load failed: %v", err)
 	}
 
-	rdbLen, err := strconv.Atoi(token[1:])
-	fmt.Println("RDB length: ", rdbLen)
-	if err != nil {
-		return fmt.Errorf("Atoi failed: %v", err)
+	unlock := lockDatabases(databases, true)
+	defer unlock()
+
+	for i, db := range databases {
+		db.replace(loaded[i])
 	}
 
-	temp := make([]byte, rdbLen)
-	rdbContent, err := io.ReadFull(c.reader, temp)
-	if err != nil {
-		return fmt.Errorf("ReadFull() failed: %v", err)
+	fmt.Printf("Loaded the %d bytes snapshot from master\n", len(rdb))
+
+	if o.AppendOnly == "yes" {
+		// a rewrite still running would write the dataset replaced
+		aof.waitRewrite()
+		if err := aof.BackgroundRewrite(o, persistence.snapshot(databases, o)); err != nil {
+			return fmt.Errorf("BackgroundRewrite failed: %v", err)
+		}
 	}
-	fmt.Println("Read RDB content length:", rdbContent)
 
 	return nil
 }
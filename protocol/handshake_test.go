@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func Test_readRDB(t *testing.T) {
+	defer func(dbs []*Storage) { databases = dbs }(databases)
+
+	master := newDatabases(2)
+	master[0].Set("foo", "bar", 0)
+	master[1].SetValue("list", NewList("a", "b"), 0)
+
+	replica := newDatabases(2)
+	replica[0].Set("stale", "key", 0)
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	databases = master
+	s := NewMaster(NewConnection(server), Opts{Role: "master", ReplID: "replid"}, NewMasterConfig())
+	go s.Handle()
+	defer list.RemoveSlave(server.RemoteAddr(), s.c)
+
+	c := NewConnection(client)
+	_, offset, _, err := sendPsync(c, "", 0)
+	if err != nil {
+		t.Fatalf("sendPsync() error = %v", err)
+	}
+	if offset != list.Offset() {
+		t.Errorf("sendPsync() offset = %d, want %d", offset, list.Offset())
+	}
+
+	// written after the snapshot, whether it is sent yet or not
+	set := ToRespArray([]string{"SET", "after", "snapshot"})
+	go list.Propagate(set)
+
+	databases = replica
+	if err := readRDB(c, Opts{}); err != nil {
+		t.Fatalf("readRDB() error = %v", err)
+	}
+
+	for i, want := range [][]string{{"foo"}, {"list"}} {
+		got := databases[i].Keys("*")
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("readRDB() keys of DB %d = %v, want %v", i, got, want)
+		}
+	}
+
+	_, request, err := c.reader.ReadCommand()
+	if err != nil {
+		t.Fatalf("ReadCommand() error = %v", err)
+	}
+	if got := ToRespArray(request); got != set {
+		t.Errorf("command after the snapshot = %q, want %q", got, set)
+	}
+}
@@ -0,0 +1,259 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// types of the files listed in the AOF manifest
+const (
+	aofTypeBase    = "b"
+	aofTypeHistory = "h"
+	aofTypeIncr    = "i"
+)
+
+// AOFInfo represents a file listed in the AOF manifest.
+type AOFInfo struct {
+	name string
+	seq  int64
+	kind string
+}
+
+// Manifest lists the files the append-only log is made of: a base file
+// holding the dataset as of the last rewrite, then the incremental files
+// holding the write commands run since, in order. History files are left
+// over by rewrites and deleted once the new manifest is written.
+type Manifest struct {
+	base    *AOFInfo
+	incrs   []*AOFInfo
+	history []*AOFInfo
+
+	// sequences of the last base and incremental files ever created
+	baseSeq int64
+	incrSeq int64
+}
+
+// aofDir returns the directory holding the files of the append-only log.
+func aofDir(o Opts) string {
+	return filepath.Join(o.Dir, o.AppendDirname)
+}
+
+// manifestPath returns the path of the AOF manifest.
+func manifestPath(o Opts) string {
+	return filepath.Join(aofDir(o), o.AppendFilename+".manifest")
+}
+
+// loadManifest reads the AOF manifest, nil if there is none.
+func loadManifest(o Opts) (*Manifest, error) {
+	f, err := os.Open(manifestPath(o))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("os.Open failed: %v", err)
+	}
+	defer f.Close()
+
+	return parseManifest(f)
+}
+
+// ManifestFiles returns the paths of the files listed in the given manifest,
+// in the order they are loaded.
+func ManifestFiles(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open failed: %v", err)
+	}
+	defer f.Close()
+
+	m, err := parseManifest(f)
+	if err != nil {
+		return nil, fmt.Errorf("parseManifest failed: %v", err)
+	}
+
+	var paths []string
+	for _, info := range m.files() {
+		paths = append(paths, filepath.Join(filepath.Dir(path), info.name))
+	}
+
+	return paths, nil
+}
+
+// parseManifest parses the lines of a manifest, each describing a file as
+// "file <name> seq <seq> type <b|h|i>".
+func parseManifest(r io.Reader) (*Manifest, error) {
+	m := &Manifest{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		args := strings.Fields(line)
+		if len(args)%2 != 0 {
+			return nil, fmt.Errorf("invalid manifest line: %q", line)
+		}
+
+		fields := make(map[string]string)
+		for i := 0; i < len(args); i += 2 {
+			fields[args[i]] = args[i+1]
+		}
+
+		seq, err := strconv.ParseInt(fields["seq"], 10, 64)
+		if err != nil || seq < 1 || fields["file"] == "" {
+			return nil, fmt.Errorf("invalid manifest line: %q", line)
+		}
+
+		info := &AOFInfo{name: fields["file"], seq: seq, kind: fields["type"]}
+
+		switch info.kind {
+		case aofTypeBase:
+			if m.base != nil {
+				return nil, fmt.Errorf("more than one base file in the manifest: %q", line)
+			}
+			m.base = info
+			m.baseSeq = seq
+		case aofTypeIncr:
+			if seq <= m.incrSeq {
+				return nil, fmt.Errorf("incremental files are out of order in the manifest: %q", line)
+			}
+			m.incrs = append(m.incrs, info)
+			m.incrSeq = seq
+		case aofTypeHistory:
+			m.history = append(m.history, info)
+		default:
+			return nil, fmt.Errorf("unknown file type in the manifest: %q", line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Scan failed: %v", err)
+	}
+
+	if m.base == nil && len(m.incrs) == 0 {
+		return nil, errors.New("the manifest lists no file")
+	}
+
+	return m, nil
+}
+
+// String returns the manifest the way it is written to its file.
+func (m *Manifest) String() string {
+	var b strings.Builder
+
+	var base []*AOFInfo
+	if m.base != nil {
+		base = []*AOFInfo{m.base}
+	}
+
+	for _, info := range slices.Concat(base, m.history, m.incrs) {
+		fmt.Fprintf(&b, "file %s seq %d type %s\n", info.name, info.seq, info.kind)
+	}
+
+	return b.String()
+}
+
+// clone returns a copy of the manifest that can be modified and written
+// while the current one stays in use.
+func (m *Manifest) clone() *Manifest {
+	c := *m
+	c.incrs = slices.Clone(m.incrs)
+	c.history = slices.Clone(m.history)
+
+	return &c
+}
+
+// files returns the base file followed by the incremental files, in the
+// order they are loaded.
+func (m *Manifest) files() []*AOFInfo {
+	if m.base == nil {
+		return m.incrs
+	}
+
+	return slices.Concat([]*AOFInfo{m.base}, m.incrs)
+}
+
+// nextIncr adds a new incremental file to the manifest.
+func (m *Manifest) nextIncr(prefix string) *AOFInfo {
+	m.incrSeq++
+	info := &AOFInfo{
+		name: fmt.Sprintf("%s.%d.incr.aof", prefix, m.incrSeq),
+		seq:  m.incrSeq,
+		kind: aofTypeIncr,
+	}
+	m.incrs = append(m.incrs, info)
+
+	return info
+}
+
+// nextBase replaces the base file of the manifest by a new one. The previous
+// base file and the incremental files before the given number of last ones
+// are moved to the history.
+func (m *Manifest) nextBase(prefix string, rdb bool, keepIncrs int) *AOFInfo {
+	ext := "aof"
+	if rdb {
+		ext = "rdb"
+	}
+
+	// the infos are shared with the manifest this one was cloned from
+	toHistory := func(info *AOFInfo) {
+		m.history = append(m.history, &AOFInfo{name: info.name, seq: info.seq, kind: aofTypeHistory})
+	}
+
+	if m.base != nil {
+		toHistory(m.base)
+	}
+
+	m.baseSeq++
+	m.base = &AOFInfo{
+		name: fmt.Sprintf("%s.%d.base.%s", prefix, m.baseSeq, ext),
+		seq:  m.baseSeq,
+		kind: aofTypeBase,
+	}
+
+	old := max(len(m.incrs)-keepIncrs, 0)
+	for _, info := range m.incrs[:old] {
+		toHistory(info)
+	}
+	m.incrs = slices.Clone(m.incrs[old:])
+
+	return m.base
+}
+
+// write replaces the manifest file with a temporary file renamed once complete.
+func (m *Manifest) write(o Opts) error {
+	f, err := os.CreateTemp(aofDir(o), "temp-*.manifest")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp failed: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.WriteString(m.String()); err != nil {
+		return fmt.Errorf("WriteString failed: %v", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("Sync failed: %v", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Close failed: %v", err)
+	}
+
+	if err := os.Rename(f.Name(), manifestPath(o)); err != nil {
+		return fmt.Errorf("os.Rename failed: %v", err)
+	}
+
+	return nil
+}
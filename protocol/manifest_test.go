@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_parseManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "Test manifest",
+			input: "file appendonly.aof.2.base.rdb seq 2 type b\n" +
+				"file appendonly.aof.1.base.rdb seq 1 type h\n" +
+				"file appendonly.aof.3.incr.aof seq 3 type i\n" +
+				"file appendonly.aof.4.incr.aof seq 4 type i\n",
+			want: "file appendonly.aof.2.base.rdb seq 2 type b\n" +
+				"file appendonly.aof.1.base.rdb seq 1 type h\n" +
+				"file appendonly.aof.3.incr.aof seq 3 type i\n" +
+				"file appendonly.aof.4.incr.aof seq 4 type i\n",
+		},
+		{
+			name:  "Test fields in any order, comments and blank lines",
+			input: "# comment\n\ntype i seq 1 file appendonly.aof.1.incr.aof\n",
+			want:  "file appendonly.aof.1.incr.aof seq 1 type i\n",
+		},
+		{name: "Test empty manifest", input: "# comment\n", wantErr: true},
+		{name: "Test two base files", input: "file a seq 1 type b\nfile b seq 2 type b\n", wantErr: true},
+		{name: "Test incremental files out of order", input: "file a seq 2 type i\nfile b seq 1 type i\n", wantErr: true},
+		{name: "Test unknown type", input: "file a seq 1 type x\n", wantErr: true},
+		{name: "Test invalid seq", input: "file a seq 0 type b\n", wantErr: true},
+		{name: "Test missing value", input: "file a seq 1 type\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseManifest(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseManifest() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("parseManifest() = %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestManifest_nextBase(t *testing.T) {
+	m, err := parseManifest(strings.NewReader("file appendonly.aof.1.base.aof seq 1 type b\n" +
+		"file appendonly.aof.1.incr.aof seq 1 type i\n"))
+	if err != nil {
+		t.Fatalf("parseManifest() error = %v", err)
+	}
+
+	// a rewrite starts by switching to a new incremental file
+	started := m.clone()
+	if info := started.nextIncr("appendonly.aof"); info.name != "appendonly.aof.2.incr.aof" {
+		t.Errorf("nextIncr() = %s, want appendonly.aof.2.incr.aof", info.name)
+	}
+
+	done := started.clone()
+	if info := done.nextBase("appendonly.aof", true, 1); info.name != "appendonly.aof.2.base.rdb" {
+		t.Errorf("nextBase() = %s, want appendonly.aof.2.base.rdb", info.name)
+	}
+
+	want := "file appendonly.aof.2.base.rdb seq 2 type b\n" +
+		"file appendonly.aof.1.base.aof seq 1 type h\n" +
+		"file appendonly.aof.1.incr.aof seq 1 type h\n" +
+		"file appendonly.aof.2.incr.aof seq 2 type i\n"
+	if done.String() != want {
+		t.Errorf("nextBase() manifest = %q, want %q", done.String(), want)
+	}
+
+	// the manifests cloned from aren't modified
+	wantStarted := "file appendonly.aof.1.base.aof seq 1 type b\n" +
+		"file appendonly.aof.1.incr.aof seq 1 type i\n" +
+		"file appendonly.aof.2.incr.aof seq 2 type i\n"
+	if started.String() != wantStarted {
+		t.Errorf("nextBase() modified the cloned manifest: %q", started.String())
+	}
+}
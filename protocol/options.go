@@ -1,16 +1,37 @@
 package protocol
 
 import (
+	"fmt"
 	"math/rand"
+	"strconv"
 	"strings"
 )
 
 // Opts represents the options given by user
 type Opts struct {
-	PortNum    string `short:"p" long:"port" description:"Port Number" default:"6379"`
-	ReplicaOf  string `long:"replicaof" description:"Replica of <MASTER_HOST> <MASTER_PORT>"`
-	Dir        string `long:"dir" description:"Path to the directory where RDB file is stored"`
-	Dbfilename string `long:"dbfilename" description:"name of RDB file"`
+	PortNum                  string   `short:"p" long:"port" description:"Port Number" default:"6379"`
+	ReplicaOf                string   `long:"replicaof" description:"Replica of <MASTER_HOST> <MASTER_PORT>"`
+	Dir                      string   `long:"dir" description:"Path to the directory where RDB file is stored"`
+	Dbfilename               string   `long:"dbfilename" description:"name of RDB file" default:"dump.rdb"`
+	RDBCorrupt               string   `long:"rdb-corrupt" description:"What to do when the RDB file is corrupt" choice:"exit" choice:"keep" choice:"empty" default:"exit"`
+	Save                     []string `long:"save" description:"Save the RDB file after <seconds> if at least <changes> changes were made, \"\" disables saving" default:"3600 1" default:"300 100" default:"60 10000"`
+	AppendOnly               string   `long:"appendonly" description:"Log every write command to the append-only file" choice:"yes" choice:"no" default:"no"`
+	AppendFilename           string   `long:"appendfilename" description:"name of the append-only file" default:"appendonly.aof"`
+	AppendFsync              string   `long:"appendfsync" description:"When the append-only file is synced to disk" choice:"always" choice:"everysec" choice:"no" default:"everysec"`
+	AOFLoadTruncated         string   `long:"aof-load-truncated" description:"Load an append-only file whose last command is truncated" choice:"yes" choice:"no" default:"yes"`
+	AppendDirname            string   `long:"appenddirname" description:"name of the directory holding the append-only files" default:"appendonlydir"`
+	AOFUseRDBPreamble        string   `long:"aof-use-rdb-preamble" description:"Write the base of a rewritten append-only file in the RDB format" choice:"yes" choice:"no" default:"yes"`
+	AutoAOFRewritePercentage int      `long:"auto-aof-rewrite-percentage" description:"Rewrite the append-only file once it grew by this percentage since the last rewrite, 0 disables it" default:"100"`
+	AutoAOFRewriteMinSize    string   `long:"auto-aof-rewrite-min-size" description:"Size the append-only file must reach before it is rewritten automatically" default:"64mb"`
+	AOFTimestampEnabled      string   `long:"aof-timestamp-enabled" description:"Annotate the append-only file with the time of the write commands" choice:"yes" choice:"no" default:"yes"`
+	AOFRestoreUntil          int64    `long:"aof-restore-until" description:"Restore the dataset as of the given unix time in milliseconds from the append-only file, the previous log being kept aside"`
+	ReplBacklogSize          string   `long:"repl-backlog-size" description:"Size of the backlog of the commands propagated to the slaves, for them to resume the replication after a disconnection" default:"1mb"`
+	ReplBacklogTTL           int      `long:"repl-backlog-ttl" description:"Seconds without slaves after which the backlog is freed, 0 keeps it forever" default:"3600"`
+	ReplPingReplicaPeriod    int      `long:"repl-ping-replica-period" description:"Seconds between the PINGs sent to the slaves, for them to detect a lost link" default:"10"`
+	ReplTimeout              int      `long:"repl-timeout" description:"Seconds without data from master after which a slave drops its link and connects again" default:"60"`
+	ReplicaReadOnly          string   `long:"replica-read-only" description:"Reject the write commands of the clients of a slave" choice:"yes" choice:"no" default:"yes"`
+	ReplicaServeStaleData    string   `long:"replica-serve-stale-data" description:"Reply to the clients of a slave whose link with master is down" choice:"yes" choice:"no" default:"yes"`
+	ClientOutputBufferLimit  []string `long:"client-output-buffer-limit" description:"Disconnect the clients of <class> whose output reaches <hard> bytes, or stays past <soft> bytes for <soft seconds>, given as \"<class> <hard> <soft> <soft seconds>\"" default:"replica 256mb 64mb 60"`
 
 	Role       string
 	ReplID     string
@@ -43,3 +64,32 @@ func generateReplid() string {
 	}
 	return string(b)
 }
+
+// parseMemory parses a number of bytes followed by an optional unit.
+// As in Redis, k is 1000 bytes while kb is 1024 bytes.
+func parseMemory(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		bytes  int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1e3}, {"m", 1e6}, {"g", 1e9}, {"b", 1},
+	}
+
+	lower := strings.ToLower(s)
+	mul := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower = strings.TrimSuffix(lower, u.suffix)
+			mul = u.bytes
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory size: %q", s)
+	}
+
+	return n * mul, nil
+}
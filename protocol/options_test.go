@@ -39,3 +39,33 @@ func TestOpts_Config(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseMemory(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{name: "Test bytes", input: "100", want: 100},
+		{name: "Test bytes unit", input: "100b", want: 100},
+		{name: "Test kilobytes", input: "1k", want: 1000},
+		{name: "Test kibibytes", input: "1kb", want: 1024},
+		{name: "Test megabytes", input: "64MB", want: 64 << 20},
+		{name: "Test gigabytes", input: "2g", want: 2e9},
+		{name: "Test unknown unit", input: "1tb", wantErr: true},
+		{name: "Test negative", input: "-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMemory(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseMemory() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseMemory() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 )
@@ -44,20 +45,114 @@ func VerifyBulkStringLength(s string, length int) error {
 
 // ToRespArray recieves an array of strings and returns a RESP Array
 func ToRespArray(arr []string) string {
-	respArr := fmt.Sprintf("*%d\r\n", len(arr))
-	for _, s := range arr {
-		respArr += ToBulkString(s)
-	}
-
-	return respArr
+	return string(ReplyWriter{}.AppendStringArray(nil, arr))
 }
 
 // ToBulkString turns a regular string into a bulk string
 func ToBulkString(s string) string {
-	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+	return string(ReplyWriter{}.AppendBulk(nil, s))
 }
 
 // ToSimpleError turns a string into a RESP simple error
 func ToSimpleError(s string) string {
-	return fmt.Sprintf("-%s\r\n", s)
+	return string(ReplyWriter{}.AppendError(nil, s))
+}
+
+// SplitArgs splits an inline command into its arguments.
+// Arguments are separated by spaces and may be quoted: double quoted strings
+// support the \n, \r, \t, \b, \a, \\, \" and \xHH escapes while single
+// quoted strings only support \'.
+func SplitArgs(line string) ([]string, error) {
+	args := []string{}
+
+	for i := 0; ; {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg []byte
+		inDouble, inSingle := false, false
+
+		for done := false; !done; {
+			if i == len(line) {
+				if inDouble || inSingle {
+					return nil, errors.New("unbalanced quotes in request")
+				}
+				break
+			}
+
+			c := line[i]
+			switch {
+			case inDouble:
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]) {
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					arg = append(arg, byte(b))
+					i += 3
+				} else if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						arg = append(arg, '\n')
+					case 'r':
+						arg = append(arg, '\r')
+					case 't':
+						arg = append(arg, '\t')
+					case 'b':
+						arg = append(arg, '\b')
+					case 'a':
+						arg = append(arg, '\a')
+					default:
+						arg = append(arg, line[i])
+					}
+				} else if c == '"' {
+					// the closing quote must be followed by a space or nothing
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errors.New("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			case inSingle:
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					arg = append(arg, '\'')
+				} else if c == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errors.New("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			default:
+				switch {
+				case isSpace(c):
+					done = true
+				case c == '"':
+					inDouble = true
+				case c == '\'':
+					inSingle = true
+				default:
+					arg = append(arg, c)
+				}
+			}
+
+			i++
+		}
+
+		args = append(args, string(arg))
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
 }
@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -160,3 +161,33 @@ func TestToSimpleError(t *testing.T) {
 		})
 	}
 }
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "Test SplitArgs with spaces", line: "  SET  key\tvalue ", want: []string{"SET", "key", "value"}},
+		{name: "Test SplitArgs with empty line", line: "", want: []string{}},
+		{name: "Test SplitArgs with double quotes", line: `SET k "a b"`, want: []string{"SET", "k", "a b"}},
+		{name: "Test SplitArgs with escapes", line: `ECHO "\x41\n\"\\"`, want: []string{"ECHO", "A\n\"\\"}},
+		{name: "Test SplitArgs with single quotes", line: `ECHO 'it\'s \n'`, want: []string{"ECHO", "it's \\n"}},
+		{name: "Test SplitArgs with empty quotes", line: `ECHO ""`, want: []string{"ECHO", ""}},
+		{name: "Test SplitArgs with unterminated quotes", line: `ECHO "abc`, wantErr: true},
+		{name: "Test SplitArgs with text after closing quote", line: `ECHO "abc"def`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SplitArgs(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SplitArgs() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
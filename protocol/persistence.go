@@ -0,0 +1,353 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var persistence = NewPersistence()
+
+// ErrSaveInProgress is returned when a save is requested while a background save is running.
+var ErrSaveInProgress = errors.New("ERR Background save already in progress")
+
+// Persistence holds the state of the dataset persistence shared by every client.
+type Persistence struct {
+	// set while the RDB file is loaded at startup
+	loading atomic.Bool
+
+	// number of changes since the last successful save
+	dirty atomic.Int64
+
+	lock sync.Mutex
+	// aux fields of the RDB file loaded at startup
+	aux map[string]string
+
+	savePoints     []SavePoint
+	bgsaveDone     chan struct{} // closed once the running background save ends, nil if none runs
+	lastSave       int64         // unix time of the last successful save
+	lastBgsaveOK   bool
+	lastBgsaveTry  time.Time
+	lastBgsaveTime time.Duration // -1 if no background save ran
+	shutdown       bool
+}
+
+// SavePoint saves the databases in the background once the given number of
+// changes were made and the given time passed since the last save.
+type SavePoint struct {
+	seconds int64
+	changes int64
+}
+
+// bgsaveRetryDelay is the time to wait after a failed background save before trying again
+const bgsaveRetryDelay = 5 * time.Second
+
+// NewPersistence is the Persistence constructor
+func NewPersistence() *Persistence {
+	return &Persistence{
+		lastSave:       time.Now().Unix(),
+		lastBgsaveOK:   true,
+		lastBgsaveTime: -1,
+	}
+}
+
+// rdbPath returns the path of the RDB file given in the options.
+func rdbPath(o Opts) string {
+	return filepath.Join(o.Dir, o.Dbfilename)
+}
+
+// setAux records the aux fields of the loaded RDB file.
+func (p *Persistence) setAux(aux map[string]string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.aux = aux
+}
+
+// Aux returns the value of the given aux field of the loaded RDB file.
+func (p *Persistence) Aux(key string) (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	v, ok := p.aux[key]
+	return v, ok
+}
+
+// Loading reports whether the dataset is still being loaded.
+func (p *Persistence) Loading() bool {
+	return p.loading.Load()
+}
+
+// Save writes the snapshot to the RDB file before returning.
+func (p *Persistence) Save(o Opts, snap *Snapshot) error {
+	p.lock.Lock()
+	saving := p.bgsaveDone != nil
+	p.lock.Unlock()
+
+	if saving {
+		return ErrSaveInProgress
+	}
+
+	if err := snap.save(rdbPath(o)); err != nil {
+		return err
+	}
+
+	p.saved(snap)
+
+	return nil
+}
+
+// BackgroundSave writes the snapshot to the RDB file in the background.
+func (p *Persistence) BackgroundSave(o Opts, snap *Snapshot) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.bgsaveDone != nil {
+		return ErrSaveInProgress
+	}
+
+	done := make(chan struct{})
+	p.bgsaveDone = done
+	p.lastBgsaveTry = time.Now()
+
+	go func() {
+		start := time.Now()
+		err := snap.save(rdbPath(o))
+		if err != nil {
+			fmt.Printf("Background saving failed: %v\n", err)
+		} else {
+			p.saved(snap)
+		}
+
+		p.lock.Lock()
+		defer p.lock.Unlock()
+
+		p.bgsaveDone = nil
+		p.lastBgsaveOK = err == nil
+		p.lastBgsaveTime = time.Since(start)
+		close(done)
+	}()
+
+	return nil
+}
+
+// waitBackgroundSave waits for the running background save to end.
+func (p *Persistence) waitBackgroundSave() {
+	p.lock.Lock()
+	done := p.bgsaveDone
+	p.lock.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// ScheduleSaves applies the save points given in the options and saves the
+// databases in the background every time one of them is reached.
+func ScheduleSaves(o Opts) error {
+	points, err := parseSavePoints(strings.Join(o.Save, " "))
+	if err != nil {
+		return fmt.Errorf("parseSavePoints failed: %v", err)
+	}
+	persistence.SetSavePoints(points)
+
+	go func() {
+		for range time.Tick(100 * time.Millisecond) {
+			persistence.cron(o)
+		}
+	}()
+
+	return nil
+}
+
+// cron starts a background save if one of the save points is reached.
+func (p *Persistence) cron(o Opts) {
+	if p.Loading() || !p.saveDue(time.Now()) {
+		return
+	}
+
+	unlock := lockDatabases(databases, false)
+	snap := p.snapshot(databases, o)
+	unlock()
+
+	if err := p.BackgroundSave(o, snap); err != nil && !errors.Is(err, ErrSaveInProgress) {
+		fmt.Printf("BackgroundSave failed: %v\n", err)
+	}
+}
+
+// saveDue reports whether a save point is reached. After a failed background
+// save, the next one is delayed so a full disk isn't hammered.
+func (p *Persistence) saveDue(now time.Time) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.bgsaveDone != nil || p.shutdown {
+		return false
+	}
+
+	if !p.lastBgsaveOK && now.Sub(p.lastBgsaveTry) < bgsaveRetryDelay {
+		return false
+	}
+
+	dirty := p.dirty.Load()
+	for _, sp := range p.savePoints {
+		if dirty >= sp.changes && now.Unix()-p.lastSave >= sp.seconds {
+			fmt.Printf("%d changes in %d seconds. Saving...\n", sp.changes, sp.seconds)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Shutdown saves the databases one last time if save points are configured,
+// once the running background save ended.
+func Shutdown(o Opts) error {
+	var snap *Snapshot
+	if len(persistence.SavePoints()) > 0 {
+		unlock := lockDatabases(databases, false)
+		snap = persistence.snapshot(databases, o)
+		unlock()
+	}
+
+	return persistence.Shutdown(o, snap)
+}
+
+// Shutdown stops the automatic saves, waits for the running background save
+// and AOF rewrite, and writes the given snapshot unless it is nil. A dataset
+// still loading is never saved as it would replace the file with part of itself.
+func (p *Persistence) Shutdown(o Opts, snap *Snapshot) error {
+	p.lock.Lock()
+	p.shutdown = true
+	p.lock.Unlock()
+
+	p.waitBackgroundSave()
+	aof.waitRewrite()
+	aof.sync()
+
+	if snap == nil || p.Loading() {
+		return nil
+	}
+
+	fmt.Println("Saving the final RDB snapshot before exiting")
+
+	if err := p.Save(o, snap); err != nil {
+		// the server keeps running
+		p.lock.Lock()
+		p.shutdown = false
+		p.lock.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+// SavePoints returns the save points.
+func (p *Persistence) SavePoints() []SavePoint {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.savePoints
+}
+
+// SetSavePoints replaces the save points, none disables the automatic saves.
+func (p *Persistence) SetSavePoints(points []SavePoint) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.savePoints = points
+}
+
+// parseSavePoints parses save points given as "<seconds> <changes>" pairs.
+func parseSavePoints(s string) ([]SavePoint, error) {
+	args := strings.Fields(s)
+	if len(args)%2 != 0 {
+		return nil, fmt.Errorf("save points must be pairs of seconds and changes: %q", s)
+	}
+
+	points := make([]SavePoint, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		seconds, err := strconv.ParseInt(args[i], 10, 64)
+		if err != nil || seconds < 1 {
+			return nil, fmt.Errorf("invalid seconds: %q", args[i])
+		}
+
+		changes, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("invalid changes: %q", args[i+1])
+		}
+
+		points = append(points, SavePoint{seconds: seconds, changes: changes})
+	}
+
+	return points, nil
+}
+
+// formatSavePoints returns the save points the way CONFIG GET shows them.
+func formatSavePoints(points []SavePoint) string {
+	args := make([]string, 0, len(points)*2)
+	for _, sp := range points {
+		args = append(args, strconv.FormatInt(sp.seconds, 10), strconv.FormatInt(sp.changes, 10))
+	}
+
+	return strings.Join(args, " ")
+}
+
+// saved records the successful save of the snapshot.
+// The changes made since the snapshot was taken are still to be saved.
+func (p *Persistence) saved(snap *Snapshot) {
+	p.dirty.Add(-snap.dirty)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.lastSave = time.Now().Unix()
+}
+
+// LastSave returns the unix time of the last successful save.
+func (p *Persistence) LastSave() int64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.lastSave
+}
+
+// info returns the persistence section of the INFO command.
+func (p *Persistence) info() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	status := "ok"
+	if !p.lastBgsaveOK {
+		status = "err"
+	}
+
+	bgsaveTime := int64(-1)
+	if p.lastBgsaveTime >= 0 {
+		bgsaveTime = int64(p.lastBgsaveTime.Seconds())
+	}
+
+	return fmt.Sprintf("# Persistence\r\n"+
+		"loading:%d\r\n"+
+		"rdb_changes_since_last_save:%d\r\n"+
+		"rdb_bgsave_in_progress:%d\r\n"+
+		"rdb_last_save_time:%d\r\n"+
+		"rdb_last_bgsave_status:%s\r\n"+
+		"rdb_last_bgsave_time_sec:%d\r\n",
+		boolInt(p.Loading()), p.dirty.Load(), boolInt(p.bgsaveDone != nil), p.lastSave, status, bgsaveTime) +
+		aof.info()
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_parseSavePoints(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []SavePoint
+		wantErr bool
+	}{
+		{name: "Test save points", input: "3600 1 300 100", want: []SavePoint{{3600, 1}, {300, 100}}},
+		{name: "Test no save points", input: "", want: []SavePoint{}},
+		{name: "Test odd number of arguments", input: "3600 1 300", wantErr: true},
+		{name: "Test invalid seconds", input: "0 1", wantErr: true},
+		{name: "Test invalid changes", input: "60 x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSavePoints(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseSavePoints() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSavePoints() = %v, want %v", got, tt.want)
+			}
+			if !tt.wantErr && formatSavePoints(got) != tt.input {
+				t.Errorf("formatSavePoints() = %q, want %q", formatSavePoints(got), tt.input)
+			}
+		})
+	}
+}
+
+func TestPersistence_saveDue(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name         string
+		dirty        int64
+		sinceSave    time.Duration
+		lastBgsaveOK bool
+		sinceBgsave  time.Duration
+		want         bool
+	}{
+		{name: "Test not enough changes", dirty: 9, sinceSave: 30 * time.Minute, lastBgsaveOK: true, want: false},
+		{name: "Test not enough time", dirty: 100, sinceSave: 30 * time.Second, lastBgsaveOK: true, want: false},
+		{name: "Test first save point", dirty: 10, sinceSave: time.Minute, lastBgsaveOK: true, want: true},
+		{name: "Test second save point", dirty: 1, sinceSave: time.Hour, lastBgsaveOK: true, want: true},
+		{name: "Test retry after failure too soon", dirty: 10, sinceSave: time.Hour, sinceBgsave: time.Second, want: false},
+		{name: "Test retry after failure", dirty: 10, sinceSave: time.Hour, sinceBgsave: 10 * time.Second, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPersistence()
+			p.SetSavePoints([]SavePoint{{60, 10}, {3600, 1}})
+			p.dirty.Store(tt.dirty)
+			p.lastSave = now.Add(-tt.sinceSave).Unix()
+			p.lastBgsaveOK = tt.lastBgsaveOK
+			p.lastBgsaveTry = now.Add(-tt.sinceBgsave)
+
+			if got := p.saveDue(now); got != tt.want {
+				t.Errorf("saveDue() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
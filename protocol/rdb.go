@@ -3,12 +3,30 @@ package protocol
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"math"
 	"os"
+	"strconv"
 	"time"
+
+	lzf "github.com/zhuyie/golzf"
 )
 
+// rdbVersion is the latest version of the RDB format that can be loaded
+const rdbVersion = 12
+
+// rdbSaveVersion is the version of the RDB files written, the one of Redis 7.2
+const rdbSaveVersion = 11
+
 const (
+	opSlotInfo     byte = 244
+	opFunction2    byte = 245
+	opModuleAux    byte = 247
+	opIdle         byte = 248
+	opFreq         byte = 249
 	opAux          byte = 250
 	opResizeDB     byte = 251
 	opExpireTimeMS byte = 252
@@ -17,64 +35,183 @@ const (
 	opEOF          byte = 255
 )
 
+// value types
+const (
+	rdbTypeString           byte = 0
+	rdbTypeList             byte = 1
+	rdbTypeSet              byte = 2
+	rdbTypeZSet             byte = 3
+	rdbTypeHash             byte = 4
+	rdbTypeZSet2            byte = 5
+	rdbTypeModule           byte = 6
+	rdbTypeModule2          byte = 7
+	rdbTypeHashZipmap       byte = 9
+	rdbTypeListZiplist      byte = 10
+	rdbTypeSetIntset        byte = 11
+	rdbTypeZSetZiplist      byte = 12
+	rdbTypeHashZiplist      byte = 13
+	rdbTypeListQuicklist    byte = 14
+	rdbTypeStreamListpacks  byte = 15
+	rdbTypeHashListpack     byte = 16
+	rdbTypeZSetListpack     byte = 17
+	rdbTypeListQuicklist2   byte = 18
+	rdbTypeStreamListpacks2 byte = 19
+	rdbTypeSetListpack      byte = 20
+	rdbTypeStreamListpacks3 byte = 21
+)
+
+// opcodes of the data saved by modules
+const (
+	moduleOpEOF    = 0
+	moduleOpSInt   = 1
+	moduleOpUInt   = 2
+	moduleOpFloat  = 3
+	moduleOpDouble = 4
+	moduleOpString = 5
+)
+
+// quicklist node containers
+const (
+	quicklistPlain  = 1
+	quicklistPacked = 2
+)
+
+// flags of the entries of stream listpacks
+const (
+	streamItemDeleted    = 1
+	streamItemSameFields = 2
+)
+
+// length encodings starting with 0b10
+const (
+	lenEnc32Bit byte = 0x80
+	lenEnc64Bit byte = 0x81
+)
+
+// special string encodings starting with 0b11
+const (
+	strEncInt8  = 0
+	strEncInt16 = 1
+	strEncInt32 = 2
+	strEncLZF   = 3
+)
+
 // File represents an RDB file
 type File struct {
-	file   *os.File
-	reader *bufio.Reader
+	reader *checksumReader
+
+	version int
+	aux     map[string]string
+
+	// set to load the keys that already expired, for inspection
+	keepExpired bool
 }
 
 // NewFile creates a new File instance
-func NewFile(f *os.File) *File {
+func NewFile(r io.Reader) *File {
 	return &File{
-		file:   f,
-		reader: bufio.NewReader(f),
+		reader: &checksumReader{reader: bufio.NewReader(r)},
+		aux:    make(map[string]string),
+	}
+}
+
+// checksumReader computes the CRC64 of every byte read from the file.
+type checksumReader struct {
+	reader *bufio.Reader
+	crc    uint64
+}
+
+func (r *checksumReader) ReadByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err != nil {
+		return 0, err
 	}
+
+	buf := [1]byte{b}
+	r.crc = crc64Update(r.crc, buf[:])
+
+	return b, nil
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.crc = crc64Update(r.crc, p[:n])
+
+	return n, err
 }
 
-// processRDB handles the KEYS command
-func (s *Server) processRDB() error {
-	path := fmt.Sprintf("%s/%s", s.opts.Dir, s.opts.Dbfilename)
+// LoadRDB loads the RDB file given in the options into the databases in the background.
+// Clients are answered with LOADING errors until the returned channel receives the outcome.
+func LoadRDB(o Opts) <-chan error {
+	persistence.loading.Store(true)
+
+	done := make(chan error, 1)
+	go func() {
+		aux, err := loadRDB(o, databases)
+		persistence.setAux(aux)
+		persistence.loading.Store(false)
+		done <- err
+	}()
+
+	return done
+}
+
+// loadRDB loads the RDB file into the given databases and returns its aux fields.
+// A missing file is an empty dataset. A corrupt file is an error unless
+// RDBCorrupt says to keep the keys read before the corruption or to start empty.
+func loadRDB(o Opts, dbs []*Storage) (map[string]string, error) {
+	if o.Dbfilename == "" {
+		return nil, nil
+	}
+
+	path := rdbPath(o)
 	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
 	if err != nil {
-		return fmt.Errorf("os.Open failed: %v", err)
+		return nil, fmt.Errorf("os.Open failed: %v", err)
 	}
 	defer f.Close()
+
+	// keys are loaded aside so a corrupt file can be discarded as a whole
+	loaded := newDatabases(len(dbs))
 	file := NewFile(f)
 
-	err = s.addKVPair(file)
+	err = file.load(loaded)
 	if err != nil {
-		return fmt.Errorf("addKVPair failed: %v", err)
+		switch o.RDBCorrupt {
+		case "keep":
+			fmt.Printf("%s is corrupt, keeping the keys loaded so far: %v\n", path, err)
+		case "empty":
+			fmt.Printf("%s is corrupt, starting with an empty dataset: %v\n", path, err)
+			return file.aux, nil
+		default:
+			return file.aux, fmt.Errorf("%s is corrupt: %v", path, err)
+		}
 	}
 
-	return nil
-}
-
-// addKVPair parses key-value pairs from the RDB file
-func (s *Server) addKVPair(file *File) error {
-	dbSelected := false
-	for !dbSelected {
-		b, err := file.reader.ReadByte()
-		if err != nil {
-			return fmt.Errorf("ReadByte failed: %v", err)
-		}
+	for i, db := range dbs {
+		unlock := db.LockAll(true)
+		db.merge(loaded[i])
+		unlock()
+	}
 
-		if b == opSelectDB {
-			dbSelected = true
-			lengthByte, err := file.reader.ReadByte()
-			if err != nil {
-				return fmt.Errorf("ReadByte failed for DB index length: %v", err)
-			}
+	fmt.Printf("Loaded %s (RDB version %d, redis-ver %q)\n", path, file.version, file.aux["redis-ver"])
 
-			dbIndex, err := file.parseLength(lengthByte)
-			if err != nil {
-				return fmt.Errorf("parseLength failed for DB index: %v", err)
-			}
+	return file.aux, nil
+}
 
-			fmt.Printf("Selected DB: %d\n", dbIndex)
-		}
+// load parses the header, the databases and the checksum of the RDB file
+// and adds the keys to the given databases.
+func (file *File) load(dbs []*Storage) error {
+	if err := file.readHeader(); err != nil {
+		return fmt.Errorf("readHeader failed: %v", err)
 	}
 
+	db := dbs[0]
 	var expiry int64 = 0
+
 	for {
 		b, err := file.reader.ReadByte()
 		if err != nil {
@@ -87,93 +224,186 @@ func (s *Server) addKVPair(file *File) error {
 			if err != nil {
 				return fmt.Errorf("readExpireTime failed: %v", err)
 			}
-			fmt.Println("Encountered opExpireTime")
 
 		case opExpireTimeMS:
 			expiry, err = file.readExpireTimeMS()
 			if err != nil {
 				return fmt.Errorf("readExpireTimeMS failed: %v", err)
 			}
-			fmt.Println("Encountered opExpireTimeMS")
 
-		case opResizeDB:
-			fmt.Println("Encountered opResizeDB")
-			b, err = file.reader.ReadByte()
+		case opSelectDB:
+			idx, err := file.readLength()
 			if err != nil {
-				return fmt.Errorf("ReadByte failed: %v", err)
+				return fmt.Errorf("readLength failed for DB index: %v", err)
 			}
 
-			dbHashTableSize, err := file.parseLength(b)
-			if err != nil {
-				return fmt.Errorf("parseLength failed for dbHashTableSize: %v", err)
+			if idx >= len(dbs) {
+				return fmt.Errorf("DB index %d is out of range", idx)
 			}
-			fmt.Printf("dbHashTableSize: %d\n", dbHashTableSize)
+			db = dbs[idx]
 
-			b, err = file.reader.ReadByte()
+		case opResizeDB:
+			// the sizes of the keys and expires hash tables are only hints
+			for i := 0; i < 2; i++ {
+				if _, err := file.readLength(); err != nil {
+					return fmt.Errorf("readLength failed for DB size: %v", err)
+				}
+			}
+
+		case opSlotInfo:
+			// slot id, slot size and expires slot size, only written by cluster nodes
+			for i := 0; i < 3; i++ {
+				if _, err := file.readLength(); err != nil {
+					return fmt.Errorf("readLength failed for slot info: %v", err)
+				}
+			}
+
+		case opAux:
+			key, err := file.readString()
 			if err != nil {
-				return fmt.Errorf("ReadByte failed: %v", err)
+				return fmt.Errorf("readString failed for aux key: %v", err)
 			}
 
-			expireHashTableSize, err := file.parseLength(b)
+			value, err := file.readString()
 			if err != nil {
-				return fmt.Errorf("parseLength failed for expireHashTableSize: %v", err)
+				return fmt.Errorf("readString failed for aux %s: %v", key, err)
 			}
-			fmt.Printf("expireHashTableSize: %d\n", expireHashTableSize)
 
-		case opAux:
-			fmt.Println("Encountered opAux")
-			continue
+			file.aux[key] = value
 
-		case opEOF:
-			fmt.Println("Encountered opEOF")
-			return nil
+		case opIdle:
+			// LRU idle time of the next key
+			if _, err := file.readLength(); err != nil {
+				return fmt.Errorf("readLength failed for idle time: %v", err)
+			}
 
-		default:
-			fmt.Printf("Parsing key-value pair, starting with byte: %08b\n", b)
+		case opFreq:
+			// LFU counter of the next key
+			if _, err := file.reader.ReadByte(); err != nil {
+				return fmt.Errorf("ReadByte failed for frequency: %v", err)
+			}
 
-			key, err := file.parseString(b)
-			if err != nil {
-				return fmt.Errorf("file.parseString failed for key: %v", err)
+		case opFunction2:
+			// the code of a function library, functions aren't supported
+			if _, err := file.readString(); err != nil {
+				return fmt.Errorf("readString failed for function: %v", err)
 			}
 
-			if key == "" {
-				fmt.Println("Encountered an empty key, skipping")
-				continue
+		case opModuleAux:
+			if err := file.skipModuleAux(); err != nil {
+				return fmt.Errorf("skipModuleAux failed: %v", err)
 			}
 
-			fmt.Printf("Parsed key: %s\n", key)
+		case opEOF:
+			return file.verifyChecksum()
 
-			b, err = file.reader.ReadByte()
+		default:
+			// any other byte is the type of the value following the key
+			key, err := file.readString()
 			if err != nil {
-				return fmt.Errorf("ReadByte failed: %v", err)
+				return fmt.Errorf("readString failed for key: %v", err)
 			}
 
-			value, err := file.parseString(b)
+			value, err := file.readValue(b)
 			if err != nil {
-				return fmt.Errorf("file.parseString failed for value: %v", err)
+				return fmt.Errorf("readValue failed for key %s: %v", key, err)
 			}
 
-			// Check if the key is expired
-			if expiry > 0 && expiry < time.Now().Unix()*1000 {
-				fmt.Printf("Key %s has expired, skipping\n", key)
+			// expired keys are dropped as soon as they are loaded
+			if expiry > 0 && expiry < time.Now().UnixMilli() && !file.keepExpired {
 				expiry = 0
 				continue
 			}
 
-			fmt.Printf("Parsed value: %s\n", value)
-			fmt.Printf("Adding kv pair with expiry: %s, %s, %d\n", key, value, expiry)
-			s.storage.Set(key, value, expiry)
+			db.SetValue(key, value, expiry)
 			expiry = 0
 		}
 	}
 }
 
+// readHeader reads the magic string and the version of the file.
+func (file *File) readHeader() error {
+	header, err := file.readFull(9)
+	if err != nil {
+		return err
+	}
+
+	if string(header[:5]) != "REDIS" {
+		return fmt.Errorf("invalid magic string %q", header[:5])
+	}
+
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > rdbVersion {
+		return fmt.Errorf("unsupported RDB version %q", header[5:])
+	}
+	file.version = version
+
+	return nil
+}
+
+// verifyChecksum compares the CRC64 ending the file with the one of the bytes read.
+// Files written before version 5 have no checksum, and a zero checksum means
+// it was disabled when the file was written.
+func (file *File) verifyChecksum() error {
+	if file.version < 5 {
+		return nil
+	}
+
+	computed := file.reader.crc
+
+	buf, err := file.readFull(8)
+	if err != nil {
+		return fmt.Errorf("readFull failed for checksum: %v", err)
+	}
+
+	expected := binary.LittleEndian.Uint64(buf)
+	if expected != 0 && expected != computed {
+		return fmt.Errorf("checksum mismatch: expected %016x, computed %016x", expected, computed)
+	}
+
+	return nil
+}
+
+// skipModuleAux skips the aux data of a module. Modules aren't supported
+// but their data is self-describing so the rest of the file can be loaded.
+func (file *File) skipModuleAux() error {
+	// module id, followed by when the data is loaded as a tagged value
+	if _, err := file.readLength64(); err != nil {
+		return fmt.Errorf("readLength64 failed for module id: %v", err)
+	}
+
+	for {
+		opcode, err := file.readLength()
+		if err != nil {
+			return fmt.Errorf("readLength failed for module opcode: %v", err)
+		}
+
+		switch opcode {
+		case moduleOpEOF:
+			return nil
+		case moduleOpSInt, moduleOpUInt:
+			_, err = file.readLength64()
+		case moduleOpFloat:
+			_, err = file.readFull(4)
+		case moduleOpDouble:
+			_, err = file.readFull(8)
+		case moduleOpString:
+			_, err = file.readString()
+		default:
+			return fmt.Errorf("unknown module opcode %d", opcode)
+		}
+
+		if err != nil {
+			return fmt.Errorf("module value failed: %v", err)
+		}
+	}
+}
+
 // readExpireTime reads an expiry time in seconds
 func (file *File) readExpireTime() (int64, error) {
-	buf := make([]byte, 4)
-	_, err := file.reader.Read(buf)
+	buf, err := file.readFull(4)
 	if err != nil {
-		return 0, fmt.Errorf("Read failed: %v", err)
+		return 0, err
 	}
 	expiry := int64(binary.LittleEndian.Uint32(buf)) * 1000 // Convert to milliseconds
 	return expiry, nil
@@ -181,111 +411,786 @@ func (file *File) readExpireTime() (int64, error) {
 
 // readExpireTimeMS reads an expiry time in milliseconds
 func (file *File) readExpireTimeMS() (int64, error) {
-	buf := make([]byte, 8)
-	_, err := file.reader.Read(buf)
+	buf, err := file.readFull(8)
 	if err != nil {
-		return 0, fmt.Errorf("Read failed: %v", err)
+		return 0, err
 	}
 	expiry := int64(binary.LittleEndian.Uint64(buf))
 	return expiry, nil
 }
 
-// parseLength parses the length of the next object in the stream
+// readFull reads exactly n bytes
+func (file *File) readFull(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(file.reader, buf); err != nil {
+		return nil, fmt.Errorf("ReadFull failed: %v", err)
+	}
+
+	return buf, nil
+}
+
+// parseLength parses the length of the next object in the stream.
+// The special string encodings (0b11) are handled by parseString.
 func (file *File) parseLength(b byte) (int, error) {
-	fmt.Printf("Parsing length from byte: %08b\n", b)
-	msb := uint8(b >> 6)
-	switch msb {
+	length, err := file.parseLength64(b)
+	if err != nil {
+		return 0, err
+	}
+
+	if length > math.MaxInt64 {
+		return 0, fmt.Errorf("length too big: %d", length)
+	}
+
+	return int(length), nil
+}
+
+// parseLength64 parses a length as the unsigned 64 bits integer it is stored as,
+// which is also used for values that aren't lengths.
+func (file *File) parseLength64(b byte) (uint64, error) {
+	switch b >> 6 {
 	case 0b00:
-		length := int(b & 0b00111111)
-		fmt.Printf("Parsed length (00): %d\n", length)
-		return length, nil
+		return uint64(b & 0b00111111), nil
 
 	case 0b01:
 		nextByte, err := file.reader.ReadByte()
 		if err != nil {
 			return 0, fmt.Errorf("ReadByte failed: %v", err)
 		}
-		length := (int(b&0b00111111) << 8) | int(nextByte)
-		fmt.Printf("Parsed length (01): %d\n", length)
-		return length, nil
+		return (uint64(b&0b00111111) << 8) | uint64(nextByte), nil
 
 	case 0b10:
-		next4bytes := make([]byte, 4)
-		_, err := file.reader.Read(next4bytes)
+		switch b {
+		case lenEnc32Bit:
+			buf, err := file.readFull(4)
+			if err != nil {
+				return 0, err
+			}
+			return uint64(binary.BigEndian.Uint32(buf)), nil
+		case lenEnc64Bit:
+			buf, err := file.readFull(8)
+			if err != nil {
+				return 0, err
+			}
+			return binary.BigEndian.Uint64(buf), nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid length encoding: %08b", b)
+}
+
+// parseString parses a string from the RDB file, either raw with its length,
+// an integer stored in 1, 2 or 4 bytes, or LZF compressed.
+func (file *File) parseString(b byte) (string, error) {
+	if b>>6 == 0b11 {
+		switch b & 0b00111111 {
+		case strEncInt8:
+			v, err := file.reader.ReadByte()
+			if err != nil {
+				return "", fmt.Errorf("ReadByte failed: %v", err)
+			}
+			return strconv.Itoa(int(int8(v))), nil
+		case strEncInt16:
+			buf, err := file.readFull(2)
+			if err != nil {
+				return "", err
+			}
+			return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf)))), nil
+		case strEncInt32:
+			buf, err := file.readFull(4)
+			if err != nil {
+				return "", err
+			}
+			return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf)))), nil
+		case strEncLZF:
+			return file.parseLZFString()
+		default:
+			return "", fmt.Errorf("invalid special encoding: %d", b&0b00111111)
+		}
+	}
+
+	length, err := file.parseLength(b)
+	if err != nil {
+		return "", fmt.Errorf("parseLength failed: %v", err)
+	}
+
+	if length > maxBulkLength {
+		return "", fmt.Errorf("string too long: %d", length)
+	}
+
+	str, err := file.readFull(length)
+	if err != nil {
+		return "", err
+	}
+
+	return string(str), nil
+}
+
+// parseLZFString reads the compressed and uncompressed lengths followed by the compressed data.
+func (file *File) parseLZFString() (string, error) {
+	lengths := make([]int, 2)
+	for i := range lengths {
+		b, err := file.reader.ReadByte()
 		if err != nil {
-			return 0, fmt.Errorf("Read failed: %v", err)
+			return "", fmt.Errorf("ReadByte failed: %v", err)
 		}
 
-		length := int(binary.BigEndian.Uint32(next4bytes))
-		fmt.Printf("Parsed length (10, 32 bits): %d\n", length)
-		return length, nil
+		lengths[i], err = file.parseLength(b)
+		if err != nil {
+			return "", fmt.Errorf("parseLength failed: %v", err)
+		}
+	}
 
-	case 0b11:
-		lastSixBits := uint64(b & 0b00111111)
+	for _, length := range lengths {
+		if length < 0 || length > maxBulkLength {
+			return "", fmt.Errorf("invalid string length: %d", length)
+		}
+	}
+
+	compressed, err := file.readFull(lengths[0])
+	if err != nil {
+		return "", err
+	}
+
+	str := make([]byte, lengths[1])
+	n, err := lzf.Decompress(compressed, str)
+	if err != nil {
+		return "", fmt.Errorf("lzf.Decompress failed: %v", err)
+	}
+	if n != len(str) {
+		return "", fmt.Errorf("uncompressed length mismatch: expected %d, got %d", len(str), n)
+	}
+
+	return string(str), nil
+}
+
+// readLength reads a length
+func (file *File) readLength() (int, error) {
+	b, err := file.reader.ReadByte()
+	if err != nil {
+		return 0, fmt.Errorf("ReadByte failed: %v", err)
+	}
+
+	return file.parseLength(b)
+}
+
+// readLength64 reads a length as an unsigned 64 bits integer
+func (file *File) readLength64() (uint64, error) {
+	b, err := file.reader.ReadByte()
+	if err != nil {
+		return 0, fmt.Errorf("ReadByte failed: %v", err)
+	}
+
+	return file.parseLength64(b)
+}
+
+// readString reads a string in any of its encodings
+func (file *File) readString() (string, error) {
+	b, err := file.reader.ReadByte()
+	if err != nil {
+		return "", fmt.Errorf("ReadByte failed: %v", err)
+	}
+
+	return file.parseString(b)
+}
+
+// readStrings reads a length followed by as many strings
+func (file *File) readStrings(pairs bool) ([]string, error) {
+	n, err := file.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	if pairs {
+		n *= 2
+	}
+
+	elems := make([]string, 0, min(n, 1024))
+	for i := 0; i < n; i++ {
+		elem, err := file.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		elems = append(elems, elem)
+	}
+
+	return elems, nil
+}
+
+// readEncoded reads a string holding an aggregate in one of its compact encodings
+func (file *File) readEncoded(decode func([]byte) ([]string, error)) ([]string, error) {
+	blob, err := file.readString()
+	if err != nil {
+		return nil, err
+	}
+
+	elems, err := decode([]byte(blob))
+	if err != nil {
+		return nil, fmt.Errorf("corrupt encoded value: %v", err)
+	}
+
+	return elems, nil
+}
+
+// readValue reads a value of the given RDB type
+func (file *File) readValue(t byte) (Value, error) {
+	switch t {
+	case rdbTypeString:
+		s, err := file.readString()
+		return String(s), err
+
+	case rdbTypeList, rdbTypeSet:
+		elems, err := file.readStrings(false)
+		if err != nil {
+			return nil, err
+		}
+
+		if t == rdbTypeList {
+			return NewList(elems...), nil
+		}
+		return NewSet(elems...), nil
+
+	case rdbTypeZSet, rdbTypeZSet2:
+		return file.readZSet(t == rdbTypeZSet2)
+
+	case rdbTypeHash:
+		elems, err := file.readStrings(true)
+		if err != nil {
+			return nil, err
+		}
+		return hashFromPairs(elems)
+
+	case rdbTypeListZiplist, rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		elems, err := file.readList(t)
+		if err != nil {
+			return nil, err
+		}
+		return NewList(elems...), nil
 
-		switch lastSixBits {
-		case 0:
-			l, err := file.reader.ReadByte()
+	case rdbTypeSetIntset, rdbTypeSetListpack:
+		decode := decodeIntset
+		if t == rdbTypeSetListpack {
+			decode = decodeListpack
+		}
+
+		elems, err := file.readEncoded(decode)
+		if err != nil {
+			return nil, err
+		}
+		return NewSet(elems...), nil
+
+	case rdbTypeZSetZiplist, rdbTypeZSetListpack:
+		decode := decodeZiplist
+		if t == rdbTypeZSetListpack {
+			decode = decodeListpack
+		}
+
+		elems, err := file.readEncoded(decode)
+		if err != nil {
+			return nil, err
+		}
+		return zsetFromPairs(elems)
+
+	case rdbTypeHashZipmap, rdbTypeHashZiplist, rdbTypeHashListpack:
+		decode := decodeZipmap
+		if t == rdbTypeHashZiplist {
+			decode = decodeZiplist
+		} else if t == rdbTypeHashListpack {
+			decode = decodeListpack
+		}
+
+		elems, err := file.readEncoded(decode)
+		if err != nil {
+			return nil, err
+		}
+		return hashFromPairs(elems)
+
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return file.readStream(t)
+
+	case rdbTypeModule, rdbTypeModule2:
+		return nil, fmt.Errorf("module values are not supported")
+
+	default:
+		return nil, fmt.Errorf("unknown value type %d", t)
+	}
+}
+
+// readList reads the elements of a ziplist or of the nodes of a quicklist
+func (file *File) readList(t byte) ([]string, error) {
+	if t == rdbTypeListZiplist {
+		return file.readEncoded(decodeZiplist)
+	}
+
+	nodes, err := file.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	elems := make([]string, 0)
+	for i := 0; i < nodes; i++ {
+		container := quicklistPacked
+		if t == rdbTypeListQuicklist2 {
+			container, err = file.readLength()
 			if err != nil {
-				return 0, fmt.Errorf("ReadByte failed: %v", err)
+				return nil, err
 			}
+		}
 
-			length := int8(l)
-			fmt.Printf("Parsed length (11): %d\n", length)
-			return int(length), nil
-		case 1:
-			l := make([]byte, 2)
-			_, err := file.reader.Read(l)
+		switch {
+		case t == rdbTypeListQuicklist:
+			node, err := file.readEncoded(decodeZiplist)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, node...)
+		case container == quicklistPacked:
+			node, err := file.readEncoded(decodeListpack)
 			if err != nil {
-				return 0, fmt.Errorf("ReadByte failed: %v", err)
+				return nil, err
 			}
+			elems = append(elems, node...)
+		case container == quicklistPlain:
+			elem, err := file.readString()
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, elem)
+		default:
+			return nil, fmt.Errorf("invalid quicklist container %d", container)
+		}
+	}
+
+	return elems, nil
+}
 
-			length := binary.BigEndian.Uint16(l)
-			fmt.Printf("Parsed length (11): %d\n", length)
-			return int(length), nil
-		case 2:
-			l := make([]byte, 4)
-			_, err := file.reader.Read(l)
+// readZSet reads the members of a sorted set with their scores,
+// stored as binary doubles in ZSET_2 and as strings before.
+func (file *File) readZSet(binaryScores bool) (*ZSet, error) {
+	n, err := file.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	zset := NewZSet()
+	for i := 0; i < n; i++ {
+		member, err := file.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		var score float64
+		if binaryScores {
+			buf, err := file.readFull(8)
+			if err != nil {
+				return nil, err
+			}
+			score = math.Float64frombits(binary.LittleEndian.Uint64(buf))
+		} else {
+			score, err = file.readDouble()
 			if err != nil {
-				return 0, fmt.Errorf("ReadByte failed: %v", err)
+				return nil, err
 			}
+		}
 
-			length := binary.BigEndian.Uint32(l)
-			fmt.Printf("Parsed length (11): %d\n", length)
-			return int(length), nil
-		default:
-			return 0, fmt.Errorf("invalid special encoding: %d", lastSixBits)
+		zset.scores[member] = score
+	}
+
+	return zset, nil
+}
+
+// readDouble reads a double stored as a string prefixed by its length,
+// the lengths 253, 254 and 255 standing for nan, +inf and -inf.
+func (file *File) readDouble() (float64, error) {
+	length, err := file.reader.ReadByte()
+	if err != nil {
+		return 0, fmt.Errorf("ReadByte failed: %v", err)
+	}
+
+	switch length {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+
+	buf, err := file.readFull(int(length))
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseFloat(string(buf), 64)
+}
+
+// readMillisecondTime reads a unix time in milliseconds
+func (file *File) readMillisecondTime() (int64, error) {
+	return file.readExpireTimeMS()
+}
+
+// readStreamID reads the two lengths making a stream ID
+func (file *File) readStreamID() (string, error) {
+	ms, err := file.readLength()
+	if err != nil {
+		return "", err
+	}
+
+	seq, err := file.readLength()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d-%d", ms, seq), nil
+}
+
+// readRawStreamID reads a stream ID stored as two big endian 64 bits integers
+func (file *File) readRawStreamID() (string, error) {
+	buf, err := file.readFull(16)
+	if err != nil {
+		return "", err
+	}
+
+	return rawStreamID(buf), nil
+}
+
+func rawStreamID(b []byte) string {
+	return fmt.Sprintf("%d-%d", binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:]))
+}
+
+// readStream reads a stream: its entries stored in listpacks, its metadata
+// and its consumer groups. Later versions added fields to the metadata.
+func (file *File) readStream(t byte) (*Stream, error) {
+	stream := NewStream()
+
+	nodes, err := file.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < nodes; i++ {
+		// the node key is the master ID the IDs of the node entries are relative to
+		master, err := file.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(master) != 16 {
+			return nil, fmt.Errorf("invalid stream node key length %d", len(master))
+		}
+
+		elems, err := file.readEncoded(decodeListpack)
+		if err != nil {
+			return nil, err
+		}
+
+		entries, err := decodeStreamListpack(elems, []byte(master))
+		if err != nil {
+			return nil, fmt.Errorf("corrupt stream node: %v", err)
+		}
+
+		stream.entries = append(stream.entries, entries...)
+	}
+
+	// number of entries
+	if _, err := file.readLength(); err != nil {
+		return nil, err
+	}
+
+	stream.lastID, err = file.readStreamID()
+	if err != nil {
+		return nil, err
+	}
+
+	stream.entriesAdded = int64(len(stream.entries))
+	if t >= rdbTypeStreamListpacks2 {
+		// first ID, computed from the entries
+		if _, err := file.readStreamID(); err != nil {
+			return nil, err
+		}
+
+		stream.maxDeletedID, err = file.readStreamID()
+		if err != nil {
+			return nil, err
+		}
+
+		added, err := file.readLength()
+		if err != nil {
+			return nil, err
+		}
+		stream.entriesAdded = int64(added)
+	}
+
+	groups, err := file.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < groups; i++ {
+		group, err := file.readConsumerGroup(t)
+		if err != nil {
+			return nil, fmt.Errorf("readConsumerGroup failed: %v", err)
 		}
+
+		stream.groups = append(stream.groups, group)
 	}
 
-	return 0, fmt.Errorf("invalid length encoding")
+	return stream, nil
 }
 
-// parseString parses a string from the RDB file
-func (file *File) parseString(b byte) (string, error) {
-	length, err := file.parseLength(b)
+// readConsumerGroup reads a consumer group with its pending entries and consumers
+func (file *File) readConsumerGroup(t byte) (*ConsumerGroup, error) {
+	var err error
+	group := &ConsumerGroup{entriesRead: -1}
+
+	group.name, err = file.readString()
 	if err != nil {
-		return "", fmt.Errorf("parseLength failed: %v", err)
+		return nil, err
+	}
+
+	group.lastID, err = file.readStreamID()
+	if err != nil {
+		return nil, err
 	}
-	fmt.Printf("String length: %d\n", length)
 
-	if length < 0 {
-		return "", fmt.Errorf("invalid string length: %d", length)
+	if t >= rdbTypeStreamListpacks2 {
+		// -1 when unknown
+		read, err := file.readLength64()
+		if err != nil {
+			return nil, err
+		}
+		group.entriesRead = int64(read)
 	}
 
-	// Handle empty string case
-	if length == 0 {
-		return "", nil
+	pending, err := file.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < pending; i++ {
+		entry := &PendingEntry{}
+
+		entry.id, err = file.readRawStreamID()
+		if err != nil {
+			return nil, err
+		}
+
+		entry.deliveryTime, err = file.readMillisecondTime()
+		if err != nil {
+			return nil, err
+		}
+
+		count, err := file.readLength()
+		if err != nil {
+			return nil, err
+		}
+		entry.deliveryCount = int64(count)
+
+		group.pending = append(group.pending, entry)
 	}
 
-	str := make([]byte, length)
-	n, err := file.reader.Read(str)
+	consumers, err := file.readLength()
 	if err != nil {
-		return "", fmt.Errorf("Read failed: %v", err)
+		return nil, err
+	}
+
+	for i := 0; i < consumers; i++ {
+		consumer := &Consumer{}
+
+		consumer.name, err = file.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		consumer.seenTime, err = file.readMillisecondTime()
+		if err != nil {
+			return nil, err
+		}
+
+		consumer.activeTime = consumer.seenTime
+		if t >= rdbTypeStreamListpacks3 {
+			consumer.activeTime, err = file.readMillisecondTime()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// the pending entries of the consumer refer to the ones of the group
+		n, err := file.readLength()
+		if err != nil {
+			return nil, err
+		}
+
+		for j := 0; j < n; j++ {
+			id, err := file.readRawStreamID()
+			if err != nil {
+				return nil, err
+			}
+
+			found := false
+			for _, entry := range group.pending {
+				if entry.id == id {
+					entry.consumer = consumer.name
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				return nil, fmt.Errorf("pending entry %s of consumer %s not found in group %s", id, consumer.name, group.name)
+			}
+		}
+
+		group.consumers = append(group.consumers, consumer)
+	}
+
+	return group, nil
+}
+
+// decodeStreamListpack returns the entries of a stream node. The node starts
+// with a master entry holding the fields shared by the entries, which only
+// store their ID relative to the master ID and their values if they share the fields.
+func decodeStreamListpack(elems []string, master []byte) ([]*StreamEntry, error) {
+	pos := 0
+	next := func() (string, error) {
+		if pos >= len(elems) {
+			return "", fmt.Errorf("unexpected end of node")
+		}
+
+		pos++
+		return elems[pos-1], nil
 	}
-	if n != length {
-		return "", fmt.Errorf("read string length mismatch: expected %d, got %d", length, n)
+	nextInt := func() (int64, error) {
+		elem, err := next()
+		if err != nil {
+			return 0, err
+		}
+
+		return strconv.ParseInt(elem, 10, 64)
 	}
-	fmt.Printf("Parsed string: %s\n", string(str[:n]))
-	return string(str[:n]), nil
+
+	masterMs := binary.BigEndian.Uint64(master[:8])
+	masterSeq := binary.BigEndian.Uint64(master[8:])
+
+	// valid and deleted entries count
+	for i := 0; i < 2; i++ {
+		if _, err := nextInt(); err != nil {
+			return nil, err
+		}
+	}
+
+	n, err := nextInt()
+	if err != nil {
+		return nil, err
+	}
+
+	if n < 0 || int(n) > len(elems) {
+		return nil, fmt.Errorf("invalid master fields count %d", n)
+	}
+
+	masterFields := make([]string, n)
+	for i := range masterFields {
+		if masterFields[i], err = next(); err != nil {
+			return nil, err
+		}
+	}
+
+	// end of the master entry
+	if _, err := next(); err != nil {
+		return nil, err
+	}
+
+	entries := make([]*StreamEntry, 0)
+	for pos < len(elems) {
+		var header [3]int64
+		for i := range header {
+			if header[i], err = nextInt(); err != nil {
+				return nil, err
+			}
+		}
+		flags, msDiff, seqDiff := header[0], header[1], header[2]
+
+		var kvs []string
+		if flags&streamItemSameFields != 0 {
+			for _, field := range masterFields {
+				value, err := next()
+				if err != nil {
+					return nil, err
+				}
+
+				kvs = append(kvs, field, value)
+			}
+		} else {
+			n, err := nextInt()
+			if err != nil {
+				return nil, err
+			}
+
+			if n < 0 || int(n) > len(elems) {
+				return nil, fmt.Errorf("invalid fields count %d", n)
+			}
+
+			for i := 0; i < int(n)*2; i++ {
+				elem, err := next()
+				if err != nil {
+					return nil, err
+				}
+
+				kvs = append(kvs, elem)
+			}
+		}
+
+		// number of elements of the entry, used to iterate backwards
+		if _, err := next(); err != nil {
+			return nil, err
+		}
+
+		if flags&streamItemDeleted != 0 {
+			continue
+		}
+
+		id := fmt.Sprintf("%d-%d", masterMs+uint64(msDiff), masterSeq+uint64(seqDiff))
+
+		entry, err := NewStreamEntry(id, kvs)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// hashFromPairs builds a hash from fields and values following each other
+func hashFromPairs(elems []string) (*Hash, error) {
+	if len(elems)%2 != 0 {
+		return nil, fmt.Errorf("hash field without value")
+	}
+
+	hash := NewHash()
+	for i := 0; i < len(elems); i += 2 {
+		hash.fields[elems[i]] = elems[i+1]
+	}
+
+	return hash, nil
+}
+
+// zsetFromPairs builds a sorted set from members and scores following each other
+func zsetFromPairs(elems []string) (*ZSet, error) {
+	if len(elems)%2 != 0 {
+		return nil, fmt.Errorf("sorted set member without score")
+	}
+
+	zset := NewZSet()
+	for i := 0; i < len(elems); i += 2 {
+		score, err := strconv.ParseFloat(elems[i+1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid score %q", elems[i+1])
+		}
+
+		zset.scores[elems[i]] = score
+	}
+
+	return zset, nil
 }
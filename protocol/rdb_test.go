@@ -0,0 +1,433 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	lzf "github.com/zhuyie/golzf"
+)
+
+const (
+	testRDBHeader = "REDIS0011\xfa\x09redis-ver\x057.2.0\xfe\x00\xfb\x02\x00"
+	testRDB       = testRDBHeader + "\x00\x03foo\x03bar\x00\x03baz\x03qux\xff\x00\x00\x00\x00\x00\x00\x00\x00"
+	// truncated in the middle of the second key
+	testCorruptRDB = testRDBHeader + "\x00\x03foo\x03bar\x00\x03ba"
+	// keys in databases 0 and 1 with aux fields
+	testMultiDBRDB = "REDIS0011\xfa\x09redis-ver\x057.2.0\xfa\x0brepl-offset\xc0\x2a" +
+		"\xfe\x00\xfb\x01\x00\x00\x03foo\x03bar" +
+		"\xfe\x01\xfb\x01\x00\x00\x03baz\x03qux\xff"
+)
+
+// withChecksum appends the CRC64 of the given RDB content.
+func withChecksum(content string) string {
+	return string(binary.LittleEndian.AppendUint64([]byte(content), crc64Update(0, []byte(content))))
+}
+
+func Test_loadRDB(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		filename string
+		policy   string
+		want     []string
+		wantDB1  []string
+		wantAux  map[string]string
+		wantErr  bool
+	}{
+		{name: "Test load", content: testRDB, policy: "exit", want: []string{"baz", "foo"}},
+		{name: "Test load missing file", filename: "missing.rdb", policy: "exit", want: []string{}},
+		{name: "Test load corrupt file", content: testCorruptRDB, policy: "exit", want: []string{}, wantErr: true},
+		{name: "Test load corrupt file keeping keys", content: testCorruptRDB, policy: "keep", want: []string{"foo"}},
+		{name: "Test load corrupt file starting empty", content: testCorruptRDB, policy: "empty", want: []string{}},
+		{
+			name:    "Test load multiple databases",
+			content: withChecksum(testMultiDBRDB),
+			policy:  "exit",
+			want:    []string{"foo"},
+			wantDB1: []string{"baz"},
+			wantAux: map[string]string{"redis-ver": "7.2.0", "repl-offset": "42"},
+		},
+		{name: "Test load checksum mismatch", content: testMultiDBRDB + "\x01\x02\x03\x04\x05\x06\x07\x08", policy: "exit", want: []string{}, wantErr: true},
+		{name: "Test load missing checksum", content: testMultiDBRDB, policy: "exit", want: []string{}, wantErr: true},
+		{name: "Test load version without checksum", content: "REDIS0004\xfe\x00\x00\x03foo\x03bar\xff", policy: "exit", want: []string{"foo"}},
+		{name: "Test load invalid magic", content: "RODIS0011\xff", policy: "exit", want: []string{}, wantErr: true},
+		{name: "Test load unsupported version", content: "REDIS0099\xff", policy: "exit", want: []string{}, wantErr: true},
+		{name: "Test load DB index out of range", content: "REDIS0011\xfe\x02\xff", policy: "exit", want: []string{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "dump.rdb"), []byte(tt.content), 0o644); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+
+			filename := tt.filename
+			if filename == "" {
+				filename = "dump.rdb"
+			}
+
+			dbs := newDatabases(2)
+			aux, err := loadRDB(Opts{Dir: dir, Dbfilename: filename, RDBCorrupt: tt.policy}, dbs)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadRDB() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			got := dbs[0].Keys("*")
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadRDB() keys = %v, want %v", got, tt.want)
+			}
+
+			if tt.wantDB1 != nil {
+				if got := dbs[1].Keys("*"); !reflect.DeepEqual(got, tt.wantDB1) {
+					t.Errorf("loadRDB() keys of DB 1 = %v, want %v", got, tt.wantDB1)
+				}
+			}
+
+			if tt.wantAux != nil && !reflect.DeepEqual(aux, tt.wantAux) {
+				t.Errorf("loadRDB() aux = %v, want %v", aux, tt.wantAux)
+			}
+		})
+	}
+}
+
+func TestFile_parseString(t *testing.T) {
+	long := strings.Repeat("redis", 20)
+	compressed := make([]byte, len(long))
+	n, err := lzf.Compress([]byte(long), compressed)
+	if err != nil {
+		t.Fatalf("lzf.Compress failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "Test raw string", input: "\x05hello", want: "hello"},
+		{name: "Test empty string", input: "\x00", want: ""},
+		{name: "Test 14 bits length", input: "\x40\x03abc", want: "abc"},
+		{name: "Test 32 bits length", input: "\x80\x00\x00\x00\x03abc", want: "abc"},
+		{name: "Test 8 bits integer", input: "\xc0\x7b", want: "123"},
+		{name: "Test negative 8 bits integer", input: "\xc0\xff", want: "-1"},
+		{name: "Test 16 bits integer", input: "\xc1\x39\x30", want: "12345"},
+		{name: "Test 32 bits integer", input: "\xc2\x87\xd6\x12\x00", want: "1234567"},
+		{name: "Test LZF string", input: "\xc3" + string([]byte{byte(n), 0x40 | byte(len(long)>>8), byte(len(long))}) + string(compressed[:n]), want: long},
+		{name: "Test short string", input: "\x05hel", wantErr: true},
+		{name: "Test short integer", input: "\xc2\x87\xd6", wantErr: true},
+		{name: "Test corrupt LZF string", input: "\xc3\x02\x05\xff\xff", wantErr: true},
+		{name: "Test oversized LZF string", input: "\xc3\x81\x00\x00\x00\x10\x00\x00\x00\x00\x05", wantErr: true},
+		{name: "Test negative LZF length", input: "\xc3\x81\xff\xff\xff\xff\xff\xff\xff\xff\x05", wantErr: true},
+		{name: "Test truncated LZF string", input: "\xc3\x05\x05\x04ab", wantErr: true},
+		{name: "Test invalid encoding", input: "\xc4", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := NewFile(strings.NewReader(tt.input))
+
+			b, _ := file.reader.ReadByte()
+			got, err := file.parseString(b)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseString() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseString() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// lpEntry encodes a listpack entry from its encoding and data, followed by its backlen.
+func lpEntry(enc ...byte) string {
+	return string(enc) + string([]byte{byte(len(enc))})
+}
+
+// lpStr encodes a listpack string shorter than 64 bytes.
+func lpStr(s string) string {
+	return lpEntry(append([]byte{0x80 | byte(len(s))}, s...)...)
+}
+
+// lpInt encodes a listpack integer between 0 and 127.
+func lpInt(v int) string {
+	return lpEntry(byte(v))
+}
+
+// listpack builds a listpack from encoded entries.
+func listpack(entries ...string) string {
+	return "\x00\x00\x00\x00\x00\x00" + strings.Join(entries, "") + "\xff"
+}
+
+// rdbStr encodes an RDB string shorter than 64 bytes.
+func rdbStr(s string) string {
+	return string([]byte{byte(len(s))}) + s
+}
+
+func Test_decodeListpack(t *testing.T) {
+	str70 := strings.Repeat("x", 70)
+
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "Test listpack",
+			input: listpack(
+				lpInt(5),
+				lpStr("abc"),
+				lpEntry(0xdf, 0xff),
+				lpEntry(append([]byte{0xe0, 70}, str70...)...),
+				lpEntry(0xf1, 0x39, 0x30),
+				lpEntry(0xf2, 0xfe, 0xff, 0xff),
+				lpEntry(0xf3, 0x87, 0xd6, 0x12, 0x00),
+				lpEntry(0xf4, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00),
+			),
+			want: []string{"5", "abc", "-1", str70, "12345", "-2", "1234567", "1099511627776"},
+		},
+		{name: "Test empty listpack", input: listpack(), want: []string{}},
+		{name: "Test listpack without end", input: "\x00\x00\x00\x00\x00\x00" + lpStr("abc"), wantErr: true},
+		{name: "Test listpack with truncated string", input: "\x00\x00\x00\x00\x00\x00\x85ab", wantErr: true},
+		{name: "Test listpack with invalid encoding", input: listpack(lpEntry(0xf5)), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeListpack([]byte(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("decodeListpack() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeListpack() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_encodeListpack(t *testing.T) {
+	tests := []struct {
+		name  string
+		elems []string
+	}{
+		{name: "Test empty listpack", elems: []string{}},
+		{name: "Test integers", elems: []string{"0", "127", "128", "-1", "-4096", "4095", "-32768", "32767", "-8388608", "8388607", "-2147483648", "2147483647", "-9223372036854775808", "9223372036854775807"}},
+		{name: "Test strings", elems: []string{"", "abc", "007", "-0", "1e3", strings.Repeat("x", 63), strings.Repeat("x", 64), strings.Repeat("x", 4095), strings.Repeat("x", 4096), strings.Repeat("x", 20000)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := encodeListpack(tt.elems)
+			if got := int(binary.LittleEndian.Uint32(b)); got != len(b) {
+				t.Errorf("encodeListpack() total bytes = %d, want %d", got, len(b))
+			}
+
+			got, err := decodeListpack(b)
+			if err != nil {
+				t.Fatalf("decodeListpack() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.elems) {
+				t.Errorf("decodeListpack(encodeListpack()) = %q, want %q", got, tt.elems)
+			}
+		})
+	}
+}
+
+func Test_decodeZiplist(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "Test ziplist",
+			input: "\x00\x00\x00\x00\x00\x00\x00\x00\x04\x00" + "\x00\x03abc" + "\x05\xf2" + "\x02\xfe\x80" + "\x03\xc0\x39\x30" + "\xff",
+			want:  []string{"abc", "1", "-128", "12345"},
+		},
+		{
+			name:  "Test ziplist with large previous entry",
+			input: "\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00" + "\xfe\x00\x01\x00\x00\x01a" + "\xff",
+			want:  []string{"a"},
+		},
+		{name: "Test ziplist without end", input: "\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x03abc", wantErr: true},
+		{name: "Test ziplist with invalid encoding", input: "\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x90\xff", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeZiplist([]byte(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("decodeZiplist() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeZiplist() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_decodeIntset(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "Test 16 bits intset", input: "\x02\x00\x00\x00\x02\x00\x00\x00\x01\x00\xff\xff", want: []string{"1", "-1"}},
+		{name: "Test 64 bits intset", input: "\x08\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00", want: []string{"1099511627776"}},
+		{name: "Test intset with wrong length", input: "\x02\x00\x00\x00\x03\x00\x00\x00\x01\x00", wantErr: true},
+		{name: "Test intset with invalid encoding", input: "\x03\x00\x00\x00\x00\x00\x00\x00", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeIntset([]byte(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("decodeIntset() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeIntset() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_decodeZipmap(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "Test zipmap", input: "\x02\x03foo\x03\x00bar\x03baz\x01\x02q\x00\x00\xff", want: []string{"foo", "bar", "baz", "q"}},
+		{name: "Test zipmap with field without value", input: "\x01\x03foo\xff", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeZipmap([]byte(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("decodeZipmap() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeZipmap() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFile_readValue(t *testing.T) {
+	stream := NewStream()
+	stream.entries = []*StreamEntry{
+		{id: "1000-0", kvpairs: map[string]string{"f": "v1"}},
+		{id: "1002-0", kvpairs: map[string]string{"g": "w"}},
+	}
+	stream.lastID = "1002-0"
+	stream.maxDeletedID = "1001-0"
+	stream.entriesAdded = 3
+	stream.groups = []*ConsumerGroup{{
+		name:        "grp",
+		lastID:      "1000-0",
+		entriesRead: 1,
+		pending:     []*PendingEntry{{id: "1000-0", consumer: "alice", deliveryTime: 1, deliveryCount: 1}},
+		consumers:   []*Consumer{{name: "alice", seenTime: 2, activeTime: 3}},
+	}}
+
+	id1000 := "\x00\x00\x00\x00\x00\x00\x03\xe8\x00\x00\x00\x00\x00\x00\x00\x00"
+	streamNode := listpack(
+		// master entry: 2 entries, 1 deleted, the field f
+		lpInt(2), lpInt(1), lpInt(1), lpStr("f"), lpInt(0),
+		// 1000-0 with the master fields
+		lpInt(2), lpInt(0), lpInt(0), lpStr("v1"), lpInt(4),
+		// 1001-0 deleted
+		lpInt(3), lpInt(1), lpInt(0), lpStr("v2"), lpInt(4),
+		// 1002-0 with its own fields
+		lpInt(0), lpInt(2), lpInt(0), lpInt(1), lpStr("g"), lpStr("w"), lpInt(6),
+	)
+
+	tests := []struct {
+		name    string
+		t       byte
+		input   string
+		want    Value
+		wantErr bool
+	}{
+		{name: "Test string", t: rdbTypeString, input: rdbStr("abc"), want: String("abc")},
+		{name: "Test list", t: rdbTypeList, input: "\x02" + rdbStr("a") + rdbStr("b"), want: NewList("a", "b")},
+		{
+			name:  "Test quicklist 2",
+			t:     rdbTypeListQuicklist2,
+			input: "\x02" + "\x02" + rdbStr(listpack(lpStr("a"), lpStr("b"))) + "\x01" + rdbStr("c"),
+			want:  NewList("a", "b", "c"),
+		},
+		{name: "Test set", t: rdbTypeSet, input: "\x02" + rdbStr("a") + rdbStr("b"), want: NewSet("a", "b")},
+		{name: "Test set listpack", t: rdbTypeSetListpack, input: rdbStr(listpack(lpStr("a"), lpInt(1))), want: NewSet("a", "1")},
+		{
+			name:  "Test sorted set",
+			t:     rdbTypeZSet,
+			input: "\x02" + rdbStr("a") + "\x031.5" + rdbStr("b") + "\xfe",
+			want:  &ZSet{scores: map[string]float64{"a": 1.5, "b": math.Inf(1)}},
+		},
+		{
+			name:  "Test sorted set 2",
+			t:     rdbTypeZSet2,
+			input: "\x01" + rdbStr("a") + "\x00\x00\x00\x00\x00\x00\xf8\x3f",
+			want:  &ZSet{scores: map[string]float64{"a": 1.5}},
+		},
+		{
+			name:  "Test sorted set listpack",
+			t:     rdbTypeZSetListpack,
+			input: rdbStr(listpack(lpStr("a"), lpInt(1), lpStr("b"), lpStr("2.5"))),
+			want:  &ZSet{scores: map[string]float64{"a": 1, "b": 2.5}},
+		},
+		{
+			name:  "Test hash",
+			t:     rdbTypeHash,
+			input: "\x01" + rdbStr("f") + rdbStr("v"),
+			want:  &Hash{fields: map[string]string{"f": "v"}},
+		},
+		{
+			name:  "Test hash listpack",
+			t:     rdbTypeHashListpack,
+			input: rdbStr(listpack(lpStr("f"), lpStr("v"), lpStr("n"), lpInt(7))),
+			want:  &Hash{fields: map[string]string{"f": "v", "n": "7"}},
+		},
+		{
+			name: "Test stream listpacks 3",
+			t:    rdbTypeStreamListpacks3,
+			input: "\x01" + rdbStr(id1000) + "\x40" + string([]byte{byte(len(streamNode))}) + streamNode +
+				// length, last ID, first ID, max deleted ID, entries added
+				"\x02" + "\x43\xea\x00" + "\x43\xe8\x00" + "\x43\xe9\x00" + "\x03" +
+				// group with its pending entry
+				"\x01" + rdbStr("grp") + "\x43\xe8\x00" + "\x01" +
+				"\x01" + id1000 + "\x01\x00\x00\x00\x00\x00\x00\x00" + "\x01" +
+				// consumer
+				"\x01" + rdbStr("alice") + "\x02\x00\x00\x00\x00\x00\x00\x00" + "\x03\x00\x00\x00\x00\x00\x00\x00" + "\x01" + id1000,
+			want: stream,
+		},
+		{name: "Test hash listpack with field without value", t: rdbTypeHashListpack, input: rdbStr(listpack(lpStr("f"))), wantErr: true},
+		{name: "Test module", t: rdbTypeModule2, input: "", wantErr: true},
+		{name: "Test unknown type", t: 42, input: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := NewFile(strings.NewReader(tt.input))
+
+			got, err := file.readValue(tt.t)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("readValue() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readValue() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of the replication link of a slave with its master.
+const (
+	linkNone       = "none"       // not a slave
+	linkConnect    = "connect"    // waiting to connect again
+	linkConnecting = "connecting" // dialing master
+	linkHandshake  = "handshake"  // asking master to synchronize
+	linkSync       = "sync"       // receiving the snapshot of master
+	linkConnected  = "connected"  // applying the commands streamed by master
+)
+
+const (
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 10 * time.Second
+)
+
+// MasterLink is the replication link of a slave with its master. The server
+// is a master while there is no link.
+type MasterLink struct {
+	lock       sync.Mutex
+	host, port string
+	state      string
+	c          *Connection   // connection to master, nil while not connected
+	stopped    chan struct{} // closed to stop replicating the master
+	done       chan struct{} // closed once the replication stopped
+	lastIO     time.Time     // time data was last received from master
+	downSince  time.Time     // time the link was lost, zero if it never was up
+	db         int           // database selected by master when the link was lost
+}
+
+var link = &MasterLink{state: linkNone}
+
+// ReplicateMaster makes the server a slave of the master given in the options.
+func ReplicateMaster(o Opts) {
+	list.Demote()
+	link.start(o, o.MasterHost, o.MasterPort)
+}
+
+// start replicates the given master in the background, connecting to it
+// again with an exponential backoff whenever the link drops.
+// The replication of the previous master must be stopped.
+func (l *MasterLink) start(o Opts, host, port string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.host, l.port = host, port
+	l.state = linkConnect
+	l.stopped = make(chan struct{})
+	l.done = make(chan struct{})
+	l.lastIO = time.Time{}
+	l.downSince = time.Time{}
+	l.db = 0
+
+	go l.run(o, host, port, l.stopped, l.done)
+}
+
+// stop stops replicating master and waits for the command applied from it to complete.
+func (l *MasterLink) stop() {
+	l.lock.Lock()
+	if l.state == linkNone {
+		l.lock.Unlock()
+		return
+	}
+
+	close(l.stopped)
+	if l.c != nil {
+		l.c.Close()
+	}
+	done := l.done
+
+	l.host, l.port = "", ""
+	l.state = linkNone
+	l.c = nil
+	l.lock.Unlock()
+
+	<-done
+}
+
+// isSlave reports whether the server replicates a master.
+func (l *MasterLink) isSlave() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.state != linkNone
+}
+
+// status returns the state of the link.
+func (l *MasterLink) status() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.state
+}
+
+// replicating reports whether the server replicates the given master.
+func (l *MasterLink) replicating(host, port string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.state != linkNone && l.host == host && l.port == port
+}
+
+func (l *MasterLink) run(o Opts, host, port string, stopped, done chan struct{}) {
+	defer close(done)
+
+	addr := net.JoinHostPort(host, port)
+	delay := minReconnectDelay
+	for {
+		up, err := l.replicate(o, addr, stopped)
+
+		select {
+		case <-stopped:
+			fmt.Printf("Stopped replicating master %s\n", addr)
+			return
+		default:
+		}
+
+		fmt.Printf("Replication from master %s failed: %v\n", addr, err)
+
+		l.setState(stopped, linkConnect)
+		if up {
+			delay = minReconnectDelay
+		}
+
+		select {
+		case <-stopped:
+			fmt.Printf("Stopped replicating master %s\n", addr)
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxReconnectDelay)
+	}
+}
+
+// replicate connects to master, synchronizes with it and applies the commands
+// it streams until the link drops. It reports whether the link was up.
+func (l *MasterLink) replicate(o Opts, addr string, stopped chan struct{}) (bool, error) {
+	timeout := time.Duration(o.ReplTimeout) * time.Second
+
+	l.setState(stopped, linkConnecting)
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return false, fmt.Errorf("net.Dial failed: %v", err)
+	}
+
+	c := NewConnection(masterConn{Conn: conn, timeout: timeout})
+
+	// the connection is closed by stop from now on
+	l.lock.Lock()
+	select {
+	case <-stopped:
+		l.lock.Unlock()
+		c.Close()
+		return false, fmt.Errorf("replication stopped")
+	default:
+	}
+	l.c = c
+	l.state = linkHandshake
+	db := l.db
+	l.lock.Unlock()
+
+	server := NewSlave(c)
+	full, err := server.Handshake(o)
+	if err != nil {
+		l.detach(c, db)
+		c.Close()
+		return false, fmt.Errorf("Handshake failed: %v", err)
+	}
+
+	// a partial resynchronization continues the stream against the database master had selected
+	if !full {
+		server.db = db
+		server.storage = databases[db]
+	}
+
+	l.setState(stopped, linkConnected)
+	fmt.Printf("Connected to master %s\n", addr)
+
+	server.Handle()
+
+	l.detach(c, server.db)
+
+	return true, fmt.Errorf("connection lost")
+}
+
+// detach records that the link of the given connection was lost.
+func (l *MasterLink) detach(c *Connection, db int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.c != c {
+		return
+	}
+
+	l.c = nil
+	l.db = db
+	if l.state == linkConnected {
+		l.downSince = time.Now()
+	}
+}
+
+// setState changes the state of the link, unless the replication was stopped.
+func (l *MasterLink) setState(stopped chan struct{}, state string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.stopped == stopped && l.state != linkNone {
+		l.state = state
+	}
+}
+
+// syncing records that the snapshot of master is received on the given connection.
+func (l *MasterLink) syncing(c *Connection) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.c == c {
+		l.state = linkSync
+	}
+}
+
+// touch records that data was received from master.
+func (l *MasterLink) touch() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.lastIO = time.Now()
+}
+
+// info returns the fields of the replication section of the INFO command about the link.
+func (l *MasterLink) info(now time.Time) string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	status, lastIO := "down", -1
+	if l.state == linkConnected {
+		status = "up"
+		lastIO = int(now.Sub(l.lastIO).Seconds())
+	}
+
+	var sync int
+	if l.state == linkSync {
+		sync = 1
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "master_host:%s\r\n"+
+		"master_port:%s\r\n"+
+		"master_link_status:%s\r\n"+
+		"master_last_io_seconds_ago:%d\r\n"+
+		"master_sync_in_progress:%d\r\n"+
+		"slave_repl_offset:%d\r\n",
+		l.host, l.port, status, lastIO, sync, list.Offset())
+
+	if status == "down" {
+		downSince := -1
+		if !l.downSince.IsZero() {
+			downSince = int(now.Sub(l.downSince).Seconds())
+		}
+		fmt.Fprintf(&b, "master_link_down_since_seconds:%d\r\n", downSince)
+	}
+
+	return b.String()
+}
+
+// masterConn is the connection of a slave to its master. Reading from it
+// fails once master sent nothing for the replication timeout, master pinging
+// its slaves meanwhile.
+type masterConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c masterConn) Read(b []byte) (int, error) {
+	if err := c.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		link.touch()
+	}
+
+	return n, err
+}
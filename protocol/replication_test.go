@@ -0,0 +1,357 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMasterLink_info(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		state     string
+		lastIO    time.Time
+		downSince time.Time
+		want      []string
+	}{
+		{
+			name:   "Test info connected",
+			state:  linkConnected,
+			lastIO: now.Add(-3 * time.Second),
+			want:   []string{"master_link_status:up", "master_last_io_seconds_ago:3", "master_sync_in_progress:0"},
+		},
+		{
+			name:  "Test info never connected",
+			state: linkConnecting,
+			want:  []string{"master_link_status:down", "master_last_io_seconds_ago:-1", "master_link_down_since_seconds:-1"},
+		},
+		{
+			name:      "Test info syncing",
+			state:     linkSync,
+			downSince: now.Add(-5 * time.Second),
+			want:      []string{"master_link_status:down", "master_sync_in_progress:1", "master_link_down_since_seconds:5"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &MasterLink{host: "localhost", port: "6379", state: tt.state, lastIO: tt.lastIO, downSince: tt.downSince}
+
+			got := l.info(now)
+			for _, field := range append(tt.want, "master_host:localhost", "master_port:6379") {
+				if !strings.Contains(got, field+"\r\n") {
+					t.Errorf("info() = %q, missing %q", got, field)
+				}
+			}
+			if tt.state == linkConnected && strings.Contains(got, "master_link_down_since_seconds") {
+				t.Errorf("info() = %q, reports the link down", got)
+			}
+		})
+	}
+}
+
+func Test_masterConn_Read(t *testing.T) {
+	tests := []struct {
+		name    string
+		write   string
+		wantErr bool
+	}{
+		{
+			name:  "Test read from master",
+			write: "*1\r\n$4\r\nPING\r\n",
+		},
+		{
+			name:    "Test read from silent master",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			if tt.write != "" {
+				go server.Write([]byte(tt.write))
+			}
+
+			c := masterConn{Conn: client, timeout: 50 * time.Millisecond}
+			b := make([]byte, 64)
+			n, err := c.Read(b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Read() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Errorf("Read() error = %v, want a timeout", err)
+			}
+			if string(b[:n]) != tt.write {
+				t.Errorf("Read() = %q, want %q", b[:n], tt.write)
+			}
+		})
+	}
+}
+
+func TestServer_replicaError(t *testing.T) {
+	tests := []struct {
+		name       string
+		state      string
+		readOnly   string
+		serveStale string
+		fromMaster bool
+		command    string
+		want       string
+	}{
+		{
+			name:     "Test write on master",
+			state:    linkNone,
+			readOnly: "yes",
+			command:  "set",
+		},
+		{
+			name:     "Test write on read-only slave",
+			state:    linkConnected,
+			readOnly: "yes",
+			command:  "set",
+			want:     "-READONLY You can't write against a read only replica.\r\n",
+		},
+		{
+			name:     "Test write on writable slave",
+			state:    linkConnected,
+			readOnly: "no",
+			command:  "set",
+		},
+		{
+			name:       "Test write from master",
+			state:      linkConnected,
+			readOnly:   "yes",
+			fromMaster: true,
+			command:    "set",
+		},
+		{
+			name:     "Test read on read-only slave",
+			state:    linkConnected,
+			readOnly: "yes",
+			command:  "get",
+		},
+		{
+			name:       "Test read on slave with link down",
+			state:      linkConnect,
+			serveStale: "no",
+			command:    "get",
+			want:       "-MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.\r\n",
+		},
+		{
+			name:       "Test read on slave syncing",
+			state:      linkSync,
+			serveStale: "no",
+			command:    "get",
+			want:       "-MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.\r\n",
+		},
+		{
+			name:       "Test stale command on slave with link down",
+			state:      linkConnect,
+			serveStale: "no",
+			command:    "info",
+		},
+		{
+			name:       "Test read on slave serving stale data",
+			state:      linkConnect,
+			serveStale: "yes",
+			command:    "get",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(state string) { link.state = state }(link.state)
+			link.state = tt.state
+
+			s := &Server{
+				opts:       Opts{ReplicaReadOnly: tt.readOnly, ReplicaServeStaleData: tt.serveStale},
+				fromMaster: tt.fromMaster,
+			}
+			if got := s.replicaError(commands[tt.command]); got != tt.want {
+				t.Errorf("replicaError() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_HandleOffset(t *testing.T) {
+	defer func(dbs []*Storage, l *Slaves) { databases, list = dbs, l }(databases, list)
+	databases = newDatabases(1)
+	list = NewSlaves()
+
+	getack := ToRespArray([]string{"REPLCONF", "GETACK", "*"})
+
+	tests := []struct {
+		name     string
+		requests [][]string
+	}{
+		{
+			name:     "Test offset of writes",
+			requests: [][]string{{"SET", "foo", "bar"}, {"PING"}},
+		},
+		{
+			name:     "Test offset of commands with GETACK as argument",
+			requests: [][]string{{"SET", "getack", "x"}, {"GET", "GETACK"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+
+			s := NewSlave(NewConnection(server))
+			done := make(chan struct{})
+			go func() {
+				s.Handle()
+				close(done)
+			}()
+			defer func() { <-done }()
+			defer client.Close()
+
+			var want int
+			for _, request := range tt.requests {
+				want += len(ToRespArray(request))
+			}
+
+			r := NewRespReader(client)
+			for _, offset := range []int{want, want + len(getack)} {
+				stream := getack
+				if offset == want {
+					for _, request := range tt.requests {
+						stream = ToRespArray(request) + stream
+					}
+				}
+				go client.Write([]byte(stream))
+
+				ack, err := r.ReadValue()
+				if err != nil {
+					t.Fatalf("ReadValue() error = %v", err)
+				}
+				if len(ack.Elems) != 3 || ack.Elems[2].Str != strconv.Itoa(offset) {
+					t.Errorf("ACK = %+v, want offset %d", ack, offset)
+				}
+			}
+		})
+	}
+}
+
+func Test_handlePsync(t *testing.T) {
+	defer func(state string) { link.state = state }(link.state)
+	link.state = linkConnected
+
+	var buf bytes.Buffer
+	s := &Server{c: NewConnection(bufferConn{buf: &buf})}
+
+	got, err := handlePsync(s, []string{"?", "-1"})
+	if err != nil {
+		t.Fatalf("handlePsync() error = %v", err)
+	}
+	if !strings.HasPrefix(got, "-ERR") {
+		t.Errorf("handlePsync() = %q, want an error on a slave", got)
+	}
+}
+
+func Test_handleExecReplicaError(t *testing.T) {
+	tests := []struct {
+		name       string
+		state      string
+		readOnly   string
+		serveStale string
+		queue      [][]string
+		want       string
+	}{
+		{
+			name:     "Test write queued before becoming a read-only slave",
+			state:    linkConnected,
+			readOnly: "yes",
+			queue:    [][]string{{"GET", "foo"}, {"SET", "foo", "bar"}},
+			want:     "-EXECABORT Transaction discarded because of: READONLY You can't write against a read only replica.\r\n",
+		},
+		{
+			name:       "Test read queued before the link with master went down",
+			state:      linkConnect,
+			serveStale: "no",
+			queue:      [][]string{{"GET", "foo"}},
+			want:       "-EXECABORT Transaction discarded because of: MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(state string) { link.state = state }(link.state)
+			link.state = tt.state
+
+			s := &Server{
+				opts:    Opts{ReplicaReadOnly: tt.readOnly, ReplicaServeStaleData: tt.serveStale},
+				queuing: true,
+				queue:   tt.queue,
+			}
+			got, err := handleExec(s, nil)
+			if err != nil {
+				t.Fatalf("handleExec() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("handleExec() = %q, want %q", got, tt.want)
+			}
+			if s.queuing || len(s.queue) != 0 {
+				t.Errorf("handleExec() kept the transaction")
+			}
+		})
+	}
+}
+
+func Test_handleWaitOnSlave(t *testing.T) {
+	defer func(state string) { link.state = state }(link.state)
+	link.state = linkConnected
+
+	slaves := NewSlaves()
+	slaves.SetReplication("8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb", 53)
+	slaves.Feed(ToRespArray([]string{"SET", "foo", "bar"}))
+
+	s := &Server{mc: &MasterConfig{slaves: slaves}}
+	got, err := handleWait(s, []string{"1", "0"})
+	if err != nil {
+		t.Fatalf("handleWait() error = %v", err)
+	}
+	if !strings.HasPrefix(got, "-ERR") {
+		t.Errorf("handleWait() = %q, want an error on a slave", got)
+	}
+
+	// the slave still resumes the replication where its master is
+	if replID, offset := slaves.Replication(); replID != "8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb" || offset != 53 {
+		t.Errorf("Replication() = %s, %d, want 8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb, 53", replID, offset)
+	}
+}
+
+func Test_handlePsyncStalledSlave(t *testing.T) {
+	defer func(dbs []*Storage) { databases = dbs }(databases)
+	databases = newDatabases(1)
+
+	// the slave never reads what is written to it
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	s := &Server{c: NewConnection(conn), mc: &MasterConfig{slaves: NewSlaves()}}
+
+	done := make(chan error)
+	go func() {
+		_, err := handlePsync(s, []string{"?", "-1"})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("handlePsync() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handlePsync() blocked writing to the slave")
+	}
+}
@@ -0,0 +1,245 @@
+package protocol
+
+import (
+	"math"
+	"strconv"
+)
+
+// ReplyWriter encodes replies for the protocol version negotiated by the client.
+// RESP3 types are downgraded to their RESP2 equivalents unless HELLO 3 was sent.
+//
+// Every AppendX method appends the encoded value to the given buffer without
+// allocating when it has enough capacity, the other methods return it as a string.
+type ReplyWriter struct {
+	proto int
+}
+
+// Proto returns the protocol version of the client, 2 by default.
+func (w ReplyWriter) Proto() int {
+	if w.proto == 0 {
+		return 2
+	}
+
+	return w.proto
+}
+
+func (w ReplyWriter) resp3() bool {
+	return w.proto == 3
+}
+
+// appendHeader appends a type marker followed by a number and CRLF.
+func appendHeader(b []byte, kind byte, n int64) []byte {
+	b = append(b, kind)
+	b = strconv.AppendInt(b, n, 10)
+	return append(b, '\r', '\n')
+}
+
+// AppendSimpleString appends a status reply.
+func (w ReplyWriter) AppendSimpleString(b []byte, s string) []byte {
+	b = append(b, RespSimpleString)
+	b = append(b, s...)
+	return append(b, '\r', '\n')
+}
+
+// AppendError appends an error reply.
+func (w ReplyWriter) AppendError(b []byte, s string) []byte {
+	b = append(b, RespError)
+	b = append(b, s...)
+	return append(b, '\r', '\n')
+}
+
+// AppendInteger appends an integer reply.
+func (w ReplyWriter) AppendInteger(b []byte, n int) []byte {
+	return appendHeader(b, RespInteger, int64(n))
+}
+
+// AppendBulk appends a bulk string reply.
+func (w ReplyWriter) AppendBulk(b []byte, s string) []byte {
+	b = appendHeader(b, RespBulkString, int64(len(s)))
+	b = append(b, s...)
+	return append(b, '\r', '\n')
+}
+
+// AppendNull appends a missing value, a null bulk string in RESP2.
+func (w ReplyWriter) AppendNull(b []byte) []byte {
+	if w.resp3() {
+		return append(b, "_\r\n"...)
+	}
+
+	return append(b, "$-1\r\n"...)
+}
+
+// AppendNullArray appends a missing aggregate, a null array in RESP2.
+func (w ReplyWriter) AppendNullArray(b []byte) []byte {
+	if w.resp3() {
+		return append(b, "_\r\n"...)
+	}
+
+	return append(b, "*-1\r\n"...)
+}
+
+// AppendArray appends the header of an array of n elements.
+func (w ReplyWriter) AppendArray(b []byte, n int) []byte {
+	return appendHeader(b, RespArray, int64(n))
+}
+
+// AppendStringArray appends an array of bulk strings.
+func (w ReplyWriter) AppendStringArray(b []byte, arr []string) []byte {
+	b = w.AppendArray(b, len(arr))
+	for _, s := range arr {
+		b = w.AppendBulk(b, s)
+	}
+
+	return b
+}
+
+// AppendMap appends the header of a map of n key value pairs.
+// RESP2 clients get a flat array of 2*n elements.
+func (w ReplyWriter) AppendMap(b []byte, n int) []byte {
+	if w.resp3() {
+		return appendHeader(b, RespMap, int64(n))
+	}
+
+	return appendHeader(b, RespArray, int64(2*n))
+}
+
+// AppendSet appends the header of a set of n elements, an array in RESP2.
+func (w ReplyWriter) AppendSet(b []byte, n int) []byte {
+	if w.resp3() {
+		return appendHeader(b, RespSet, int64(n))
+	}
+
+	return appendHeader(b, RespArray, int64(n))
+}
+
+// AppendPush appends the header of an out of band push frame of n elements, an array in RESP2.
+func (w ReplyWriter) AppendPush(b []byte, n int) []byte {
+	if w.resp3() {
+		return appendHeader(b, RespPush, int64(n))
+	}
+
+	return appendHeader(b, RespArray, int64(n))
+}
+
+// AppendDouble appends a floating point number, a bulk string in RESP2.
+func (w ReplyWriter) AppendDouble(b []byte, f float64) []byte {
+	var buf [32]byte
+	var s []byte
+
+	switch {
+	case math.IsInf(f, 1):
+		s = append(buf[:0], "inf"...)
+	case math.IsInf(f, -1):
+		s = append(buf[:0], "-inf"...)
+	case math.IsNaN(f):
+		s = append(buf[:0], "nan"...)
+	default:
+		s = strconv.AppendFloat(buf[:0], f, 'g', -1, 64)
+	}
+
+	if w.resp3() {
+		b = append(b, RespDouble)
+	} else {
+		b = appendHeader(b, RespBulkString, int64(len(s)))
+	}
+
+	b = append(b, s...)
+	return append(b, '\r', '\n')
+}
+
+// AppendBool appends a boolean, the integers 1 and 0 in RESP2.
+func (w ReplyWriter) AppendBool(b []byte, v bool) []byte {
+	switch {
+	case w.resp3() && v:
+		return append(b, "#t\r\n"...)
+	case w.resp3():
+		return append(b, "#f\r\n"...)
+	case v:
+		return append(b, ":1\r\n"...)
+	default:
+		return append(b, ":0\r\n"...)
+	}
+}
+
+// AppendVerbatim appends a text with its three letters format, a bulk string in RESP2.
+func (w ReplyWriter) AppendVerbatim(b []byte, format string, s string) []byte {
+	if !w.resp3() {
+		return w.AppendBulk(b, s)
+	}
+
+	b = appendHeader(b, RespVerbatim, int64(len(s)+4))
+	b = append(b, format...)
+	b = append(b, ':')
+	b = append(b, s...)
+	return append(b, '\r', '\n')
+}
+
+// SimpleString encodes a status reply.
+func (w ReplyWriter) SimpleString(s string) string {
+	return string(w.AppendSimpleString(nil, s))
+}
+
+// Error encodes an error reply.
+func (w ReplyWriter) Error(s string) string {
+	return string(w.AppendError(nil, s))
+}
+
+// Integer encodes an integer reply.
+func (w ReplyWriter) Integer(n int) string {
+	return string(w.AppendInteger(nil, n))
+}
+
+// Bulk encodes a bulk string reply.
+func (w ReplyWriter) Bulk(s string) string {
+	return string(w.AppendBulk(nil, s))
+}
+
+// Null encodes a missing value, a null bulk string in RESP2.
+func (w ReplyWriter) Null() string {
+	return string(w.AppendNull(nil))
+}
+
+// NullArray encodes a missing aggregate, a null array in RESP2.
+func (w ReplyWriter) NullArray() string {
+	return string(w.AppendNullArray(nil))
+}
+
+// Array encodes the header of an array of n elements.
+func (w ReplyWriter) Array(n int) string {
+	return string(w.AppendArray(nil, n))
+}
+
+// StringArray encodes an array of bulk strings.
+func (w ReplyWriter) StringArray(arr []string) string {
+	return string(w.AppendStringArray(nil, arr))
+}
+
+// Map encodes the header of a map of n key value pairs.
+func (w ReplyWriter) Map(n int) string {
+	return string(w.AppendMap(nil, n))
+}
+
+// Set encodes the header of a set of n elements.
+func (w ReplyWriter) Set(n int) string {
+	return string(w.AppendSet(nil, n))
+}
+
+// Push encodes the header of a push frame of n elements.
+func (w ReplyWriter) Push(n int) string {
+	return string(w.AppendPush(nil, n))
+}
+
+// Double encodes a floating point number.
+func (w ReplyWriter) Double(f float64) string {
+	return string(w.AppendDouble(nil, f))
+}
+
+// Bool encodes a boolean.
+func (w ReplyWriter) Bool(v bool) string {
+	return string(w.AppendBool(nil, v))
+}
+
+// Verbatim encodes a text with its three letters format.
+func (w ReplyWriter) Verbatim(format string, s string) string {
+	return string(w.AppendVerbatim(nil, format, s))
+}
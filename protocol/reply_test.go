@@ -0,0 +1,129 @@
+package protocol
+
+import (
+	"math"
+	"testing"
+)
+
+func TestReplyWriter(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply func(w ReplyWriter) string
+		want2 string
+		want3 string
+	}{
+		{
+			name:  "Test null",
+			reply: func(w ReplyWriter) string { return w.Null() },
+			want2: "$-1\r\n",
+			want3: "_\r\n",
+		},
+		{
+			name:  "Test null array",
+			reply: func(w ReplyWriter) string { return w.NullArray() },
+			want2: "*-1\r\n",
+			want3: "_\r\n",
+		},
+		{
+			name:  "Test map",
+			reply: func(w ReplyWriter) string { return w.Map(1) + w.Bulk("k") + w.Integer(1) },
+			want2: "*2\r\n$1\r\nk\r\n:1\r\n",
+			want3: "%1\r\n$1\r\nk\r\n:1\r\n",
+		},
+		{
+			name:  "Test set",
+			reply: func(w ReplyWriter) string { return w.Set(1) + w.Bulk("a") },
+			want2: "*1\r\n$1\r\na\r\n",
+			want3: "~1\r\n$1\r\na\r\n",
+		},
+		{
+			name:  "Test push",
+			reply: func(w ReplyWriter) string { return w.Push(1) + w.Bulk("a") },
+			want2: "*1\r\n$1\r\na\r\n",
+			want3: ">1\r\n$1\r\na\r\n",
+		},
+		{
+			name:  "Test double",
+			reply: func(w ReplyWriter) string { return w.Double(1.5) },
+			want2: "$3\r\n1.5\r\n",
+			want3: ",1.5\r\n",
+		},
+		{
+			name:  "Test infinite double",
+			reply: func(w ReplyWriter) string { return w.Double(math.Inf(-1)) },
+			want2: "$4\r\n-inf\r\n",
+			want3: ",-inf\r\n",
+		},
+		{
+			name:  "Test bool",
+			reply: func(w ReplyWriter) string { return w.Bool(true) },
+			want2: ":1\r\n",
+			want3: "#t\r\n",
+		},
+		{
+			name:  "Test verbatim",
+			reply: func(w ReplyWriter) string { return w.Verbatim("txt", "hi") },
+			want2: "$2\r\nhi\r\n",
+			want3: "=6\r\ntxt:hi\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.reply(ReplyWriter{}); got != tt.want2 {
+				t.Errorf("RESP2 reply = %q, want %q", got, tt.want2)
+			}
+			if got := tt.reply(ReplyWriter{proto: 3}); got != tt.want3 {
+				t.Errorf("RESP3 reply = %q, want %q", got, tt.want3)
+			}
+		})
+	}
+}
+
+func Test_handleHello(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		want      string
+		wantProto int
+	}{
+		{
+			name:      "Test HELLO 3",
+			args:      []string{"3"},
+			want:      "%7\r\n$6\r\nserver\r\n$5\r\nredis\r\n$7\r\nversion\r\n$5\r\n7.2.0\r\n$5\r\nproto\r\n:3\r\n$2\r\nid\r\n:1\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n$4\r\nrole\r\n$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n",
+			wantProto: 3,
+		},
+		{
+			name:      "Test HELLO with unsupported version",
+			args:      []string{"4"},
+			want:      "-NOPROTO unsupported protocol version\r\n",
+			wantProto: 2,
+		},
+		{
+			name:      "Test HELLO with wrong user",
+			args:      []string{"3", "AUTH", "admin", "pass"},
+			want:      "-WRONGPASS invalid username-password pair or user is disabled.\r\n",
+			wantProto: 2,
+		},
+		{
+			name:      "Test HELLO with invalid name",
+			args:      []string{"3", "SETNAME", "a b"},
+			want:      "-ERR Client names cannot contain spaces, newlines or special characters.\r\n",
+			wantProto: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{id: 1, opts: Opts{Role: "master"}}
+			got, err := handleHello(s, tt.args)
+			if err != nil {
+				t.Fatalf("handleHello() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("handleHello() = %q, want %q", got, tt.want)
+			}
+			if s.w.Proto() != tt.wantProto {
+				t.Errorf("handleHello() proto = %v, want %v", s.w.Proto(), tt.wantProto)
+			}
+		})
+	}
+}
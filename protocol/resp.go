@@ -0,0 +1,394 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// RESP type markers
+const (
+	RespSimpleString byte = '+'
+	RespError        byte = '-'
+	RespInteger      byte = ':'
+	RespBulkString   byte = '$'
+	RespArray        byte = '*'
+	RespNull         byte = '_'
+	RespBoolean      byte = '#'
+	RespDouble       byte = ','
+	RespBigNumber    byte = '('
+	RespBulkError    byte = '!'
+	RespVerbatim     byte = '='
+	RespMap          byte = '%'
+	RespSet          byte = '~'
+	RespAttribute    byte = '|'
+	RespPush         byte = '>'
+)
+
+const (
+	maxBulkLength  = 512 * 1024 * 1024
+	maxArrayLength = 1024 * 1024 * 1024
+	maxNesting     = 64
+	maxLineLength  = 64 * 1024
+)
+
+// ProtocolError is returned when the peer sends something that isn't valid RESP.
+type ProtocolError string
+
+func (e ProtocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// RespValue represents a decoded RESP2 or RESP3 value.
+type RespValue struct {
+	Kind byte
+
+	// Str holds simple strings, errors, bulk strings, big numbers and verbatim strings
+	Str string
+	// Format holds the three letters format of verbatim strings
+	Format string
+	Int    int64
+	Float  float64
+	Bool   bool
+	// Null is set for RESP3 nulls as well as RESP2 null bulk strings and arrays
+	Null bool
+	// Elems holds the elements of arrays, sets and pushes.
+	// Maps are flattened as key, value, key, value...
+	Elems []RespValue
+}
+
+// RespReader decodes RESP values from a stream.
+type RespReader struct {
+	r *bufio.Reader
+	n int // bytes consumed since the last call to Consumed
+}
+
+// NewRespReader creates a new RespReader instance.
+func NewRespReader(r io.Reader) *RespReader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	return &RespReader{
+		r: br,
+	}
+}
+
+// Buffered returns the number of bytes received but not decoded yet.
+func (r *RespReader) Buffered() int {
+	return r.r.Buffered()
+}
+
+// Consumed returns the number of bytes decoded since the last call and resets the count.
+func (r *RespReader) Consumed() int {
+	n := r.n
+	r.n = 0
+	return n
+}
+
+// ReadCommand reads a request made of an array of bulk strings, or an inline
+// command made of space separated arguments, and returns it with the number of
+// bytes it took. Empty inline commands are returned as empty requests.
+func (r *RespReader) ReadCommand() (int, []string, error) {
+	r.Consumed()
+
+	b, err := r.r.Peek(1)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if b[0] != RespArray {
+		return r.readInline()
+	}
+
+	line, err := r.readLine()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(line) == 0 || line[0] != RespArray {
+		return 0, nil, ProtocolError(fmt.Sprintf("expected '*', got '%s'", printable(line)))
+	}
+
+	n, err := parseLength(line[1:], maxArrayLength)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	request := make([]string, 0, min(max(n, 0), 1024))
+	for i := 0; i < n; i++ {
+		line, err := r.readLine()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if len(line) == 0 || line[0] != RespBulkString {
+			return 0, nil, ProtocolError(fmt.Sprintf("expected '$', got '%s'", printable(line)))
+		}
+
+		length, err := parseLength(line[1:], maxBulkLength)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if length < 0 {
+			return 0, nil, ProtocolError("invalid bulk length")
+		}
+
+		b, err := r.readBulk(length)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		request = append(request, string(b))
+	}
+
+	return r.Consumed(), request, nil
+}
+
+// readInline reads an inline command terminated by LF or CRLF.
+func (r *RespReader) readInline() (int, []string, error) {
+	line, err := r.readRawLine()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+
+	request, err := SplitArgs(string(line))
+	if err != nil {
+		return 0, nil, ProtocolError(err.Error())
+	}
+
+	return r.Consumed(), request, nil
+}
+
+// ReadValue reads the next RESP value.
+func (r *RespReader) ReadValue() (RespValue, error) {
+	return r.readValue(0)
+}
+
+// ReadRDB reads an RDB payload sent during a full resynchronization:
+// a bulk string header followed by the file content without trailing CRLF.
+func (r *RespReader) ReadRDB() ([]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 || line[0] != RespBulkString {
+		return nil, ProtocolError(fmt.Sprintf("expected '$', got '%s'", printable(line)))
+	}
+
+	length, err := parseLength(line[1:], math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+
+	if length < 0 {
+		return nil, ProtocolError("invalid RDB length")
+	}
+
+	payload := make([]byte, length)
+	n, err := io.ReadFull(r.r, payload)
+	r.n += n
+	if err != nil {
+		return nil, fmt.Errorf("ReadFull failed: %w", err)
+	}
+
+	return payload, nil
+}
+
+func (r *RespReader) readValue(depth int) (RespValue, error) {
+	if depth > maxNesting {
+		return RespValue{}, ProtocolError("too many nested aggregates")
+	}
+
+	line, err := r.readLine()
+	if err != nil {
+		return RespValue{}, err
+	}
+
+	if len(line) == 0 {
+		return RespValue{}, ProtocolError("empty line")
+	}
+
+	v := RespValue{Kind: line[0]}
+	payload := line[1:]
+
+	switch v.Kind {
+	case RespSimpleString, RespError, RespBigNumber:
+		v.Str = string(payload)
+	case RespInteger:
+		v.Int, err = strconv.ParseInt(string(payload), 10, 64)
+		if err != nil {
+			return RespValue{}, ProtocolError(fmt.Sprintf("invalid integer '%s'", printable(payload)))
+		}
+	case RespNull:
+		v.Null = true
+	case RespBoolean:
+		switch string(payload) {
+		case "t":
+			v.Bool = true
+		case "f":
+			v.Bool = false
+		default:
+			return RespValue{}, ProtocolError(fmt.Sprintf("invalid boolean '%s'", printable(payload)))
+		}
+	case RespDouble:
+		switch string(payload) {
+		case "inf":
+			v.Float = math.Inf(1)
+		case "-inf":
+			v.Float = math.Inf(-1)
+		default:
+			v.Float, err = strconv.ParseFloat(string(payload), 64)
+			if err != nil {
+				return RespValue{}, ProtocolError(fmt.Sprintf("invalid double '%s'", printable(payload)))
+			}
+		}
+	case RespBulkString, RespBulkError, RespVerbatim:
+		length, err := parseLength(payload, maxBulkLength)
+		if err != nil {
+			return RespValue{}, err
+		}
+
+		if length < 0 {
+			v.Null = true
+			break
+		}
+
+		b, err := r.readBulk(length)
+		if err != nil {
+			return RespValue{}, err
+		}
+
+		if v.Kind == RespVerbatim {
+			if len(b) < 4 || b[3] != ':' {
+				return RespValue{}, ProtocolError("invalid verbatim string")
+			}
+
+			v.Format = string(b[:3])
+			b = b[4:]
+		}
+
+		v.Str = string(b)
+	case RespArray, RespSet, RespPush, RespMap, RespAttribute:
+		n, err := parseLength(payload, maxArrayLength)
+		if err != nil {
+			return RespValue{}, err
+		}
+
+		if n < 0 {
+			v.Null = true
+			break
+		}
+
+		if v.Kind == RespMap || v.Kind == RespAttribute {
+			n *= 2
+		}
+
+		v.Elems = make([]RespValue, 0, min(n, 1024))
+		for i := 0; i < n; i++ {
+			elem, err := r.readValue(depth + 1)
+			if err != nil {
+				return RespValue{}, err
+			}
+
+			v.Elems = append(v.Elems, elem)
+		}
+
+		// attributes are out of band information about the value that follows
+		if v.Kind == RespAttribute {
+			return r.readValue(depth)
+		}
+	default:
+		return RespValue{}, ProtocolError(fmt.Sprintf("unknown type '%c'", v.Kind))
+	}
+
+	return v, nil
+}
+
+// readLine returns the next CRLF terminated line without the CRLF.
+// The returned slice is only valid until the next read.
+func (r *RespReader) readLine() ([]byte, error) {
+	line, err := r.readRawLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, ProtocolError("line not terminated by CRLF")
+	}
+
+	return line[:len(line)-2], nil
+}
+
+// readRawLine returns the next line including its LF.
+func (r *RespReader) readRawLine() ([]byte, error) {
+	line, err := r.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		buf := append([]byte(nil), line...)
+		for errors.Is(err, bufio.ErrBufferFull) && len(buf) <= maxLineLength {
+			line, err = r.r.ReadSlice('\n')
+			buf = append(buf, line...)
+		}
+
+		line = buf
+	}
+
+	r.n += len(line)
+	if err != nil {
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, ProtocolError("too big line")
+		}
+
+		return nil, err
+	}
+
+	return line, nil
+}
+
+// readBulk reads exactly length bytes followed by CRLF.
+func (r *RespReader) readBulk(length int) ([]byte, error) {
+	b := make([]byte, length+2)
+
+	n, err := io.ReadFull(r.r, b)
+	r.n += n
+	if err != nil {
+		return nil, err
+	}
+
+	if b[length] != '\r' || b[length+1] != '\n' {
+		return nil, ProtocolError("bulk string not terminated by CRLF")
+	}
+
+	return b[:length], nil
+}
+
+// parseLength parses the length of a bulk string or aggregate, -1 meaning null.
+func parseLength(b []byte, limit int) (int, error) {
+	n, err := strconv.Atoi(string(b))
+	if err != nil || n < -1 || n > limit {
+		return 0, ProtocolError(fmt.Sprintf("invalid length '%s'", printable(b)))
+	}
+
+	return n, nil
+}
+
+// printable quotes the given bytes for error messages.
+func printable(b []byte) string {
+	if len(b) > 32 {
+		b = b[:32]
+	}
+
+	q := strconv.Quote(string(b))
+	return q[1 : len(q)-1]
+}
@@ -0,0 +1,222 @@
+package protocol
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRespReader_ReadCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantN   int
+		wantErr bool
+	}{
+		{
+			name:  "Test ReadCommand 1",
+			input: "*2\r\n$4\r\nECHO\r\n$3\r\nhey\r\n",
+			want:  []string{"ECHO", "hey"},
+			wantN: 23,
+		},
+		{
+			name:  "Test ReadCommand with CRLF inside a bulk string",
+			input: "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$8\r\na\r\nb\nc\r\n\r\n",
+			want:  []string{"SET", "k", "a\r\nb\nc\r\n"},
+			wantN: 34,
+		},
+		{
+			name:  "Test ReadCommand with empty bulk string",
+			input: "*2\r\n$4\r\nECHO\r\n$0\r\n\r\n",
+			want:  []string{"ECHO", ""},
+			wantN: 20,
+		},
+		{
+			name:  "Test ReadCommand with inline command",
+			input: "SET k \"a b\"\n",
+			want:  []string{"SET", "k", "a b"},
+			wantN: 12,
+		},
+		{
+			name:  "Test ReadCommand with CRLF terminated inline command",
+			input: "PING\r\n",
+			want:  []string{"PING"},
+			wantN: 6,
+		},
+		{
+			name:  "Test ReadCommand with empty inline command",
+			input: "\r\n",
+			want:  []string{},
+			wantN: 2,
+		},
+		{
+			name:    "Test ReadCommand with unbalanced quotes",
+			input:   "SET k \"a\n",
+			wantErr: true,
+		},
+		{
+			name:    "Test ReadCommand with wrong bulk length",
+			input:   "*1\r\n$3\r\nPING\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "Test ReadCommand with integer element",
+			input:   "*1\r\n:3\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "Test ReadCommand with truncated request",
+			input:   "*2\r\n$4\r\nECHO\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "Test ReadCommand with huge array length",
+			input:   "*1000000000\r\n$4\r\nPING\r\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRespReader(strings.NewReader(tt.input))
+			n, got, err := r.ReadCommand()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ReadCommand() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) && !tt.wantErr {
+				t.Errorf("ReadCommand() = %q, want %q", got, tt.want)
+			}
+			if n != tt.wantN {
+				t.Errorf("ReadCommand() n = %v, want %v", n, tt.wantN)
+			}
+		})
+	}
+}
+
+func TestRespReader_ReadValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    RespValue
+		wantErr bool
+	}{
+		{
+			name:  "Test simple string",
+			input: "+OK\r\n",
+			want:  RespValue{Kind: RespSimpleString, Str: "OK"},
+		},
+		{
+			name:  "Test error",
+			input: "-ERR unknown\r\n",
+			want:  RespValue{Kind: RespError, Str: "ERR unknown"},
+		},
+		{
+			name:  "Test integer",
+			input: ":-42\r\n",
+			want:  RespValue{Kind: RespInteger, Int: -42},
+		},
+		{
+			name:  "Test null bulk string",
+			input: "$-1\r\n",
+			want:  RespValue{Kind: RespBulkString, Null: true},
+		},
+		{
+			name:  "Test null",
+			input: "_\r\n",
+			want:  RespValue{Kind: RespNull, Null: true},
+		},
+		{
+			name:  "Test boolean",
+			input: "#t\r\n",
+			want:  RespValue{Kind: RespBoolean, Bool: true},
+		},
+		{
+			name:  "Test double",
+			input: ",-inf\r\n",
+			want:  RespValue{Kind: RespDouble, Float: math.Inf(-1)},
+		},
+		{
+			name:  "Test big number",
+			input: "(3492890328409238509324850943850943825024385\r\n",
+			want:  RespValue{Kind: RespBigNumber, Str: "3492890328409238509324850943850943825024385"},
+		},
+		{
+			name:  "Test verbatim string",
+			input: "=15\r\ntxt:Some string\r\n",
+			want:  RespValue{Kind: RespVerbatim, Format: "txt", Str: "Some string"},
+		},
+		{
+			name:  "Test nested array",
+			input: "*2\r\n*1\r\n:1\r\n$2\r\n\r\n\r\n",
+			want: RespValue{Kind: RespArray, Elems: []RespValue{
+				{Kind: RespArray, Elems: []RespValue{{Kind: RespInteger, Int: 1}}},
+				{Kind: RespBulkString, Str: "\r\n"},
+			}},
+		},
+		{
+			name:  "Test map",
+			input: "%1\r\n+key\r\n#f\r\n",
+			want: RespValue{Kind: RespMap, Elems: []RespValue{
+				{Kind: RespSimpleString, Str: "key"},
+				{Kind: RespBoolean, Bool: false},
+			}},
+		},
+		{
+			name:  "Test set with attribute",
+			input: "|1\r\n+ttl\r\n:3\r\n~1\r\n+a\r\n",
+			want: RespValue{Kind: RespSet, Elems: []RespValue{
+				{Kind: RespSimpleString, Str: "a"},
+			}},
+		},
+		{
+			name:  "Test push",
+			input: ">2\r\n+message\r\n$2\r\nhi\r\n",
+			want: RespValue{Kind: RespPush, Elems: []RespValue{
+				{Kind: RespSimpleString, Str: "message"},
+				{Kind: RespBulkString, Str: "hi"},
+			}},
+		},
+		{
+			name:    "Test unknown type",
+			input:   "?\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "Test line without CR",
+			input:   "+OK\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRespReader(strings.NewReader(tt.input))
+			got, err := r.ReadValue()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ReadValue() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadValue() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRespReader_ReadRDB(t *testing.T) {
+	r := NewRespReader(strings.NewReader("$5\r\nREDIS*1\r\n$4\r\nPING\r\n"))
+
+	got, err := r.ReadRDB()
+	if err != nil {
+		t.Fatalf("ReadRDB() error = %v", err)
+	}
+	if string(got) != "REDIS" {
+		t.Errorf("ReadRDB() = %q, want %q", got, "REDIS")
+	}
+
+	_, request, err := r.ReadCommand()
+	if err != nil || !reflect.DeepEqual(request, []string{"PING"}) {
+		t.Errorf("ReadCommand() after ReadRDB() = %q, %v", request, err)
+	}
+}
@@ -3,34 +3,397 @@ package protocol
 import (
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 var list = NewSlaves()
 
+// noReplID is shown in place of the secondary replication ID when there is none.
+const noReplID = "0000000000000000000000000000000000000000"
+
 // Slaves store secondary connections
 type Slaves struct {
-	list map[string]*Connection
-	lock sync.RWMutex
+	list   map[string]*Slave
+	offset int // number of bytes propagated so far
+	db     int // database selected by the commands propagated, -1 before the first one
+	acked  chan struct{}
+	lock   sync.RWMutex
+
+	// ID of the history of the dataset, and the ID of the previous history
+	// it continues, valid up to secondOffset
+	replID       string
+	replID2      string
+	secondOffset int
+
+	backlog     *Backlog // nil until a slave attaches
+	backlogSize int
+	backlogTTL  time.Duration // 0 keeps the backlog without slaves forever
+	lastSlave   time.Time     // time the last slave was removed
+	slave       bool          // set while the server replicates a master
+
+	limit OutputBufferLimit
+}
+
+// Slave is a replica attached to the master. The commands propagated to it
+// are queued and written by its own goroutine, so that a slow slave holds
+// back neither the clients nor the other slaves.
+type Slave struct {
+	c      *Connection
+	offset int // replication offset acknowledged by the replica
+
+	lock      sync.Mutex
+	queue     []byte        // commands propagated and not written yet
+	pending   int           // bytes queued or being written
+	online    bool          // set once the snapshot of the full resynchronization is sent
+	closed    bool          // set once the slave is removed
+	wake      chan struct{} // signaled when commands are queued to an online slave
+	softSince time.Time     // time the output went past the soft limit, zero if it isn't
+}
+
+// OutputBufferLimit is the limit of the output of a client: it is
+// disconnected once its output reaches the hard limit, or stays past the
+// soft limit for the soft time. 0 disables a limit.
+type OutputBufferLimit struct {
+	hard     int64
+	soft     int64
+	softTime time.Duration
 }
 
 // NewSlaves is the Repls constructor
 func NewSlaves() *Slaves {
 	return &Slaves{
-		list: make(map[string]*Connection),
-		lock: sync.RWMutex{},
+		list:         make(map[string]*Slave),
+		db:           -1,
+		acked:        make(chan struct{}),
+		lock:         sync.RWMutex{},
+		replID:       generateReplid(),
+		secondOffset: -1,
+		backlogSize:  1 << 20,
+		backlogTTL:   time.Hour,
+		limit:        OutputBufferLimit{hard: 256 << 20, soft: 64 << 20, softTime: time.Minute},
+	}
+}
+
+// ConfigureReplication applies the replication options.
+func ConfigureReplication(o Opts) error {
+	size, err := parseMemory(o.ReplBacklogSize)
+	if err != nil {
+		return fmt.Errorf("parseMemory failed: %v", err)
+	}
+
+	if size < 1 {
+		return fmt.Errorf("invalid backlog size: %q", o.ReplBacklogSize)
+	}
+
+	if o.ReplBacklogTTL < 0 {
+		return fmt.Errorf("invalid backlog TTL: %d", o.ReplBacklogTTL)
+	}
+
+	if o.ReplPingReplicaPeriod < 1 {
+		return fmt.Errorf("invalid ping period: %d", o.ReplPingReplicaPeriod)
+	}
+
+	if o.ReplTimeout < 1 {
+		return fmt.Errorf("invalid replication timeout: %d", o.ReplTimeout)
+	}
+
+	limit := list.limit
+	for _, l := range o.ClientOutputBufferLimit {
+		if limit, err = parseOutputBufferLimit(l); err != nil {
+			return fmt.Errorf("parseOutputBufferLimit failed: %v", err)
+		}
+	}
+
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	list.replID = o.ReplID
+	list.backlogSize = int(size)
+	list.backlogTTL = time.Duration(o.ReplBacklogTTL) * time.Second
+	list.limit = limit
+
+	go func() {
+		for range time.Tick(time.Duration(o.ReplPingReplicaPeriod) * time.Second) {
+			// a slave doesn't alter the stream of its master
+			if !link.isSlave() {
+				list.pingSlaves()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// pingSlaves propagates a PING to the slaves so they know the link is alive
+// while no write is made.
+func (s *Slaves) pingSlaves() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.list) > 0 {
+		s.propagate(ToRespArray([]string{"PING"}))
+	}
+}
+
+// parseOutputBufferLimit parses a limit given as "<class> <hard> <soft> <soft seconds>".
+// Only the output of the slaves is limited.
+func parseOutputBufferLimit(s string) (OutputBufferLimit, error) {
+	args := strings.Fields(s)
+	if len(args) != 4 {
+		return OutputBufferLimit{}, fmt.Errorf("limits must be given as <class> <hard> <soft> <soft seconds>: %q", s)
+	}
+
+	if class := strings.ToLower(args[0]); class != "replica" && class != "slave" {
+		return OutputBufferLimit{}, fmt.Errorf("unsupported client class: %q", args[0])
+	}
+
+	hard, err := parseMemory(args[1])
+	if err != nil {
+		return OutputBufferLimit{}, fmt.Errorf("invalid hard limit: %v", err)
+	}
+
+	soft, err := parseMemory(args[2])
+	if err != nil {
+		return OutputBufferLimit{}, fmt.Errorf("invalid soft limit: %v", err)
+	}
+
+	seconds, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil || seconds < 0 {
+		return OutputBufferLimit{}, fmt.Errorf("invalid soft seconds: %q", args[3])
+	}
+
+	return OutputBufferLimit{hard: hard, soft: soft, softTime: time.Duration(seconds) * time.Second}, nil
+}
+
+// exceeded reports whether an output of the given size is past the limit.
+// since is the time the output went past the soft limit, updated by the call.
+func (l OutputBufferLimit) exceeded(size int64, since *time.Time, now time.Time) bool {
+	if l.hard > 0 && size >= l.hard {
+		return true
+	}
+
+	if l.soft == 0 || size < l.soft {
+		*since = time.Time{}
+		return false
+	}
+
+	if since.IsZero() {
+		*since = now
+	}
+
+	return now.Sub(*since) >= l.softTime
+}
+
+// newSlave creates a slave writing the commands queued once it is online.
+func newSlave(c *Connection, offset int) *Slave {
+	slave := &Slave{
+		c:      c,
+		offset: offset,
+		wake:   make(chan struct{}, 1),
+	}
+
+	go slave.run()
+
+	return slave
+}
+
+// run writes the queued commands to the slave until it is closed.
+func (sl *Slave) run() {
+	for range sl.wake {
+		sl.lock.Lock()
+		out := sl.queue
+		sl.queue = nil
+		sl.lock.Unlock()
+
+		if len(out) == 0 {
+			continue
+		}
+
+		if err := sl.c.Write(string(out)); err != nil {
+			sl.lock.Lock()
+			closed := sl.closed
+			sl.lock.Unlock()
+
+			// the connection is closed for its client to remove the slave
+			if !closed {
+				fmt.Printf("Writing to slave %s failed: %v\n", sl.c.conn.RemoteAddr(), err)
+				sl.c.Close()
+			}
+			return
+		}
+
+		sl.lock.Lock()
+		sl.pending -= len(out)
+		sl.lock.Unlock()
+	}
+}
+
+// enqueue queues the command to write to the slave. It reports false if
+// the output of the slave is past the limit, the slave having to be removed.
+func (sl *Slave) enqueue(cmd string, limit OutputBufferLimit, now time.Time) bool {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+
+	if sl.closed {
+		return true
+	}
+
+	sl.queue = append(sl.queue, cmd...)
+	sl.pending += len(cmd)
+	if sl.online {
+		sl.signal()
+	}
+
+	return !limit.exceeded(int64(sl.pending), &sl.softSince, now)
+}
+
+// setOnline starts writing the commands queued to the slave.
+func (sl *Slave) setOnline() {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+
+	sl.online = true
+	if !sl.closed {
+		sl.signal()
+	}
+}
+
+// signal wakes the goroutine writing to the slave up, if it isn't about to wake up already.
+// The caller must hold the lock of the slave.
+func (sl *Slave) signal() {
+	select {
+	case sl.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close stops the writes to the slave and closes its connection.
+func (sl *Slave) close() {
+	sl.lock.Lock()
+	if !sl.closed {
+		sl.closed = true
+		sl.queue = nil
+		close(sl.wake)
+	}
+	sl.lock.Unlock()
+
+	sl.c.Close()
+}
+
+// AddSlave adds a new slave to the internal map and returns the replication
+// offset it starts from, the one of the snapshot of the dataset taken with
+// the locks held. The commands propagated to it are kept until SlaveOnline,
+// once it received that snapshot.
+func (s *Slaves) AddSlave(slaveAddr net.Addr, conn *Connection) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.backlog == nil {
+		s.backlog = newBacklog(s.backlogSize, s.offset)
+	}
+
+	s.list[slaveAddr.String()] = newSlave(conn, s.offset)
+
+	// the snapshot doesn't tell which database the next commands run against
+	s.db = -1
+
+	return s.offset
+}
+
+// PartialSync resumes the replication of a slave holding the dataset up to
+// the given offset of the given history: the commands it missed are sent from
+// the backlog. It reports false if they aren't all held anymore, the slave
+// needing a full resynchronization then.
+func (s *Slaves) PartialSync(slaveAddr net.Addr, conn *Connection, replID string, offset int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.expireBacklog(time.Now())
+
+	if s.backlog == nil || replID == "" {
+		return false
+	}
+
+	if replID != s.replID && (replID != s.replID2 || offset > s.secondOffset) {
+		return false
+	}
+
+	missed, ok := s.backlog.since(offset)
+	if !ok {
+		return false
+	}
+
+	slave := newSlave(conn, offset)
+	s.list[slaveAddr.String()] = slave
+
+	slave.enqueue(fmt.Sprintf("+CONTINUE %s\r\n", s.replID)+missed, OutputBufferLimit{}, time.Now())
+	slave.setOnline()
+
+	return true
+}
+
+// SlaveOnline starts writing to the slave the commands propagated since it was added.
+func (s *Slaves) SlaveOnline(slaveAddr net.Addr) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	slave, ok := s.list[slaveAddr.String()]
+	if !ok {
+		return fmt.Errorf("couldn't find slave: %s", slaveAddr.String())
 	}
+
+	slave.setOnline()
+
+	return nil
 }
 
-// AddSlave adds a new slave to the internal map.
-func (s *Slaves) AddSlave(slaveAddr net.Addr, conn *Connection) {
+// RemoveSlave removes the slave from the internal map, if the connection is still the one of that slave.
+func (s *Slaves) RemoveSlave(slaveAddr net.Addr, conn *Connection) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	s.list[slaveAddr.String()] = conn
+	slave, ok := s.list[slaveAddr.String()]
+	if !ok || slave.c != conn {
+		return
+	}
+
+	s.remove(slaveAddr.String())
+}
+
+// remove closes the slave and removes it from the internal map.
+// The caller must hold the lock.
+func (s *Slaves) remove(key string) {
+	s.list[key].close()
+	delete(s.list, key)
+
+	if len(s.list) == 0 {
+		s.lastSlave = time.Now()
+	}
+}
+
+// expireBacklog frees the backlog once no slave was attached for its TTL.
+// The history of the dataset starts over, as the writes made from then on
+// can't be sent to a slave that would resume the replication.
+func (s *Slaves) expireBacklog(now time.Time) {
+	// a slave keeps the history of its master to resume the replication from it
+	if s.slave || s.lastSlave.IsZero() {
+		return
+	}
+
+	if s.backlog == nil || len(s.list) > 0 || s.backlogTTL == 0 || now.Sub(s.lastSlave) < s.backlogTTL {
+		return
+	}
+
+	s.backlog = nil
+	s.replID = generateReplid()
+	s.replID2 = ""
+	s.secondOffset = -1
 }
 
-// Ack updates the slave offset
+// Ack updates the slave offset and wakes up the clients waiting for acknowledgements
 func (s *Slaves) Ack(slaveAddr net.Addr, ack int) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -41,33 +404,84 @@ func (s *Slaves) Ack(slaveAddr net.Addr, ack int) error {
 	}
 
 	slave.offset = ack
+
+	close(s.acked)
+	s.acked = make(chan struct{})
+
 	return nil
 }
 
-// Propagate propagates the given write command to every slave
-func (s *Slaves) Propagate(cmd string) error {
+// AckNotify returns a channel closed on the next acknowledgement from any slave
+func (s *Slaves) AckNotify() <-chan struct{} {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	for _, s := range s.list {
-		if err := s.Write(cmd); err != nil {
-			return fmt.Errorf("propagation write failed: %w", err)
+	return s.acked
+}
+
+// Propagate propagates the given write command to every slave.
+// The exclusive lock keeps concurrent commands from interleaving on the slave connections.
+func (s *Slaves) Propagate(cmd string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.propagate(cmd)
+}
+
+// PropagateCommands propagates the given write commands to every slave, each
+// selecting the database it ran against.
+func (s *Slaves) PropagateCommands(ops []op) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var cmd string
+	for _, o := range ops {
+		if o.db != s.db {
+			cmd += ToRespArray([]string{"SELECT", strconv.Itoa(o.db)})
+			s.db = o.db
 		}
+		cmd += ToRespArray(o.request)
 	}
 
-	return nil
+	s.propagate(cmd)
 }
 
-// NotSyncedSlaveCount returns the number of slaves that are not synced with the given master status.
-func (s *Slaves) NotSyncedSlaveCount(masterOffset int) int {
+// propagate queues the command to every slave, removing the slaves too far behind.
+// The caller must hold the lock.
+func (s *Slaves) propagate(cmd string) {
+	now := time.Now()
+	s.expireBacklog(now)
+
+	s.offset += len(cmd)
+	if s.backlog != nil {
+		s.backlog.write(cmd)
+	}
+
+	for key, slave := range s.list {
+		if !slave.enqueue(cmd, s.limit, now) {
+			fmt.Printf("Disconnecting slave %s for overcoming the output buffer limits\n", key)
+			s.remove(key)
+		}
+	}
+}
+
+// Offset returns the number of bytes propagated to the slaves so far
+func (s *Slaves) Offset() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.offset
+}
+
+// SyncedSlaveCount returns the number of slaves that acknowledged at least the given offset.
+func (s *Slaves) SyncedSlaveCount(masterOffset int) int {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
 	ret := 0
 
 	for _, s := range s.list {
-		fmt.Println("s.offset = ", s.offset)
-		if s.offset != masterOffset {
+		if s.offset >= masterOffset {
 			ret++
 		}
 	}
@@ -82,3 +496,137 @@ func (s *Slaves) Count() int {
 
 	return len(s.list)
 }
+
+// ReplID returns the replication ID of the dataset.
+func (s *Slaves) ReplID() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.replID
+}
+
+// Replication returns the replication ID and offset a slave resumes the
+// replication from, no ID if it never synchronized with its master.
+func (s *Slaves) Replication() (string, int) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.replID, s.offset
+}
+
+// SetReplication records the replication ID and offset of the snapshot
+// received from master, the dataset starting a new history. The slaves
+// still attached are disconnected as they hold the previous one.
+func (s *Slaves) SetReplication(replID string, offset int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key := range s.list {
+		s.remove(key)
+	}
+
+	s.slave = true
+	s.replID = replID
+	s.replID2 = ""
+	s.secondOffset = -1
+	s.offset = offset
+	s.backlog = nil
+}
+
+// ChangeReplID switches to the new replication ID of master, the current one
+// staying valid up to the given offset.
+func (s *Slaves) ChangeReplID(replID string, offset int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.replID2 = s.replID
+	s.secondOffset = offset
+	s.replID = replID
+}
+
+// Promote starts a new history of the dataset as a master. The slaves of the
+// previous master can still resume their replication from the history it
+// continues, up to the current offset.
+func (s *Slaves) Promote() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// commands of a transaction received in part were never applied
+	if s.backlog != nil && s.backlog.end != s.offset {
+		s.backlog = nil
+	}
+
+	if s.replID != "" {
+		s.replID2 = s.replID
+		s.secondOffset = s.offset
+	}
+	s.replID = generateReplid()
+	s.slave = false
+
+	// the next command propagated selects its database
+	s.db = -1
+	s.lastSlave = time.Now()
+}
+
+// Feed adds the commands streamed by master to the backlog, so that the
+// slaves of the previous master can resume their replication from this
+// server once it is promoted.
+func (s *Slaves) Feed(cmd string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.backlog == nil {
+		s.backlog = newBacklog(s.backlogSize, s.offset)
+	}
+
+	s.backlog.write(cmd)
+}
+
+// Demote records that the server replicates a master, and disconnects every slave.
+func (s *Slaves) Demote() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.slave = true
+	for key := range s.list {
+		s.remove(key)
+	}
+}
+
+// SetOffset records the replication offset of the last command a slave
+// applied from its master.
+func (s *Slaves) SetOffset(offset int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.offset = offset
+}
+
+// info returns the fields of the replication section of the INFO command following the role.
+func (s *Slaves) info() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	replID2 := s.replID2
+	if replID2 == "" {
+		replID2 = noReplID
+	}
+
+	var active, first, histlen int
+	if s.backlog != nil {
+		active = 1
+		first = s.backlog.first() + 1
+		histlen = s.backlog.histlen
+	}
+
+	return fmt.Sprintf("connected_slaves:%d\r\n"+
+		"master_replid:%s\r\n"+
+		"master_replid2:%s\r\n"+
+		"master_repl_offset:%d\r\n"+
+		"second_repl_offset:%d\r\n"+
+		"repl_backlog_active:%d\r\n"+
+		"repl_backlog_size:%d\r\n"+
+		"repl_backlog_first_byte_offset:%d\r\n"+
+		"repl_backlog_histlen:%d\r\n",
+		len(s.list), s.replID, replID2, s.offset, s.secondOffset, active, s.backlogSize, first, histlen)
+}
@@ -0,0 +1,538 @@
+package protocol
+
+import (
+	"bytes"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bufferConn records the writes made to the connection.
+type bufferConn struct {
+	net.Conn
+	buf *bytes.Buffer
+}
+
+func (c bufferConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
+
+func (c bufferConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6380}
+}
+
+func (c bufferConn) Close() error {
+	return nil
+}
+
+// stalledConn is a slave that never reads what is written to it.
+type stalledConn struct {
+	bufferConn
+	closed chan struct{}
+}
+
+func (c stalledConn) Write(b []byte) (int, error) {
+	<-c.closed
+	return 0, net.ErrClosed
+}
+
+func (c stalledConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+// waitWritten waits for the commands queued to the slave to be written.
+func waitWritten(t *testing.T, s *Slaves, addr net.Addr) {
+	t.Helper()
+
+	s.lock.RLock()
+	slave, ok := s.list[addr.String()]
+	s.lock.RUnlock()
+	if !ok {
+		return
+	}
+
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		slave.lock.Lock()
+		pending := slave.pending
+		slave.lock.Unlock()
+
+		if pending == 0 {
+			return
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("slave %s still has %d bytes to write", addr, pending)
+		}
+	}
+}
+
+func TestSlaves_PartialSync(t *testing.T) {
+	tests := []struct {
+		name      string
+		replID    string
+		offset    int
+		backlog   bool
+		expired   bool
+		wantOK    bool
+		wantReply string
+	}{
+		{
+			name:      "Test partial sync",
+			replID:    "replid",
+			offset:    4,
+			backlog:   true,
+			wantOK:    true,
+			wantReply: "+CONTINUE replid\r\nefghij",
+		},
+		{
+			name:      "Test partial sync up to date",
+			replID:    "replid",
+			offset:    10,
+			backlog:   true,
+			wantOK:    true,
+			wantReply: "+CONTINUE replid\r\n",
+		},
+		{
+			name:      "Test partial sync with previous ID",
+			replID:    "oldid",
+			offset:    5,
+			backlog:   true,
+			wantOK:    true,
+			wantReply: "+CONTINUE replid\r\nfghij",
+		},
+		{
+			name:    "Test partial sync with previous ID after its end",
+			replID:  "oldid",
+			offset:  7,
+			backlog: true,
+		},
+		{
+			name:    "Test partial sync with unknown ID",
+			replID:  "other",
+			offset:  4,
+			backlog: true,
+		},
+		{
+			name:    "Test partial sync out of the backlog",
+			replID:  "replid",
+			offset:  1,
+			backlog: true,
+		},
+		{
+			name:   "Test partial sync without backlog",
+			replID: "replid",
+			offset: 10,
+		},
+		{
+			name:    "Test partial sync with expired backlog",
+			replID:  "replid",
+			offset:  10,
+			backlog: true,
+			expired: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSlaves()
+			s.replID = "replid"
+			s.replID2 = "oldid"
+			s.secondOffset = 6
+			s.backlogSize = 8
+			s.offset = 10
+			s.lastSlave = time.Now()
+
+			if tt.backlog {
+				s.backlog = newBacklog(s.backlogSize, 0)
+				s.backlog.write("abcdefghij")
+			}
+
+			if tt.expired {
+				s.lastSlave = time.Now().Add(-2 * s.backlogTTL)
+			}
+
+			var buf bytes.Buffer
+			conn := NewConnection(bufferConn{buf: &buf})
+
+			ok := s.PartialSync(conn.conn.RemoteAddr(), conn, tt.replID, tt.offset)
+			waitWritten(t, s, conn.conn.RemoteAddr())
+			if ok != tt.wantOK {
+				t.Errorf("PartialSync() = %v, want %v", ok, tt.wantOK)
+			}
+			if buf.String() != tt.wantReply {
+				t.Errorf("PartialSync() reply = %q, want %q", buf.String(), tt.wantReply)
+			}
+			if s.Count() != boolInt(tt.wantOK) {
+				t.Errorf("PartialSync() slaves = %d, want %d", s.Count(), boolInt(tt.wantOK))
+			}
+
+			if tt.expired && (s.backlog != nil || s.replID == "replid") {
+				t.Errorf("PartialSync() kept the expired backlog and its history")
+			}
+		})
+	}
+}
+
+func TestServer_propagate(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests [][]string
+		want     string // regular expression
+	}{
+		{
+			name:     "Test propagate write",
+			requests: [][]string{{"INCR", "a"}, {"GET", "a"}},
+			want:     `^\*2\r\n\$6\r\nSELECT\r\n\$1\r\n0\r\n\*2\r\n\$4\r\nINCR\r\n\$1\r\na\r\n$`,
+		},
+		{
+			name:     "Test propagate relative expiry as absolute",
+			requests: [][]string{{"SET", "a", "1", "EX", "100"}},
+			want:     `^\*2\r\n\$6\r\nSELECT\r\n\$1\r\n0\r\n\*5\r\n\$3\r\nSET\r\n\$1\r\na\r\n\$1\r\n1\r\n\$4\r\nPXAT\r\n\$13\r\n\d{13}\r\n$`,
+		},
+		{
+			name:     "Test propagate generated stream ID",
+			requests: [][]string{{"XADD", "s", "*", "f", "v"}},
+			want:     `^\*2\r\n\$6\r\nSELECT\r\n\$1\r\n0\r\n\*5\r\n\$4\r\nXADD\r\n\$1\r\ns\r\n\$15\r\n\d{13}-0\r\n\$1\r\nf\r\n\$1\r\nv\r\n$`,
+		},
+		{
+			name:     "Test propagate failed write",
+			requests: [][]string{{"SET", "a", "x"}, {"INCR", "a"}},
+			want:     `^\*2\r\n\$6\r\nSELECT\r\n\$1\r\n0\r\n\*3\r\n\$3\r\nSET\r\n\$1\r\na\r\n\$1\r\nx\r\n$`,
+		},
+		{
+			name:     "Test propagate transaction",
+			requests: [][]string{{"MULTI"}, {"INCR", "a"}, {"GET", "a"}, {"SELECT", "1"}, {"INCR", "b"}, {"EXEC"}},
+			want: `^\*2\r\n\$6\r\nSELECT\r\n\$1\r\n0\r\n\*1\r\n\$5\r\nMULTI\r\n\*2\r\n\$4\r\nINCR\r\n\$1\r\na\r\n` +
+				`\*2\r\n\$6\r\nSELECT\r\n\$1\r\n1\r\n\*2\r\n\$4\r\nINCR\r\n\$1\r\nb\r\n\*1\r\n\$4\r\nEXEC\r\n$`,
+		},
+		{
+			name:     "Test propagate transaction with a single write",
+			requests: [][]string{{"MULTI"}, {"GET", "a"}, {"INCR", "a"}, {"EXEC"}},
+			want:     `^\*2\r\n\$6\r\nSELECT\r\n\$1\r\n0\r\n\*2\r\n\$4\r\nINCR\r\n\$1\r\na\r\n$`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(dbs []*Storage) { databases = dbs }(databases)
+			databases = newDatabases(2)
+
+			var stream, replies bytes.Buffer
+			slaves := NewSlaves()
+			slave := NewConnection(bufferConn{buf: &stream})
+			slaves.AddSlave(slave.conn.RemoteAddr(), slave)
+			if err := slaves.SlaveOnline(slave.conn.RemoteAddr()); err != nil {
+				t.Fatalf("SlaveOnline() error = %v", err)
+			}
+
+			s := NewMaster(NewConnection(bufferConn{buf: &replies}), Opts{Role: "master"}, &MasterConfig{slaves: slaves})
+			for _, request := range tt.requests {
+				if err := s.HandleRequest(request); err != nil {
+					t.Fatalf("HandleRequest() error = %v", err)
+				}
+			}
+
+			waitWritten(t, slaves, slave.conn.RemoteAddr())
+			if !regexp.MustCompile(tt.want).MatchString(stream.String()) {
+				t.Errorf("propagated %q, want %q", stream.String(), tt.want)
+			}
+			if slaves.Offset() != stream.Len() {
+				t.Errorf("Offset() = %d, want %d", slaves.Offset(), stream.Len())
+			}
+		})
+	}
+}
+
+func TestSlaves_Propagate(t *testing.T) {
+	set := ToRespArray([]string{"SET", "foo", "bar"})
+
+	tests := []struct {
+		name        string
+		limit       OutputBufferLimit
+		softSince   time.Duration // how long the stalled slave has been past the soft limit
+		commands    int
+		wantStalled bool
+	}{
+		{
+			name:        "Test propagate within the limits",
+			limit:       OutputBufferLimit{hard: 10 * int64(len(set)), soft: 5 * int64(len(set)), softTime: time.Minute},
+			commands:    4,
+			wantStalled: true,
+		},
+		{
+			name:     "Test propagate past the hard limit",
+			limit:    OutputBufferLimit{hard: 3 * int64(len(set))},
+			commands: 4,
+		},
+		{
+			name:        "Test propagate past the soft limit",
+			limit:       OutputBufferLimit{soft: 3 * int64(len(set)), softTime: time.Minute},
+			commands:    4,
+			wantStalled: true,
+		},
+		{
+			name:      "Test propagate past the soft limit for too long",
+			limit:     OutputBufferLimit{soft: 3 * int64(len(set)), softTime: time.Minute},
+			softSince: 2 * time.Minute,
+			commands:  4,
+		},
+		{
+			name:        "Test propagate without limits",
+			commands:    100,
+			wantStalled: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSlaves()
+			s.limit = tt.limit
+
+			var buf bytes.Buffer
+			fast := NewConnection(bufferConn{buf: &buf})
+			s.AddSlave(fast.conn.RemoteAddr(), fast)
+			if err := s.SlaveOnline(fast.conn.RemoteAddr()); err != nil {
+				t.Fatalf("SlaveOnline() error = %v", err)
+			}
+
+			stalledAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6381}
+			stalled := NewConnection(stalledConn{closed: make(chan struct{})})
+			s.AddSlave(stalledAddr, stalled)
+			if err := s.SlaveOnline(stalledAddr); err != nil {
+				t.Fatalf("SlaveOnline() error = %v", err)
+			}
+			defer s.RemoveSlave(stalledAddr, stalled)
+
+			for i := 0; i < tt.commands; i++ {
+				if i == tt.commands-1 && tt.softSince > 0 {
+					s.list[stalledAddr.String()].softSince = time.Now().Add(-tt.softSince)
+				}
+				s.Propagate(set)
+				// only the stalled slave falls behind
+				waitWritten(t, s, fast.conn.RemoteAddr())
+			}
+
+			if want := strings.Repeat(set, tt.commands); buf.String() != want {
+				t.Errorf("Propagate() wrote %d bytes to the other slave, want %d", buf.Len(), len(want))
+			}
+
+			s.lock.RLock()
+			_, ok := s.list[stalledAddr.String()]
+			s.lock.RUnlock()
+			if ok != tt.wantStalled {
+				t.Errorf("Propagate() kept the stalled slave = %v, want %v", ok, tt.wantStalled)
+			}
+		})
+	}
+}
+
+func Test_parseOutputBufferLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    OutputBufferLimit
+		wantErr bool
+	}{
+		{
+			name: "Test parse replica limit",
+			s:    "replica 256mb 64mb 60",
+			want: OutputBufferLimit{hard: 256 << 20, soft: 64 << 20, softTime: time.Minute},
+		},
+		{
+			name: "Test parse slave limit",
+			s:    "slave 0 1kb 0",
+			want: OutputBufferLimit{soft: 1024},
+		},
+		{
+			name:    "Test parse limit of other class",
+			s:       "pubsub 32mb 8mb 60",
+			wantErr: true,
+		},
+		{
+			name:    "Test parse limit missing soft seconds",
+			s:       "replica 256mb 64mb",
+			wantErr: true,
+		},
+		{
+			name:    "Test parse invalid hard limit",
+			s:       "replica lots 64mb 60",
+			wantErr: true,
+		},
+		{
+			name:    "Test parse negative soft seconds",
+			s:       "replica 256mb 64mb -1",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseOutputBufferLimit(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseOutputBufferLimit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseOutputBufferLimit() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlaves_Promote(t *testing.T) {
+	tests := []struct {
+		name        string
+		replID      string
+		fed         string
+		offset      int
+		wantReplID2 string
+		wantSecond  int
+		wantBacklog bool
+	}{
+		{
+			name:        "Test promote synchronized slave",
+			replID:      "replid",
+			fed:         "abcdefghij",
+			offset:      10,
+			wantReplID2: "replid",
+			wantSecond:  10,
+			wantBacklog: true,
+		},
+		{
+			name:        "Test promote slave in a transaction",
+			replID:      "replid",
+			fed:         "abcdefghij",
+			offset:      4,
+			wantReplID2: "replid",
+			wantSecond:  4,
+		},
+		{
+			name:       "Test promote slave never synchronized",
+			wantSecond: -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSlaves()
+			s.replID = tt.replID
+			s.db = 3
+
+			if tt.fed != "" {
+				s.Feed(tt.fed)
+			}
+			s.offset = tt.offset
+
+			s.Promote()
+
+			if s.replID == tt.replID || len(s.replID) != 40 {
+				t.Errorf("Promote() replID = %q, want a new ID", s.replID)
+			}
+			if s.replID2 != tt.wantReplID2 || s.secondOffset != tt.wantSecond {
+				t.Errorf("Promote() previous history = %q up to %d, want %q up to %d", s.replID2, s.secondOffset, tt.wantReplID2, tt.wantSecond)
+			}
+			if (s.backlog != nil) != tt.wantBacklog {
+				t.Errorf("Promote() kept backlog = %v, want %v", s.backlog != nil, tt.wantBacklog)
+			}
+			if s.db != -1 {
+				t.Errorf("Promote() db = %d, want -1", s.db)
+			}
+
+			if !tt.wantBacklog {
+				return
+			}
+
+			// a slave of the previous master resumes from the history of the promoted slave
+			var buf bytes.Buffer
+			conn := NewConnection(bufferConn{buf: &buf})
+			if !s.PartialSync(conn.conn.RemoteAddr(), conn, tt.replID, 6) {
+				t.Fatalf("PartialSync() = false, want true")
+			}
+			waitWritten(t, s, conn.conn.RemoteAddr())
+			if want := "+CONTINUE " + s.replID + "\r\nghij"; buf.String() != want {
+				t.Errorf("PartialSync() reply = %q, want %q", buf.String(), want)
+			}
+		})
+	}
+}
+
+func TestSlaves_AddSlave(t *testing.T) {
+	s := NewSlaves()
+	s.offset = 100
+
+	var buf bytes.Buffer
+	conn := NewConnection(bufferConn{buf: &buf})
+	if got := s.AddSlave(conn.conn.RemoteAddr(), conn); got != 100 {
+		t.Errorf("AddSlave() = %d, want 100", got)
+	}
+	defer s.RemoveSlave(conn.conn.RemoteAddr(), conn)
+
+	// the slave holds the snapshot at that offset before any acknowledgement
+	if got := s.SyncedSlaveCount(100); got != 1 {
+		t.Errorf("SyncedSlaveCount(100) = %d, want 1", got)
+	}
+	if got := s.SyncedSlaveCount(101); got != 0 {
+		t.Errorf("SyncedSlaveCount(101) = %d, want 0", got)
+	}
+}
+
+func TestSlaves_SetReplication(t *testing.T) {
+	s := NewSlaves()
+
+	var buf bytes.Buffer
+	conn := NewConnection(bufferConn{buf: &buf})
+	s.AddSlave(conn.conn.RemoteAddr(), conn)
+
+	s.SetReplication("8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb", 42)
+
+	// the slave holds the history replaced by the snapshot of master
+	if got := s.Count(); got != 0 {
+		t.Errorf("Count() = %d, want 0", got)
+	}
+	if replID, offset := s.Replication(); replID != "8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb" || offset != 42 {
+		t.Errorf("Replication() = %s, %d, want 8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb, 42", replID, offset)
+	}
+}
+
+func TestSlaves_expireBacklog(t *testing.T) {
+	tests := []struct {
+		name      string
+		slave     bool
+		lastSlave time.Duration
+		wantKept  bool
+	}{
+		{
+			name:      "Test backlog expired",
+			lastSlave: 2 * time.Hour,
+		},
+		{
+			name:      "Test backlog within its TTL",
+			lastSlave: time.Minute,
+			wantKept:  true,
+		},
+		{
+			name:     "Test backlog never used by a slave",
+			wantKept: true,
+		},
+		{
+			name:      "Test backlog of a slave",
+			slave:     true,
+			lastSlave: 2 * time.Hour,
+			wantKept:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+
+			s := NewSlaves()
+			s.replID = "replid"
+			s.slave = tt.slave
+			s.backlog = newBacklog(s.backlogSize, 0)
+			if tt.lastSlave > 0 {
+				s.lastSlave = now.Add(-tt.lastSlave)
+			}
+
+			s.expireBacklog(now)
+			if kept := s.backlog != nil && s.replID == "replid"; kept != tt.wantKept {
+				t.Errorf("expireBacklog() kept = %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+}
@@ -0,0 +1,414 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// streamNodeMaxEntries is the number of entries stored in each node of a saved stream
+const streamNodeMaxEntries = 100
+
+// Snapshot is a point-in-time copy of the databases, written to RDB files
+// without holding any lock.
+type Snapshot struct {
+	dbs []map[string]*Entry
+	aux [][2]string
+
+	// changes made to the databases when the snapshot was taken
+	dirty int64
+}
+
+// snapshot copies the given databases.
+// The caller must hold the locks of every database.
+func (p *Persistence) snapshot(dbs []*Storage, o Opts) *Snapshot {
+	snap := &Snapshot{
+		dbs:   make([]map[string]*Entry, len(dbs)),
+		dirty: p.dirty.Load(),
+	}
+
+	for i, db := range dbs {
+		snap.dbs[i] = db.clone()
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	snap.aux = [][2]string{
+		{"redis-ver", "7.2.0"},
+		{"redis-bits", "64"},
+		{"ctime", strconv.FormatInt(time.Now().Unix(), 10)},
+		{"used-mem", strconv.FormatUint(mem.Alloc, 10)},
+		{"repl-id", list.ReplID()},
+		{"repl-offset", strconv.Itoa(list.Offset())},
+		{"aof-base", "0"},
+	}
+
+	return snap
+}
+
+// cloneValue returns a copy of the value that later commands won't modify.
+func cloneValue(v Value) Value {
+	switch v := v.(type) {
+	case *List:
+		return NewList(slices.Clone(v.elems)...)
+
+	case *Set:
+		return &Set{members: maps.Clone(v.members)}
+
+	case *ZSet:
+		return &ZSet{scores: maps.Clone(v.scores)}
+
+	case *Hash:
+		return &Hash{fields: maps.Clone(v.fields)}
+
+	case *Stream:
+		stream := *v
+		stream.entries = slices.Clone(v.entries)
+		stream.groups = make([]*ConsumerGroup, len(v.groups))
+
+		for i, g := range v.groups {
+			group := *g
+			group.pending = make([]*PendingEntry, len(g.pending))
+			for j, entry := range g.pending {
+				e := *entry
+				group.pending[j] = &e
+			}
+
+			group.consumers = make([]*Consumer, len(g.consumers))
+			for j, consumer := range g.consumers {
+				c := *consumer
+				group.consumers[j] = &c
+			}
+
+			stream.groups[i] = &group
+		}
+
+		return &stream
+	}
+
+	// strings are immutable
+	return v
+}
+
+// save writes the snapshot to a temporary file renamed to the given path once
+// complete, so the previous file is kept whole if anything fails.
+func (snap *Snapshot) save(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "temp-*.rdb")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp failed: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if err := snap.write(w); err != nil {
+		return fmt.Errorf("write failed: %v", err)
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("Flush failed: %v", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("Sync failed: %v", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Close failed: %v", err)
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("os.Rename failed: %v", err)
+	}
+
+	return nil
+}
+
+// write encodes the snapshot in the RDB format, followed by its checksum.
+func (snap *Snapshot) write(w io.Writer) error {
+	var crc uint64
+	write := func(b []byte) error {
+		crc = crc64Update(crc, b)
+		_, err := w.Write(b)
+		return err
+	}
+
+	b := fmt.Appendf(nil, "REDIS%04d", rdbSaveVersion)
+	for _, aux := range snap.aux {
+		b = append(b, opAux)
+		b = appendRDBString(b, aux[0])
+		b = appendRDBString(b, aux[1])
+	}
+
+	for i, keys := range snap.dbs {
+		if len(keys) == 0 {
+			continue
+		}
+
+		expires := 0
+		for _, e := range keys {
+			if e.expireAt != 0 {
+				expires++
+			}
+		}
+
+		b = append(b, opSelectDB)
+		b = appendRDBLength(b, uint64(i))
+		b = append(b, opResizeDB)
+		b = appendRDBLength(b, uint64(len(keys)))
+		b = appendRDBLength(b, uint64(expires))
+
+		for key, e := range keys {
+			if e.expireAt != 0 {
+				b = binary.LittleEndian.AppendUint64(append(b, opExpireTimeMS), uint64(e.expireAt))
+			}
+
+			b = appendRDBValue(b, key, e.value)
+
+			// the buffer is written out every few keys
+			if len(b) >= 64*1024 {
+				if err := write(b); err != nil {
+					return err
+				}
+				b = b[:0]
+			}
+		}
+	}
+
+	b = append(b, opEOF)
+	if err := write(b); err != nil {
+		return err
+	}
+
+	_, err := w.Write(binary.LittleEndian.AppendUint64(nil, crc))
+	return err
+}
+
+// appendRDBLength appends a length in the smallest of its encodings.
+func appendRDBLength(b []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(b, byte(n))
+	case n < 1<<14:
+		return append(b, 0x40|byte(n>>8), byte(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, lenEnc32Bit), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, lenEnc64Bit), n)
+	}
+}
+
+// appendRDBString appends a string, as an integer when it fits in 32 bits.
+func appendRDBString(b []byte, s string) []byte {
+	if len(s) <= 11 {
+		if v, err := strconv.ParseInt(s, 10, 32); err == nil && strconv.FormatInt(v, 10) == s {
+			switch {
+			case v >= math.MinInt8 && v <= math.MaxInt8:
+				return append(b, 0xc0|strEncInt8, byte(v))
+			case v >= math.MinInt16 && v <= math.MaxInt16:
+				return binary.LittleEndian.AppendUint16(append(b, 0xc0|strEncInt16), uint16(v))
+			default:
+				return binary.LittleEndian.AppendUint32(append(b, 0xc0|strEncInt32), uint32(v))
+			}
+		}
+	}
+
+	b = appendRDBLength(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendRDBStreamID appends a stream ID as the two lengths it is made of.
+func appendRDBStreamID(b []byte, id string) []byte {
+	ms, seq := streamIDParts(id)
+	return appendRDBLength(appendRDBLength(b, ms), seq)
+}
+
+// appendRawStreamID appends a stream ID as two big endian 64 bits integers.
+func appendRawStreamID(b []byte, id string) []byte {
+	ms, seq := streamIDParts(id)
+	return binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(b, ms), seq)
+}
+
+// streamIDParts returns the time and sequence number of an ID, 0-0 if it isn't set.
+func streamIDParts(id string) (uint64, uint64) {
+	ms, seq, err := getTimeAndSeq(id)
+	if err != nil {
+		return 0, 0
+	}
+
+	return uint64(ms), uint64(seq)
+}
+
+// appendRDBValue appends the type of the value, the key and the value.
+func appendRDBValue(b []byte, key string, v Value) []byte {
+	switch v := v.(type) {
+	case String:
+		b = appendRDBString(append(b, rdbTypeString), key)
+		return appendRDBString(b, string(v))
+
+	case *List:
+		b = appendRDBString(append(b, rdbTypeList), key)
+		b = appendRDBLength(b, uint64(len(v.elems)))
+		for _, elem := range v.elems {
+			b = appendRDBString(b, elem)
+		}
+		return b
+
+	case *Set:
+		b = appendRDBString(append(b, rdbTypeSet), key)
+		b = appendRDBLength(b, uint64(len(v.members)))
+		for m := range v.members {
+			b = appendRDBString(b, m)
+		}
+		return b
+
+	case *ZSet:
+		b = appendRDBString(append(b, rdbTypeZSet2), key)
+		b = appendRDBLength(b, uint64(len(v.scores)))
+		for m, score := range v.scores {
+			b = appendRDBString(b, m)
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(score))
+		}
+		return b
+
+	case *Hash:
+		b = appendRDBString(append(b, rdbTypeHash), key)
+		b = appendRDBLength(b, uint64(len(v.fields)))
+		for field, value := range v.fields {
+			b = appendRDBString(b, field)
+			b = appendRDBString(b, value)
+		}
+		return b
+
+	case *Stream:
+		b = appendRDBString(append(b, rdbTypeStreamListpacks3), key)
+		return appendRDBStream(b, v)
+	}
+
+	panic(fmt.Sprintf("unknown value type %T", v))
+}
+
+// appendRDBStream appends the entries of a stream, split in listpack nodes,
+// followed by its metadata and consumer groups.
+func appendRDBStream(b []byte, stream *Stream) []byte {
+	nodes := (len(stream.entries) + streamNodeMaxEntries - 1) / streamNodeMaxEntries
+	b = appendRDBLength(b, uint64(nodes))
+
+	for i := 0; i < len(stream.entries); i += streamNodeMaxEntries {
+		entries := stream.entries[i:min(i+streamNodeMaxEntries, len(stream.entries))]
+
+		master := appendRawStreamID(nil, entries[0].id)
+		b = appendRDBString(b, string(master))
+		b = appendRDBString(b, string(encodeListpack(encodeStreamNode(entries))))
+	}
+
+	firstID := ""
+	if len(stream.entries) > 0 {
+		firstID = stream.entries[0].id
+	}
+
+	b = appendRDBLength(b, uint64(len(stream.entries)))
+	b = appendRDBStreamID(b, stream.lastID)
+	b = appendRDBStreamID(b, firstID)
+	b = appendRDBStreamID(b, stream.maxDeletedID)
+	b = appendRDBLength(b, uint64(stream.entriesAdded))
+
+	b = appendRDBLength(b, uint64(len(stream.groups)))
+	for _, group := range stream.groups {
+		b = appendRDBString(b, group.name)
+		b = appendRDBStreamID(b, group.lastID)
+		b = appendRDBLength(b, uint64(group.entriesRead))
+
+		b = appendRDBLength(b, uint64(len(group.pending)))
+		for _, entry := range group.pending {
+			b = appendRawStreamID(b, entry.id)
+			b = binary.LittleEndian.AppendUint64(b, uint64(entry.deliveryTime))
+			b = appendRDBLength(b, uint64(entry.deliveryCount))
+		}
+
+		b = appendRDBLength(b, uint64(len(group.consumers)))
+		for _, consumer := range group.consumers {
+			b = appendRDBString(b, consumer.name)
+			b = binary.LittleEndian.AppendUint64(b, uint64(consumer.seenTime))
+			b = binary.LittleEndian.AppendUint64(b, uint64(consumer.activeTime))
+
+			var pending []string
+			for _, entry := range group.pending {
+				if entry.consumer == consumer.name {
+					pending = append(pending, entry.id)
+				}
+			}
+
+			b = appendRDBLength(b, uint64(len(pending)))
+			for _, id := range pending {
+				b = appendRawStreamID(b, id)
+			}
+		}
+	}
+
+	return b
+}
+
+// encodeStreamNode returns the elements of the listpack of a stream node:
+// a master entry holding the fields of the first entry, then the entries
+// with their ID relative to the one of the first entry. The values of the
+// entries having the same fields as the master entry are stored alone.
+func encodeStreamNode(entries []*StreamEntry) []string {
+	fields := func(entry *StreamEntry) []string {
+		f := make([]string, 0, len(entry.kvpairs))
+		for field := range entry.kvpairs {
+			f = append(f, field)
+		}
+		sort.Strings(f)
+
+		return f
+	}
+
+	masterMs, masterSeq := streamIDParts(entries[0].id)
+	masterFields := fields(entries[0])
+
+	elems := []string{strconv.Itoa(len(entries)), "0", strconv.Itoa(len(masterFields))}
+	elems = append(elems, masterFields...)
+	elems = append(elems, "0")
+
+	for _, entry := range entries {
+		ms, seq := streamIDParts(entry.id)
+		entryFields := fields(entry)
+
+		flags := 0
+		if slices.Equal(entryFields, masterFields) {
+			flags |= streamItemSameFields
+		}
+
+		elems = append(elems,
+			strconv.Itoa(flags),
+			strconv.FormatInt(int64(ms-masterMs), 10),
+			strconv.FormatInt(int64(seq-masterSeq), 10))
+
+		if flags&streamItemSameFields != 0 {
+			for _, field := range entryFields {
+				elems = append(elems, entry.kvpairs[field])
+			}
+			elems = append(elems, strconv.Itoa(len(entryFields)+3))
+		} else {
+			elems = append(elems, strconv.Itoa(len(entryFields)))
+			for _, field := range entryFields {
+				elems = append(elems, field, entry.kvpairs[field])
+			}
+			elems = append(elems, strconv.Itoa(len(entryFields)*2+4))
+		}
+	}
+
+	return elems
+}
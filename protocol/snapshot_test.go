@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshot_write(t *testing.T) {
+	stream := NewStream()
+	for i := 0; i < 250; i++ {
+		entry, _ := NewStreamEntry(fmt.Sprintf("%d-%d", 1000+i/3, i%3), []string{"f", fmt.Sprint(i)})
+		if i%7 == 0 {
+			entry.kvpairs["g"] = "other fields"
+		}
+		stream.entries = append(stream.entries, entry)
+	}
+	stream.lastID = "1083-0"
+	stream.maxDeletedID = "1083-0"
+	stream.entriesAdded = 251
+	stream.groups = []*ConsumerGroup{{
+		name:        "grp",
+		lastID:      "1000-1",
+		entriesRead: -1,
+		pending:     []*PendingEntry{{id: "1000-0", consumer: "alice", deliveryTime: 1, deliveryCount: 2}},
+		consumers:   []*Consumer{{name: "alice", seenTime: 3, activeTime: 4}},
+	}}
+
+	zset := NewZSet()
+	zset.scores["a"] = 1.5
+	zset.scores["b"] = -2
+
+	hash := NewHash()
+	hash.fields["field"] = "value"
+	hash.fields["n"] = "12"
+
+	expireAt := time.Now().Add(time.Hour).UnixMilli()
+
+	dbs := newDatabases(3)
+	dbs[0].Set("str", "value", 0)
+	dbs[0].Set("int", "-70000", expireAt)
+	dbs[0].Set("expired", "value", 1)
+	dbs[0].SetValue("list", NewList("a", "1", "300"), 0)
+	dbs[0].SetValue("set", NewSet("a", "b"), 0)
+	dbs[2].SetValue("zset", zset, 0)
+	dbs[2].SetValue("hash", hash, 0)
+	dbs[2].SetValue("stream", stream, 0)
+
+	snap := persistence.snapshot(dbs, Opts{ReplID: "replid"})
+
+	// the snapshot mustn't change with the databases
+	dbs[0].Set("str", "changed", 0)
+	stream.entries = stream.entries[:1]
+
+	var buf bytes.Buffer
+	if err := snap.write(&buf); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+
+	loaded := newDatabases(3)
+	file := NewFile(&buf)
+	if err := file.load(loaded); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+
+	if file.aux["repl-id"] != list.ReplID() || file.aux["redis-ver"] != "7.2.0" {
+		t.Errorf("load() aux = %v", file.aux)
+	}
+
+	for i := range snap.dbs {
+		got := loaded[i].clone()
+		if !reflect.DeepEqual(got, snap.dbs[i]) {
+			t.Errorf("DB %d = %v, want %v", i, got, snap.dbs[i])
+		}
+	}
+
+	if _, ok := snap.dbs[0]["expired"]; ok {
+		t.Errorf("snapshot() kept an expired key")
+	}
+
+	if v := snap.dbs[0]["str"].value; v != String("value") {
+		t.Errorf("snapshot() str = %v, want value", v)
+	}
+
+	if n := len(snap.dbs[2]["stream"].value.(*Stream).entries); n != 250 {
+		t.Errorf("snapshot() stream entries = %d, want 250", n)
+	}
+}
+
+func TestPersistence_Save(t *testing.T) {
+	dir := t.TempDir()
+	o := Opts{Dir: dir, Dbfilename: "dump.rdb", RDBCorrupt: "exit"}
+
+	dbs := newDatabases(2)
+	dbs[1].Set("foo", "bar", 0)
+
+	p := NewPersistence()
+	p.dirty.Store(3)
+	if err := p.Save(o, p.snapshot(dbs, o)); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	if p.dirty.Load() != 0 {
+		t.Errorf("Save() dirty = %d, want 0", p.dirty.Load())
+	}
+
+	// only the RDB file is left in the directory
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if !reflect.DeepEqual(files, []string{filepath.Join(dir, "dump.rdb")}) {
+		t.Errorf("Save() files = %v", files)
+	}
+
+	loaded := newDatabases(2)
+	if _, err := loadRDB(o, loaded); err != nil {
+		t.Fatalf("loadRDB() error = %v", err)
+	}
+
+	if got := loaded[1].Keys("*"); !reflect.DeepEqual(got, []string{"foo"}) {
+		t.Errorf("loadRDB() keys = %v, want [foo]", got)
+	}
+
+	// a file that can't be written leaves the previous one in place
+	if err := os.Mkdir(filepath.Join(dir, "dir.rdb"), 0o755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	o.Dbfilename = "dir.rdb"
+	if err := p.Save(o, p.snapshot(dbs, o)); err == nil {
+		t.Errorf("Save() error = nil, want an error")
+	}
+}
@@ -1,71 +1,579 @@
 package protocol
 
-import "time"
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
 
-var storage = NewStorage()
+// shardCount is the number of independently locked parts of the keyspace
+const shardCount = 64
 
-// Entry represents the cache entry.
+const (
+	// keys with an expiry time sampled from a shard by the active expiry
+	activeExpireSamples = 20
+	// keys visited at most while looking for the samples of a shard
+	activeExpireVisits = 20 * activeExpireSamples
+	// a shard is sampled again while more than this percentage of its samples expired
+	activeExpireRepeat = 25
+	// time a cycle of the active expiry may take
+	activeExpireBudget = 25 * time.Millisecond
+)
+
+// databaseCount is the number of databases clients can SELECT
+const databaseCount = 16
+
+var databases = newDatabases(databaseCount)
+
+// newDatabases returns n empty databases.
+func newDatabases(n int) []*Storage {
+	dbs := make([]*Storage, n)
+	for i := range dbs {
+		dbs[i] = NewStorage()
+	}
+
+	return dbs
+}
+
+// ErrWrongType is returned when a command is run against a key holding another type of value.
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// ValueType identifies the type of the value held by a key.
+type ValueType int
+
+const (
+	TypeString ValueType = iota
+	TypeList
+	TypeSet
+	TypeZSet
+	TypeHash
+	TypeStream
+)
+
+// String returns the name of the type as reported by the TYPE command.
+func (t ValueType) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeList:
+		return "list"
+	case TypeSet:
+		return "set"
+	case TypeZSet:
+		return "zset"
+	case TypeHash:
+		return "hash"
+	case TypeStream:
+		return "stream"
+	default:
+		return "unknown"
+	}
+}
+
+// Value represents a value held by a key.
+type Value interface {
+	Type() ValueType
+}
+
+// String represents a string value.
+type String string
+
+// Type returns TypeString.
+func (String) Type() ValueType {
+	return TypeString
+}
+
+// Entry represents a key of the keyspace.
 type Entry struct {
-	value    string
+	value    Value
 	expireAt int64
 }
 
 // NewEntry is the Entry constructor.
-func NewEntry(s string, t int64) *Entry {
+func NewEntry(v Value, t int64) *Entry {
 	return &Entry{
-		value:    s,
+		value:    v,
 		expireAt: t,
 	}
 }
 
-// Storage represents the cache storage system
+// expired reports whether the entry reached its expiry time.
+func (e *Entry) expired() bool {
+	return e.expireAt != 0 && time.Now().UnixMilli() > e.expireAt
+}
+
+// Storage represents the keyspace.
+// The keys are spread over shards guarded by their own lock: the methods
+// reading or modifying keys expect the caller to hold the locks returned
+// by Lock or LockAll, so that a whole command runs atomically.
 type Storage struct {
-	cache   map[string]*Entry
-	streams map[string]*Stream // stream key, stream
+	shards [shardCount]*shard
+
+	watchLock sync.Mutex
+	watchers  map[string][]chan struct{}
+}
+
+type shard struct {
+	lock sync.RWMutex
+	keys map[string]*Entry
 }
 
 // NewStorage is the cache storage constructor
 func NewStorage() *Storage {
-	return &Storage{
-		cache:   make(map[string]*Entry),
-		streams: make(map[string]*Stream),
+	s := &Storage{
+		watchers: make(map[string][]chan struct{}),
 	}
+
+	for i := range s.shards {
+		s.shards[i] = &shard{
+			keys: make(map[string]*Entry),
+		}
+	}
+
+	return s
 }
 
-// Get returns the string value mapped to the given key.
-// nil will be returned if the entry expired or there's no such item.
-func (s *Storage) Get(key string) *string {
-	entry, ok := s.cache[key]
-	if !ok {
-		return nil
+// shardIndex returns the index of the shard holding the given key (FNV-1a).
+func shardIndex(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+
+	return int(h % shardCount)
+}
+
+func (s *Storage) shard(key string) *shard {
+	return s.shards[shardIndex(key)]
+}
+
+// Lock acquires the locks of the shards holding the given keys and returns
+// the function releasing them. Shards are always locked in the same order
+// so concurrent callers cannot deadlock.
+func (s *Storage) Lock(keys []string, write bool) func() {
+	if len(keys) == 0 {
+		return func() {}
+	}
+
+	indexes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		indexes = append(indexes, shardIndex(key))
 	}
+	sort.Ints(indexes)
 
-	if entry.expireAt != 0 && time.Now().UnixMilli() > entry.expireAt {
-		s.Delete(key)
+	locked := make([]*shard, 0, len(indexes))
+	for i, idx := range indexes {
+		if i > 0 && idx == indexes[i-1] {
+			continue
+		}
+
+		locked = append(locked, s.shards[idx])
+	}
+
+	return lockShards(locked, write)
+}
+
+// LockAll acquires the locks of every shard and returns the function releasing them.
+func (s *Storage) LockAll(write bool) func() {
+	return lockShards(s.shards[:], write)
+}
+
+// lockDatabases acquires every lock of the given databases and returns the function releasing them.
+func lockDatabases(dbs []*Storage, write bool) func() {
+	unlocks := make([]func(), len(dbs))
+	for i, db := range dbs {
+		unlocks[i] = db.LockAll(write)
+	}
+
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
+
+func lockShards(shards []*shard, write bool) func() {
+	for _, sh := range shards {
+		if write {
+			sh.lock.Lock()
+		} else {
+			sh.lock.RLock()
+		}
+	}
+
+	return func() {
+		for i := len(shards) - 1; i >= 0; i-- {
+			if write {
+				shards[i].lock.Unlock()
+			} else {
+				shards[i].lock.RUnlock()
+			}
+		}
+	}
+}
+
+// lookup returns the entry of the given key.
+// nil will be returned if the entry expired or there's no such key.
+// Expired entries are left in place as the caller may only hold a read lock:
+// write commands and the active expiry remove them.
+func (s *Storage) lookup(key string) *Entry {
+	entry, ok := s.shard(key).keys[key]
+	if !ok || entry.expired() {
 		return nil
 	}
 
-	return &entry.value
+	return entry
 }
 
-// Set adds a new entry to the storage
+// Lookup returns the value held by the given key.
+func (s *Storage) Lookup(key string) (Value, bool) {
+	entry := s.lookup(key)
+	if entry == nil {
+		return nil, false
+	}
+
+	return entry.value, true
+}
+
+// Get returns the string value mapped to the given key.
+// ErrWrongType will be returned if the key holds another type of value.
+func (s *Storage) Get(key string) (string, bool, error) {
+	entry := s.lookup(key)
+	if entry == nil {
+		return "", false, nil
+	}
+
+	value, ok := entry.value.(String)
+	if !ok {
+		return "", false, ErrWrongType
+	}
+
+	return string(value), true, nil
+}
+
+// Set maps the given key to a string, replacing any value it held.
 func (s *Storage) Set(key string, value string, expireAt int64) {
-	s.cache[key] = NewEntry(value, int64(expireAt))
+	s.SetValue(key, String(value), expireAt)
+}
+
+// SetValue maps the given key to a value, replacing any value it held.
+func (s *Storage) SetValue(key string, v Value, expireAt int64) {
+	s.shard(key).keys[key] = NewEntry(v, expireAt)
 }
 
-// Delete removes a cache entry with the given key
+// Update replaces the value held by the given key, keeping its expiry time.
+func (s *Storage) Update(key string, v Value) {
+	if entry := s.lookup(key); entry != nil {
+		entry.value = v
+		return
+	}
+
+	s.SetValue(key, v, 0)
+}
+
+// Delete removes the given key
 func (s *Storage) Delete(key string) {
-	delete(s.cache, key)
+	delete(s.shard(key).keys, key)
+}
+
+// expire removes the given keys if they expired.
+// The caller must hold the write locks of the keys.
+func (s *Storage) expire(keys []string) {
+	for _, key := range keys {
+		sh := s.shard(key)
+		if entry, ok := sh.keys[key]; ok && entry.expired() {
+			delete(sh.keys, key)
+		}
+	}
+}
+
+// expireSample removes the expired keys among the keys with an expiry time
+// sampled from the shard. It returns the number of keys sampled and removed.
+func (sh *shard) expireSample() (int, int) {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
+	var visited, sampled, expired int
+	// the iteration order of maps is random
+	for k, entry := range sh.keys {
+		if visited++; visited > activeExpireVisits || sampled == activeExpireSamples {
+			break
+		}
+
+		if entry.expireAt == 0 {
+			continue
+		}
+
+		sampled++
+		if entry.expired() {
+			delete(sh.keys, k)
+			expired++
+		}
+	}
+
+	return sampled, expired
+}
+
+// ActiveExpiry removes the expired keys nobody accesses anymore, which would
+// otherwise stay in memory. Every cycle samples the shards of the databases
+// in turn, from the shard where the previous cycle stopped.
+type ActiveExpiry struct {
+	next int // index of the next shard to sample over every database
+}
+
+var activeExpiry = &ActiveExpiry{}
+
+// ScheduleActiveExpiry runs a cycle of the active expiry in the background 10 times per second.
+func ScheduleActiveExpiry() {
+	go func() {
+		for range time.Tick(100 * time.Millisecond) {
+			activeExpiry.cycle(databases, activeExpireBudget)
+		}
+	}()
+}
+
+// cycle samples every shard of the databases once, a shard being sampled
+// again while many of its samples expired, until the time budget is spent.
+// It returns the number of keys removed.
+func (a *ActiveExpiry) cycle(dbs []*Storage, budget time.Duration) int {
+	deadline := time.Now().Add(budget)
+	total := len(dbs) * shardCount
+
+	var removed int
+	for i := 0; i < total && time.Now().Before(deadline); i++ {
+		idx := a.next % total
+		a.next = idx + 1
+		sh := dbs[idx/shardCount].shards[idx%shardCount]
+
+		for time.Now().Before(deadline) {
+			sampled, expired := sh.expireSample()
+			removed += expired
+
+			if expired*100 <= sampled*activeExpireRepeat {
+				break
+			}
+		}
+	}
+
+	return removed
+}
+
+// Type returns the name of the type of the value held by the given key.
+func (s *Storage) Type(key string) string {
+	v, ok := s.Lookup(key)
+	if !ok {
+		return "none"
+	}
+
+	return v.Type().String()
+}
+
+// Keys returns every key matching the given glob-style pattern.
+func (s *Storage) Keys(pattern string) []string {
+	keys := []string{}
+	for _, sh := range s.shards {
+		for k, entry := range sh.keys {
+			if entry.expired() || !matchPattern(pattern, k) {
+				continue
+			}
+
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
+
+// merge adds every key of the other storage, replacing the keys already present.
+func (s *Storage) merge(o *Storage) {
+	for i, sh := range o.shards {
+		for k, e := range sh.keys {
+			s.shards[i].keys[k] = e
+		}
+	}
+}
+
+// replace drops every key of the storage for the keys of the other one.
+func (s *Storage) replace(o *Storage) {
+	for i, sh := range o.shards {
+		s.shards[i].keys = sh.keys
+	}
+}
+
+// clone returns a copy of the entries that haven't expired.
+func (s *Storage) clone() map[string]*Entry {
+	keys := make(map[string]*Entry)
+	for _, sh := range s.shards {
+		for k, e := range sh.keys {
+			if e.expired() {
+				continue
+			}
+
+			keys[k] = NewEntry(cloneValue(e.value), e.expireAt)
+		}
+	}
+
+	return keys
 }
 
 // GetStream returns the Stream mapped to the given key
-func (s *Storage) GetStream(key string) (*Stream, bool) {
-	stream, ok := s.streams[key]
+// ErrWrongType will be returned if the key holds another type of value.
+func (s *Storage) GetStream(key string) (*Stream, bool, error) {
+	v, ok := s.Lookup(key)
+	if !ok {
+		return nil, false, nil
+	}
+
+	stream, ok := v.(*Stream)
+	if !ok {
+		return nil, false, ErrWrongType
+	}
 
-	return stream, ok
+	return stream, true, nil
 }
 
 // AddStream adds a new stream to the storage
-func (s *Storage) AddStream(key string) {
-	s.streams[key] = NewStream()
+func (s *Storage) AddStream(key string) *Stream {
+	stream := NewStream()
+	s.SetValue(key, stream, 0)
+
+	return stream
+}
+
+// watch returns a channel notified the next time one of the given keys is signaled.
+// It must be called while holding the locks of the keys so no signal is missed.
+func (s *Storage) watch(keys []string) chan struct{} {
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+
+	ch := make(chan struct{}, 1)
+	for _, key := range keys {
+		s.watchers[key] = append(s.watchers[key], ch)
+	}
+
+	return ch
+}
+
+// unwatch stops notifying the given channel.
+func (s *Storage) unwatch(keys []string, ch chan struct{}) {
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+
+	for _, key := range keys {
+		watchers := s.watchers[key]
+		for i, w := range watchers {
+			if w == ch {
+				watchers = append(watchers[:i], watchers[i+1:]...)
+				break
+			}
+		}
+
+		if len(watchers) == 0 {
+			delete(s.watchers, key)
+		} else {
+			s.watchers[key] = watchers
+		}
+	}
+}
+
+// signal wakes up the clients blocked on the given key.
+func (s *Storage) signal(key string) {
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+
+	for _, ch := range s.watchers[key] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// matchPattern reports whether the string matches the glob-style pattern
+// supporting *, ?, [...] and \ escapes the same way KEYS does.
+func matchPattern(pattern, str string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+
+			if len(pattern) == 1 {
+				return true
+			}
+
+			for i := 0; i <= len(str); i++ {
+				if matchPattern(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			str = str[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+
+			end := 1
+			not := end < len(pattern) && pattern[end] == '^'
+			if not {
+				end++
+			}
+
+			match := false
+			for end < len(pattern) && pattern[end] != ']' {
+				switch {
+				case pattern[end] == '\\' && end+1 < len(pattern):
+					end++
+					if pattern[end] == str[0] {
+						match = true
+					}
+				case end+2 < len(pattern) && pattern[end+1] == '-' && pattern[end+2] != ']':
+					lo, hi := pattern[end], pattern[end+2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					if str[0] >= lo && str[0] <= hi {
+						match = true
+					}
+					end += 2
+				case pattern[end] == str[0]:
+					match = true
+				}
+				end++
+			}
+
+			if match == not {
+				return false
+			}
+
+			str = str[1:]
+			if end >= len(pattern) {
+				return len(str) == 0
+			}
+			pattern = pattern[end:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || pattern[0] != str[0] {
+				return false
+			}
+			str = str[1:]
+		}
+
+		pattern = pattern[1:]
+	}
+
+	return len(str) == 0
 }
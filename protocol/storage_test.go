@@ -1,31 +1,50 @@
 package protocol
 
 import (
+	"reflect"
+	"sort"
+	"strconv"
 	"testing"
+	"time"
 )
 
 var (
 	cache = map[string]*Entry{
 		"entry": {
-			value:    "A",
+			value:    String("A"),
 			expireAt: 0,
 		},
 		"expiredEntry": {
-			value:    "A",
+			value:    String("A"),
 			expireAt: 1234,
 		},
+		"stream": {
+			value:    testStream1,
+			expireAt: 0,
+		},
 	}
 )
 
+func newTestStorage(entries map[string]*Entry) *Storage {
+	s := NewStorage()
+	for k, e := range entries {
+		s.shard(k).keys[k] = e
+	}
+
+	return s
+}
+
 func TestStorage_Get(t *testing.T) {
 	type args struct {
 		cache map[string]*Entry
 		key   string
 	}
 	tests := []struct {
-		name string
-		args args
-		want *string
+		name    string
+		args    args
+		want    string
+		wantOk  bool
+		wantErr error
 	}{
 		{
 			name: "Test get",
@@ -33,7 +52,8 @@ func TestStorage_Get(t *testing.T) {
 				cache: cache,
 				key:   "entry",
 			},
-			want: &cache["entry"].value,
+			want:   "A",
+			wantOk: true,
 		},
 		{
 			name: "Test get with nonexisting value",
@@ -41,7 +61,7 @@ func TestStorage_Get(t *testing.T) {
 				cache: cache,
 				key:   "abc",
 			},
-			want: nil,
+			wantOk: false,
 		},
 		{
 			name: "Test get for expired entry",
@@ -49,16 +69,28 @@ func TestStorage_Get(t *testing.T) {
 				cache: cache,
 				key:   "expiredEntry",
 			},
-			want: nil,
+			wantOk: false,
+		},
+		{
+			name: "Test get for stream entry",
+			args: args{
+				cache: cache,
+				key:   "stream",
+			},
+			wantOk:  false,
+			wantErr: ErrWrongType,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			s := &Storage{
-				cache: tt.args.cache,
+			s := newTestStorage(tt.args.cache)
+			got, ok, err := s.Get(tt.args.key)
+			if err != tt.wantErr {
+				t.Errorf("Storage.Get() error = %v, wantErr %v", err, tt.wantErr)
+				return
 			}
-			if got := s.Get(tt.args.key); got != tt.want {
-				t.Errorf("Storage.Get() = %v, want %v", got, tt.want)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("Storage.Get() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
 			}
 		})
 	}
@@ -103,10 +135,241 @@ func TestStorage_Set(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			s := &Storage{
-				cache: tt.fields.cache,
-			}
+			s := newTestStorage(tt.fields.cache)
 			s.Set(tt.args.key, tt.args.value, tt.args.expireAt)
 		})
 	}
 }
+
+func TestStorage_GetStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		want    *Stream
+		wantErr error
+	}{
+		{name: "Test get stream", key: "stream", want: testStream1},
+		{name: "Test get stream with nonexisting key", key: "abc", want: nil},
+		{name: "Test get stream for string entry", key: "entry", want: nil, wantErr: ErrWrongType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStorage(cache)
+			got, _, err := s.GetStream(tt.key)
+			if err != tt.wantErr {
+				t.Errorf("Storage.GetStream() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("Storage.GetStream() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStorage_Type(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		want string
+	}{
+		{name: "Test type of string", key: "entry", want: "string"},
+		{name: "Test type of stream", key: "stream", want: "stream"},
+		{name: "Test type of nonexisting key", key: "abc", want: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStorage(map[string]*Entry{
+				"entry":  NewEntry(String("A"), 0),
+				"stream": NewEntry(NewStream(), 0),
+			})
+			if got := s.Type(tt.key); got != tt.want {
+				t.Errorf("Storage.Type() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStorage_Keys(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		want    []string
+	}{
+		{name: "Test keys with *", pattern: "*", want: []string{"entry", "stream"}},
+		{name: "Test keys with prefix", pattern: "str*", want: []string{"stream"}},
+		{name: "Test keys without match", pattern: "abc", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStorage(map[string]*Entry{
+				"entry":        NewEntry(String("A"), 0),
+				"expiredEntry": NewEntry(String("A"), 1234),
+				"stream":       NewEntry(NewStream(), 0),
+			})
+			got := s.Keys(tt.pattern)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Storage.Keys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStorage_expire(t *testing.T) {
+	s := NewStorage()
+	past := time.Now().Add(-time.Second).UnixMilli()
+	future := time.Now().Add(time.Hour).UnixMilli()
+
+	s.Set("expired", "a", past)
+	s.Set("volatile", "b", future)
+	s.Set("persistent", "c", 0)
+
+	s.expire([]string{"expired", "volatile", "persistent", "missing"})
+
+	got := s.Keys("*")
+	sort.Strings(got)
+	if want := []string{"persistent", "volatile"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expire() kept %v, want %v", got, want)
+	}
+	if _, ok := s.shard("expired").keys["expired"]; ok {
+		t.Errorf("expire() kept the expired entry in memory")
+	}
+}
+
+func TestActiveExpiry_cycle(t *testing.T) {
+	past := time.Now().Add(-time.Second).UnixMilli()
+	future := time.Now().Add(time.Hour).UnixMilli()
+
+	tests := []struct {
+		name        string
+		expired     int
+		volatile    int
+		persistent  int
+		budget      time.Duration
+		wantRemoved int
+	}{
+		{
+			name:        "Test cycle removes expired keys",
+			expired:     1000,
+			volatile:    100,
+			persistent:  100,
+			budget:      time.Second,
+			wantRemoved: 1000,
+		},
+		{
+			name:        "Test cycle without expired keys",
+			volatile:    100,
+			persistent:  100,
+			budget:      time.Second,
+			wantRemoved: 0,
+		},
+		{
+			name:        "Test cycle out of budget",
+			expired:     100,
+			budget:      0,
+			wantRemoved: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbs := newDatabases(2)
+			for i := 0; i < tt.expired; i++ {
+				dbs[i%2].Set("expired"+strconv.Itoa(i), "v", past)
+			}
+			for i := 0; i < tt.volatile; i++ {
+				dbs[i%2].Set("volatile"+strconv.Itoa(i), "v", future)
+			}
+			for i := 0; i < tt.persistent; i++ {
+				dbs[i%2].Set("persistent"+strconv.Itoa(i), "v", 0)
+			}
+
+			a := &ActiveExpiry{}
+			if got := a.cycle(dbs, tt.budget); got != tt.wantRemoved {
+				t.Errorf("cycle() = %d, want %d", got, tt.wantRemoved)
+			}
+
+			var left int
+			for _, db := range dbs {
+				for _, sh := range db.shards {
+					left += len(sh.keys)
+				}
+			}
+			if want := tt.expired + tt.volatile + tt.persistent - tt.wantRemoved; left != want {
+				t.Errorf("cycle() left %d keys, want %d", left, want)
+			}
+		})
+	}
+}
+
+func Test_matchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		str     string
+		want    bool
+	}{
+		{pattern: "*", str: "anything", want: true},
+		{pattern: "h?llo", str: "hello", want: true},
+		{pattern: "h?llo", str: "hllo", want: false},
+		{pattern: "h*llo", str: "heeeello", want: true},
+		{pattern: "h[ae]llo", str: "hallo", want: true},
+		{pattern: "h[ae]llo", str: "hillo", want: false},
+		{pattern: "h[^e]llo", str: "hallo", want: true},
+		{pattern: "h[^e]llo", str: "hello", want: false},
+		{pattern: "h[a-b]llo", str: "hbllo", want: true},
+		{pattern: "h\\*llo", str: "h*llo", want: true},
+		{pattern: "h\\*llo", str: "hello", want: false},
+		{pattern: "user:*:name", str: "user:1/2:name", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.str, func(t *testing.T) {
+			if got := matchPattern(tt.pattern, tt.str); got != tt.want {
+				t.Errorf("matchPattern() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// benchmarkStorage runs SET and GET commands from parallel clients, every
+// one of them taking its locks with the given function.
+func benchmarkStorage(b *testing.B, lock func(s *Storage, key string, write bool) func()) {
+	s := NewStorage()
+
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+
+			if i%4 == 0 {
+				unlock := lock(s, key, true)
+				s.Set(key, "value", 0)
+				unlock()
+			} else {
+				unlock := lock(s, key, false)
+				s.Get(key)
+				unlock()
+			}
+
+			i++
+		}
+	})
+}
+
+func BenchmarkStorage_Sharded(b *testing.B) {
+	benchmarkStorage(b, func(s *Storage, key string, write bool) func() {
+		return s.Lock([]string{key}, write)
+	})
+}
+
+// BenchmarkStorage_GlobalLock is the baseline of a keyspace behind a single lock.
+func BenchmarkStorage_GlobalLock(b *testing.B) {
+	benchmarkStorage(b, func(s *Storage, key string, write bool) func() {
+		return s.LockAll(write)
+	})
+}
@@ -10,6 +10,36 @@ import (
 // Stream represents a stream
 type Stream struct {
 	entries []*StreamEntry
+
+	// ID of the last entry ever added, deleted entries included
+	lastID       string
+	entriesAdded int64
+	maxDeletedID string
+	groups       []*ConsumerGroup
+}
+
+// ConsumerGroup represents a consumer group of a stream
+type ConsumerGroup struct {
+	name        string
+	lastID      string
+	entriesRead int64
+	pending     []*PendingEntry
+	consumers   []*Consumer
+}
+
+// PendingEntry represents an entry delivered to a consumer but not acknowledged yet
+type PendingEntry struct {
+	id            string
+	consumer      string
+	deliveryTime  int64
+	deliveryCount int64
+}
+
+// Consumer represents a consumer of a consumer group
+type Consumer struct {
+	name       string
+	seenTime   int64
+	activeTime int64
 }
 
 // NewStream is the Stream constructor
@@ -19,6 +49,11 @@ func NewStream() *Stream {
 	}
 }
 
+// Type returns TypeStream.
+func (*Stream) Type() ValueType {
+	return TypeStream
+}
+
 // StreamEntry represents each individual entry added to a stream
 type StreamEntry struct {
 	id      string
@@ -132,6 +167,15 @@ func autoGenID(stream *Stream) (string, error) {
 }
 
 func getTimeAndSeq(id string) (int, int, error) {
+	if !strings.Contains(id, "-") {
+		millisecondsTime, err := strconv.Atoi(id)
+		if err != nil {
+			return -1, -1, fmt.Errorf("Atoi failed: %v", err)
+		}
+
+		return millisecondsTime, 0, nil
+	}
+
 	millisecondsTime, err := strconv.Atoi(id[:strings.IndexByte(id, '-')])
 	if err != nil {
 		return -1, -1, fmt.Errorf("Atoi failed: %v", err)
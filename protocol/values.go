@@ -0,0 +1,75 @@
+package protocol
+
+// List represents a list value.
+type List struct {
+	elems []string
+}
+
+// NewList is the List constructor
+func NewList(elems ...string) *List {
+	return &List{
+		elems: elems,
+	}
+}
+
+// Type returns TypeList.
+func (*List) Type() ValueType {
+	return TypeList
+}
+
+// Set represents a set value.
+type Set struct {
+	members map[string]struct{}
+}
+
+// NewSet is the Set constructor
+func NewSet(members ...string) *Set {
+	s := &Set{
+		members: make(map[string]struct{}, len(members)),
+	}
+
+	for _, m := range members {
+		s.members[m] = struct{}{}
+	}
+
+	return s
+}
+
+// Type returns TypeSet.
+func (*Set) Type() ValueType {
+	return TypeSet
+}
+
+// ZSet represents a sorted set value.
+type ZSet struct {
+	scores map[string]float64
+}
+
+// NewZSet is the ZSet constructor
+func NewZSet() *ZSet {
+	return &ZSet{
+		scores: make(map[string]float64),
+	}
+}
+
+// Type returns TypeZSet.
+func (*ZSet) Type() ValueType {
+	return TypeZSet
+}
+
+// Hash represents a hash value.
+type Hash struct {
+	fields map[string]string
+}
+
+// NewHash is the Hash constructor
+func NewHash() *Hash {
+	return &Hash{
+		fields: make(map[string]string),
+	}
+}
+
+// Type returns TypeHash.
+func (*Hash) Type() ValueType {
+	return TypeHash
+}
@@ -0,0 +1,417 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Redis serializes small aggregates as a single RDB string holding one of
+// the compact encodings decoded below: ziplists, listpacks, intsets and zipmaps.
+// Integers are returned in their decimal form, like Redis does.
+
+// blobReader reads an encoded blob while checking its bounds.
+type blobReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *blobReader) next(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.b) {
+		return nil, fmt.Errorf("unexpected end of data at offset %d", r.pos)
+	}
+
+	b := r.b[r.pos : r.pos+n]
+	r.pos += n
+
+	return b, nil
+}
+
+func (r *blobReader) byte() (byte, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+
+	return b[0], nil
+}
+
+func (r *blobReader) string(n int) (string, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func (r *blobReader) int(n int) (string, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return "", err
+	}
+
+	var v int64
+	switch n {
+	case 1:
+		v = int64(int8(b[0]))
+	case 2:
+		v = int64(int16(binary.LittleEndian.Uint16(b)))
+	case 3:
+		v = int64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8)
+	case 4:
+		v = int64(int32(binary.LittleEndian.Uint32(b)))
+	case 8:
+		v = int64(binary.LittleEndian.Uint64(b))
+	}
+
+	return strconv.FormatInt(v, 10), nil
+}
+
+// decodeZiplist returns the elements of a ziplist.
+func decodeZiplist(b []byte) ([]string, error) {
+	r := &blobReader{b: b}
+
+	// zlbytes, zltail and zllen
+	if _, err := r.next(10); err != nil {
+		return nil, err
+	}
+
+	elems := make([]string, 0)
+	for {
+		prevlen, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+
+		if prevlen == 0xff {
+			return elems, nil
+		}
+
+		if prevlen == 0xfe {
+			if _, err := r.next(4); err != nil {
+				return nil, err
+			}
+		}
+
+		enc, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+
+		var elem string
+		switch {
+		case enc>>6 == 0b00:
+			elem, err = r.string(int(enc & 0x3f))
+		case enc>>6 == 0b01:
+			var next byte
+			next, err = r.byte()
+			if err == nil {
+				elem, err = r.string(int(enc&0x3f)<<8 | int(next))
+			}
+		case enc == 0x80:
+			var length []byte
+			length, err = r.next(4)
+			if err == nil {
+				elem, err = r.string(int(binary.BigEndian.Uint32(length)))
+			}
+		case enc == 0xc0:
+			elem, err = r.int(2)
+		case enc == 0xd0:
+			elem, err = r.int(4)
+		case enc == 0xe0:
+			elem, err = r.int(8)
+		case enc == 0xf0:
+			elem, err = r.int(3)
+		case enc == 0xfe:
+			elem, err = r.int(1)
+		case enc >= 0xf1 && enc <= 0xfd:
+			elem = strconv.Itoa(int(enc&0x0f) - 1)
+		default:
+			return nil, fmt.Errorf("invalid ziplist encoding %08b", enc)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		elems = append(elems, elem)
+	}
+}
+
+// decodeListpack returns the elements of a listpack.
+func decodeListpack(b []byte) ([]string, error) {
+	r := &blobReader{b: b}
+
+	// total bytes and number of elements
+	if _, err := r.next(6); err != nil {
+		return nil, err
+	}
+
+	elems := make([]string, 0)
+	for {
+		enc, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+
+		if enc == 0xff {
+			return elems, nil
+		}
+
+		var elem string
+		var size int // size of the encoding and data, stored again backwards after them
+
+		switch {
+		case enc&0x80 == 0:
+			elem, size = strconv.Itoa(int(enc)), 1
+		case enc&0xc0 == 0x80:
+			length := int(enc & 0x3f)
+			elem, err = r.string(length)
+			size = 1 + length
+		case enc&0xe0 == 0xc0:
+			var next byte
+			next, err = r.byte()
+
+			v := int(enc&0x1f)<<8 | int(next)
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			elem, size = strconv.Itoa(v), 2
+		case enc&0xf0 == 0xe0:
+			var next byte
+			next, err = r.byte()
+			if err == nil {
+				length := int(enc&0x0f)<<8 | int(next)
+				elem, err = r.string(length)
+				size = 2 + length
+			}
+		case enc == 0xf0:
+			var length []byte
+			length, err = r.next(4)
+			if err == nil {
+				l := int(binary.LittleEndian.Uint32(length))
+				elem, err = r.string(l)
+				size = 5 + l
+			}
+		case enc == 0xf1:
+			elem, err = r.int(2)
+			size = 3
+		case enc == 0xf2:
+			elem, err = r.int(3)
+			size = 4
+		case enc == 0xf3:
+			elem, err = r.int(4)
+			size = 5
+		case enc == 0xf4:
+			elem, err = r.int(8)
+			size = 9
+		default:
+			return nil, fmt.Errorf("invalid listpack encoding %08b", enc)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := r.next(listpackBacklenSize(size)); err != nil {
+			return nil, err
+		}
+
+		elems = append(elems, elem)
+	}
+}
+
+// listpackBacklenSize returns the number of bytes used to store the given entry size.
+func listpackBacklenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// encodeListpack returns a listpack holding the given elements.
+// Elements that are integers are stored in the smallest integer encoding.
+func encodeListpack(elems []string) []byte {
+	// total bytes and number of elements, set once the elements are appended
+	b := make([]byte, 6, 64)
+
+	for _, elem := range elems {
+		start := len(b)
+		b = appendListpackElement(b, elem)
+		b = appendListpackBacklen(b, len(b)-start)
+	}
+	b = append(b, 0xff)
+
+	n := len(elems)
+	if n > 0xffff {
+		n = 0xffff // unknown, elements must be counted
+	}
+
+	binary.LittleEndian.PutUint32(b, uint32(len(b)))
+	binary.LittleEndian.PutUint16(b[4:], uint16(n))
+
+	return b
+}
+
+// appendListpackElement appends the encoding and data of an element.
+func appendListpackElement(b []byte, elem string) []byte {
+	if v, err := strconv.ParseInt(elem, 10, 64); err == nil && strconv.FormatInt(v, 10) == elem {
+		switch {
+		case v >= 0 && v <= 127:
+			return append(b, byte(v))
+		case v >= -4096 && v <= 4095:
+			u := uint16(v) & 0x1fff
+			return append(b, 0xc0|byte(u>>8), byte(u))
+		case v >= math.MinInt16 && v <= math.MaxInt16:
+			return binary.LittleEndian.AppendUint16(append(b, 0xf1), uint16(v))
+		case v >= -1<<23 && v < 1<<23:
+			return append(b, 0xf2, byte(v), byte(v>>8), byte(v>>16))
+		case v >= math.MinInt32 && v <= math.MaxInt32:
+			return binary.LittleEndian.AppendUint32(append(b, 0xf3), uint32(v))
+		default:
+			return binary.LittleEndian.AppendUint64(append(b, 0xf4), uint64(v))
+		}
+	}
+
+	switch n := len(elem); {
+	case n < 64:
+		b = append(b, 0x80|byte(n))
+	case n < 4096:
+		b = append(b, 0xe0|byte(n>>8), byte(n))
+	default:
+		b = binary.LittleEndian.AppendUint32(append(b, 0xf0), uint32(n))
+	}
+
+	return append(b, elem...)
+}
+
+// appendListpackBacklen appends the size of an entry, stored so it can be read backwards:
+// the most significant 7 bits first, every byte but the first one having its high bit set.
+func appendListpackBacklen(b []byte, size int) []byte {
+	n := listpackBacklenSize(size)
+	for i := n - 1; i >= 0; i-- {
+		c := byte(size>>(7*i)) & 0x7f
+		if i < n-1 {
+			c |= 0x80
+		}
+		b = append(b, c)
+	}
+
+	return b
+}
+
+// decodeIntset returns the members of an intset.
+func decodeIntset(b []byte) ([]string, error) {
+	r := &blobReader{b: b}
+
+	header, err := r.next(8)
+	if err != nil {
+		return nil, err
+	}
+
+	width := int(binary.LittleEndian.Uint32(header[:4]))
+	if width != 2 && width != 4 && width != 8 {
+		return nil, fmt.Errorf("invalid intset encoding %d", width)
+	}
+
+	n := int(binary.LittleEndian.Uint32(header[4:]))
+	if n*width != len(b)-8 {
+		return nil, fmt.Errorf("intset length %d doesn't match its size %d", n, len(b))
+	}
+
+	members := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		m, err := r.int(width)
+		if err != nil {
+			return nil, err
+		}
+
+		members = append(members, m)
+	}
+
+	return members, nil
+}
+
+// decodeZipmap returns the fields and values of a zipmap, one after the other.
+func decodeZipmap(b []byte) ([]string, error) {
+	r := &blobReader{b: b}
+
+	// zmlen
+	if _, err := r.byte(); err != nil {
+		return nil, err
+	}
+
+	elems := make([]string, 0)
+	for {
+		length, end, err := zipmapLength(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if end {
+			if len(elems)%2 != 0 {
+				return nil, fmt.Errorf("zipmap field without value")
+			}
+
+			return elems, nil
+		}
+
+		field, err := r.string(length)
+		if err != nil {
+			return nil, err
+		}
+
+		length, end, err = zipmapLength(r)
+		if err != nil || end {
+			return nil, fmt.Errorf("zipmap field without value")
+		}
+
+		free, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := r.string(length)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := r.next(int(free)); err != nil {
+			return nil, err
+		}
+
+		elems = append(elems, field, value)
+	}
+}
+
+// zipmapLength reads the length of the next zipmap string or its end marker.
+func zipmapLength(r *blobReader) (int, bool, error) {
+	b, err := r.byte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch b {
+	case 0xff:
+		return 0, true, nil
+	case 0xfe:
+		length, err := r.next(4)
+		if err != nil {
+			return 0, false, err
+		}
+
+		return int(binary.LittleEndian.Uint32(length)), false, nil
+	default:
+		return int(b), false, nil
+	}
+}